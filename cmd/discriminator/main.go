@@ -1,13 +1,15 @@
 package main
 
 import (
+	"os"
+
 	"github.com/sirupsen/logrus"
 
 	"sidus.io/discriminator/internal/app/discriminator"
 )
 
 func main() {
-	err := discriminator.Start()
+	err := discriminator.Execute(os.Args[1:])
 	if err != nil {
 		logrus.WithError(err).Fatalf("Application stopped with error")
 	}
@@ -0,0 +1,368 @@
+package discriminator
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/backup"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/settings"
+	"sidus.io/discriminator/internal/pkg/state"
+	"sidus.io/discriminator/internal/pkg/templates"
+)
+
+// Execute runs the command given by the arguments, or starts the application if there are none
+func Execute(args []string) error {
+	if len(args) == 0 {
+		return Start()
+	}
+	ctx := context.Background()
+	var err error
+	switch args[0] {
+	case "run":
+		err = Start()
+	case "audit":
+		err = auditCommand(ctx, args[1:], os.Stdout)
+	case "backups":
+		err = backupsCommand(ctx, args[1:], os.Stdout)
+	case "test":
+		err = testCommand(ctx, args[1:], os.Stdout)
+	case "compose":
+		err = composeCommand(ctx, args[1:], os.Stdout)
+	case "restore":
+		err = restoreCommand(ctx, args[1:], os.Stdout)
+	case "state":
+		err = stateCommand(ctx, args[1:], os.Stdout)
+	default:
+		err = fmt.Errorf("unknown command %s", args[0])
+	}
+	if err == flag.ErrHelp {
+		return nil
+	}
+	return err
+}
+
+// auditCommand prints the audit log entries of a container
+func auditCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator audit [flags] [container name]\n")
+		flags.PrintDefaults()
+	}
+	path := flags.String("path", s.AuditLogPath(), "path to the audit log")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return fmt.Errorf("no audit log configured")
+	}
+
+	auditLog, err := audit.NewFile(ctx, *path)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log")
+	}
+	entries, err := auditLog.Query(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tNAME\tOUTCOME\tOLD ID\tNEW ID\tDURATION\tCHANGED LABELS\tERROR")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.1fs\t%s\t%s\n",
+			entry.Time.Format(time.RFC3339),
+			strings.TrimPrefix(entry.Name, "/"),
+			entry.Outcome,
+			shortID(entry.OldID),
+			shortID(entry.NewID),
+			entry.DurationSeconds,
+			strings.Join(entry.Diff.Keys(), ","),
+			entry.Error,
+		)
+	}
+	return w.Flush()
+}
+
+// backupsCommand lists the backups of a container
+func backupsCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("backups", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator backups [flags] [container name]\n")
+		flags.PrintDefaults()
+	}
+	path := flags.String("path", s.BackupPath(), "path to the backup directory")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	backups, err := openBackups(ctx, *path)
+	if err != nil {
+		return err
+	}
+	list, err := backups.List(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKUP\tTIME\tNAME\tCONTAINER ID")
+	for _, b := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", b.File, b.Time.Format(time.RFC3339), b.Name, b.ContainerID)
+	}
+	return w.Flush()
+}
+
+// restoreCommand recreates a container from a backup
+func restoreCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator restore [flags] <backup>\n")
+		flags.PrintDefaults()
+	}
+	path := flags.String("path", s.BackupPath(), "path to the backup directory")
+	hostName := flags.String("host", "", "name of the docker host in the hosts file to restore to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one backup")
+	}
+	backups, err := openBackups(ctx, *path)
+	if err != nil {
+		return err
+	}
+	container, err := backups.Load(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	endpoint, err := findEndpoint(ctx, s, *hostName)
+	if err != nil {
+		return err
+	}
+	dockerClient, backend, err := connect(ctx, endpoint)
+	if err != nil {
+		return err
+	}
+	dockerService, err := docker.NewService(ctx, dockerClient, docker.ServiceOptions{Host: *hostName, Backend: backend})
+	if err != nil {
+		return errors.Wrapf(err, "failed to create docker service")
+	}
+	defer dockerService.Close()
+	newID, err := dockerService.Restore(ctx, container)
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore %s", flags.Arg(0))
+	}
+	fmt.Fprintf(out, "Restored %s as %s\n", strings.TrimPrefix(container.Name, "/"), shortID(newID))
+	return nil
+}
+
+// stateCommand prints, clears or releases the reconciliation history of containers
+func stateCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("state", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator state [flags] [container or compose service]\n")
+		flags.PrintDefaults()
+	}
+	path := flags.String("path", s.DataDir(), "path to the data directory")
+	clear := flags.Bool("clear", false, "clear the history instead of printing it, of all containers if none is given")
+	release := flags.Bool("release", false, "release from quarantine and retry failed updates right away")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return fmt.Errorf("no data directory configured")
+	}
+	if *clear && *release {
+		return fmt.Errorf("only one of -clear and -release can be given")
+	}
+	store, err := state.NewStore(ctx, *path)
+	if err != nil {
+		return err
+	}
+	match := matchKey(flags.Arg(0))
+
+	if *clear {
+		deleted, err := store.Delete(match)
+		if err != nil {
+			return err
+		}
+		for _, key := range deleted {
+			fmt.Fprintf(out, "Cleared %s\n", key)
+		}
+		return nil
+	}
+	if *release {
+		released, err := store.Update(match, func(record *state.Record) { record.Release() })
+		if err != nil {
+			return err
+		}
+		for _, key := range released {
+			fmt.Fprintf(out, "Released %s\n", key)
+		}
+		return nil
+	}
+	records, err := store.List(match)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tCONTAINER ID\tAPPLIED\tFAILURES\tQUARANTINED\tRETRY AT\tLAST ERROR")
+	for _, record := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%t\t%s\t%s\n",
+			record.Key,
+			shortID(record.ContainerID),
+			formatTime(record.AppliedAt),
+			record.Failures,
+			record.Quarantined,
+			formatTime(record.RetryAt),
+			record.LastError,
+		)
+	}
+	return w.Flush()
+}
+
+// matchKey matches the state keys of a container or compose service,
+// with or without the name of the host, ex. "web", "local/web" or "project/service"
+//
+// An empty name matches every key
+func matchKey(name string) func(key string) bool {
+	name = strings.TrimPrefix(name, "/")
+	return func(key string) bool {
+		if name == "" || key == name {
+			return true
+		}
+		parts := strings.SplitN(key, "/", 2)
+		return len(parts) == 2 && parts[1] == name
+	}
+}
+
+// formatTime formats the time for tables, the zero time as "-"
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// testCommand runs the test cases of the templates and fails if any case fails
+func testCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator test [flags] [template name]\n")
+		flags.PrintDefaults()
+	}
+	path := flags.String("path", s.TemplatesPath(), "path to the templates")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	tmpls, partials, err := templates.LoadTemplatesFromPath(ctx, *path, s.TemplatesExtension())
+	if err != nil {
+		return errors.Wrapf(err, "failed to load templates")
+	}
+	directory, err := templates.NewDirectory(ctx, tmpls, partials)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create template directory")
+	}
+	tests, err := templates.LoadTestsFromPath(ctx, *path)
+	if err != nil {
+		return err
+	}
+
+	passed, failed := 0, 0
+	for _, t := range tests {
+		if flags.Arg(0) != "" && t.Template != flags.Arg(0) {
+			continue
+		}
+		for i, c := range t.Cases {
+			name := c.Name
+			if name == "" {
+				name = fmt.Sprintf("case %d", i+1)
+			}
+			err := directory.RunTest(ctx, t.Template, c)
+			if err != nil {
+				failed++
+				fmt.Fprintf(out, "FAIL %s: %s\n  %s\n", t.Template, name, strings.Replace(err.Error(), "\n", "\n  ", -1))
+				continue
+			}
+			passed++
+			fmt.Fprintf(out, "ok   %s: %s\n", t.Template, name)
+		}
+	}
+	fmt.Fprintf(out, "%d passed, %d failed\n", passed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d template tests failed", failed)
+	}
+	return nil
+}
+
+// findEndpoint returns the named host in the hosts file, or the host configured by the environment if the name is empty
+func findEndpoint(ctx context.Context, s settings.Settings, name string) (docker.Endpoint, error) {
+	if name == "" {
+		return docker.EnvEndpoint(), nil
+	}
+	if s.HostsFile() == "" {
+		return docker.Endpoint{}, fmt.Errorf("no hosts file configured")
+	}
+	endpoints, err := docker.LoadEndpointsFromPath(ctx, s.HostsFile())
+	if err != nil {
+		return docker.Endpoint{}, err
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Name == name {
+			return endpoint, nil
+		}
+	}
+	return docker.Endpoint{}, fmt.Errorf("no host named %s in %s", name, s.HostsFile())
+}
+
+func openBackups(ctx context.Context, path string) (*backup.Directory, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no backup directory configured")
+	}
+	// Retention is only applied when saving, so the limits don't matter here
+	return backup.NewDirectory(ctx, path, 0, 0)
+}
+
+// shortID shortens a container id the same way as the docker cli
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
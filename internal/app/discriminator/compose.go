@@ -0,0 +1,137 @@
+package discriminator
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/compose"
+	"sidus.io/discriminator/internal/pkg/settings"
+	"sidus.io/discriminator/pkg/engine"
+)
+
+// composeCommand resolves the labels of the services in a compose file without touching any containers
+//
+// The result is written to a file or stdout, or with -check the command fails if any labels would change
+func composeCommand(ctx context.Context, args []string, out io.Writer) error {
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load settings")
+	}
+	flags := flag.NewFlagSet("compose", flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintf(out, "Usage: discriminator compose [flags] <compose file>\n")
+		flags.PrintDefaults()
+	}
+	output := flags.String("o", "-", "file to write the rewritten compose file to, - for stdout")
+	check := flags.Bool("check", false, "fail if the labels in the compose file are out of date instead of writing it")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected exactly one compose file")
+	}
+
+	file, err := compose.LoadFromPath(ctx, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	e, err := setupEngine(ctx, s)
+	if err != nil {
+		return err
+	}
+	diffs, err := rewriteCompose(ctx, e, file)
+	if err != nil {
+		return err
+	}
+
+	if *check {
+		for _, service := range sortedKeys(diffs) {
+			fmt.Fprintf(out, "%s: %s\n", service, describeDiff(diffs[service]))
+		}
+		if len(diffs) > 0 {
+			return fmt.Errorf("labels of %d services in %s are out of date", len(diffs), flags.Arg(0))
+		}
+		return nil
+	}
+	content, err := file.Marshal()
+	if err != nil {
+		return errors.Wrapf(err, "failed to write compose file")
+	}
+	if *output == "-" {
+		_, err = out.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(*output, content, 0644) //nolint:gosec
+}
+
+// rewriteCompose resolves the labels of every service in the file with an instruction and sets them
+//
+// The name of the service and its declared labels are used as container data,
+// changes the policy doesn't allow are logged and left out.
+// Returns the changes to the labels of the services that changed
+func rewriteCompose(ctx context.Context, e *engine.Engine, file *compose.File) (map[string]audit.Diff, error) {
+	services, err := file.Services()
+	if err != nil {
+		return nil, err
+	}
+	diffs := make(map[string]audit.Diff)
+	for _, service := range services {
+		if e.Instruction("", service.Labels) == "" {
+			continue
+		}
+		result, err := e.Evaluate(ctx, "", engine.ContainerData{Name: service.Name, Labels: service.Labels})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to resolve labels of service %s", service.Name)
+		}
+		labels := result.Labels
+		for _, violation := range result.Violations {
+			logrus.WithContext(ctx).Warnf("Change to service %s not allowed, %s", service.Name, violation)
+		}
+		if stringMapEquals(labels, service.Labels) {
+			continue
+		}
+		diffs[service.Name] = audit.NewDiff(service.Labels, labels)
+		err = file.SetLabels(service.Name, labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return diffs, nil
+}
+
+// describeDiff lists the changed labels, ex. "+a=1 -b ~c=2"
+func describeDiff(diff audit.Diff) string {
+	changes := make([]string, 0, len(diff.Keys()))
+	for _, key := range diff.Keys() {
+		if value, ok := diff.Added[key]; ok {
+			changes = append(changes, "+"+key+"="+value)
+		}
+		if _, ok := diff.Removed[key]; ok {
+			changes = append(changes, "-"+key)
+		}
+		if change, ok := diff.Changed[key]; ok {
+			changes = append(changes, "~"+key+"="+change.To)
+		}
+	}
+	return strings.Join(changes, " ")
+}
+
+func sortedKeys(diffs map[string]audit.Diff) []string {
+	keys := make([]string, 0, len(diffs))
+	for key := range diffs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
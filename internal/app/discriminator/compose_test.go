@@ -0,0 +1,87 @@
+package discriminator
+
+import (
+	"context"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/compose"
+)
+
+func Test_rewriteCompose(t *testing.T) {
+	ctx := context.Background()
+	e := newEngine(t, "instruction", map[string]string{"named": "+name={{.Name}}\n+port={{index .Labels \"port\"}}"})
+
+	tests := []struct {
+		name      string
+		content   string
+		want      string
+		wantDiffs []string
+		wantErr   bool
+	}{
+		{
+			name: "rewritten",
+			content: `services:
+  web:
+    image: nginx
+    labels:
+      instruction: named()
+      port: "80"
+  db:
+    image: postgres
+`,
+			want: `services:
+  web:
+    image: nginx
+    labels:
+      instruction: named()
+      name: web
+      port: "80"
+  db:
+    image: postgres
+`,
+			wantDiffs: []string{"web"},
+		},
+		{
+			name:    "up to date",
+			content: "services:\n  web:\n    labels: [instruction=named(), name=web, port=]\n",
+		},
+		{
+			name:    "unknown template",
+			content: "services:\n  web:\n    labels: [instruction=unknown()]\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file, err := compose.Parse([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			diffs, err := rewriteCompose(ctx, e, file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rewriteCompose() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(diffs) != len(tt.wantDiffs) {
+				t.Errorf("rewriteCompose() changed %v, want %v", sortedKeys(diffs), tt.wantDiffs)
+			}
+			for _, service := range tt.wantDiffs {
+				if _, ok := diffs[service]; !ok {
+					t.Errorf("rewriteCompose() didn't change service %s", service)
+				}
+			}
+			if tt.want == "" {
+				return
+			}
+			got, err := file.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("rewriteCompose() wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package discriminator
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"sidus.io/discriminator/internal/pkg/api"
+	"sidus.io/discriminator/internal/pkg/logging"
+	"sidus.io/discriminator/internal/pkg/settings"
+	"sidus.io/discriminator/internal/pkg/state"
+)
+
+// request is work the main loop executes between iterations on behalf of the api
+type request func(ctx context.Context, svc *services)
+
+// controller implements the api by sending requests to the main loop,
+// so requests never run concurrently with iterations or each other
+type controller struct {
+	requests chan request
+	settings settings.Settings
+
+	mu     sync.Mutex
+	status api.Status
+}
+
+func newController(s settings.Settings) *controller {
+	return &controller{
+		requests: make(chan request),
+		settings: s,
+	}
+}
+
+// Reconcile runs an iteration, or reconciles only the named container
+func (c *controller) Reconcile(ctx context.Context, name string) error {
+	return c.do(ctx, func(ctx context.Context, svc *services) error {
+		if name == "" {
+			status, err := run(ctx, *svc, c.settings)
+			if err != nil {
+				return err
+			}
+			c.setStatus(status)
+			return nil
+		}
+		h, container, err := findContainer(ctx, *svc, c.settings, name)
+		if err != nil {
+			return err
+		}
+		plan, err := reconcileContainer(ctx, *svc, h, c.settings, container)
+		if err != nil {
+			return err
+		}
+		if plan.Reason != "" {
+			return errors.Wrapf(api.ErrPostponed, "%s", plan.Reason)
+		}
+		return nil
+	})
+}
+
+// Status returns the status of the last iteration
+func (c *controller) Status(_ context.Context) api.Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// Plan resolves the labels the named container would get without applying them
+func (c *controller) Plan(ctx context.Context, name string) (api.Plan, error) {
+	var plan api.Plan
+	err := c.do(ctx, func(ctx context.Context, svc *services) error {
+		h, container, err := findContainer(ctx, *svc, c.settings, name)
+		if err != nil {
+			return err
+		}
+		plan, err = planContainer(ctx, *svc, h, c.settings, container)
+		return err
+	})
+	return plan, err
+}
+
+// ReloadTemplates replaces the label engine with one with the current templates and aliases
+//
+// The old engine is kept if the templates can't be loaded
+func (c *controller) ReloadTemplates(ctx context.Context) error {
+	return c.do(ctx, func(ctx context.Context, svc *services) error {
+		e, err := setupEngine(ctx, c.settings)
+		if err != nil {
+			return err
+		}
+		svc.engine = e
+		return nil
+	})
+}
+
+// Release releases the named container from quarantine and forgets its failed updates
+func (c *controller) Release(ctx context.Context, name string) error {
+	return c.do(ctx, func(ctx context.Context, svc *services) error {
+		_, container, err := findContainer(ctx, *svc, c.settings, name)
+		if err != nil {
+			return err
+		}
+		key := stateKey(container)
+		_, err = svc.state.Update(
+			func(k string) bool { return k == key },
+			func(record *state.Record) { record.Release() },
+		)
+		return err
+	})
+}
+
+func (c *controller) setStatus(status api.Status) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// do sends the function to the main loop and waits for it to complete
+//
+// The function is executed with the context of the main loop, since giving up on the
+// request shouldn't abort changes to containers halfway. Every request is logged as an iteration of its own.
+func (c *controller) do(ctx context.Context, f func(ctx context.Context, svc *services) error) error {
+	result := make(chan error, 1)
+	r := func(ctx context.Context, svc *services) {
+		result <- f(logging.With(ctx, logging.FieldIteration, logging.NewIterationID()), svc)
+	}
+	select {
+	case c.requests <- r:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,120 @@
+package discriminator
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"sidus.io/discriminator/internal/pkg/api"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+	"sidus.io/discriminator/internal/pkg/ratelimit"
+	"sidus.io/discriminator/internal/pkg/settings"
+)
+
+// serveRequests executes the requests of the controller like the main loop until the returned function is called
+func serveRequests(ctx context.Context, ctrl *controller, svc *services) func() {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case r := <-ctrl.requests:
+				r(ctx, svc)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func Test_controller(t *testing.T) {
+	ctx := context.Background()
+	templatesPath, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(templatesPath)
+	err = ioutil.WriteFile(filepath.Join(templatesPath, "extra.tmpl"), []byte("+b=3"), 0600)
+	if err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	os.Setenv("DISCRIMINATOR_TEMPLATES_PATH", templatesPath)
+	defer os.Unsetenv("DISCRIMINATOR_TEMPLATES_PATH")
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{label: "extra()"},
+	})
+	client.AddContainer(dockertest.Container{
+		Name:    "api",
+		Running: true,
+		Labels:  map[string]string{label: "extra()"},
+	})
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, label, map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{MaxPerHour: 1})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+	ctrl := newController(s)
+	defer serveRequests(ctx, ctrl, &svc)()
+
+	plan, err := ctrl.Plan(ctx, "web")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if plan.Labels["b"] != "2" || plan.Diff.Added["b"] != "2" {
+		t.Errorf("Plan() = %+v, want b added", plan)
+	}
+	if _, err := ctrl.Plan(ctx, "missing"); errors.Cause(err) != api.ErrContainerNotFound {
+		t.Errorf("Plan() error = %v, want %v", err, api.ErrContainerNotFound)
+	}
+
+	if err := ctrl.Reconcile(ctx, "web"); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	if web, _ := client.Container("web"); web.Config.Labels["b"] != "2" {
+		t.Errorf("container web not updated by Reconcile(), labels: %v", web.Config.Labels)
+	}
+	if err := ctrl.Reconcile(ctx, "api"); errors.Cause(err) != api.ErrPostponed {
+		t.Errorf("Reconcile() error = %v, want %v", err, api.ErrPostponed)
+	}
+
+	if err := ctrl.Reconcile(ctx, ""); err != nil {
+		t.Fatalf("Reconcile() error = %v", err)
+	}
+	status := ctrl.Status(ctx)
+	if status.LastIteration.IsZero() || len(status.Pending) != 1 || status.Pending[0].Name != "/api" {
+		t.Errorf("Status() = %+v, want api pending", status)
+	}
+
+	if err := ctrl.ReloadTemplates(ctx); err != nil {
+		t.Fatalf("ReloadTemplates() error = %v", err)
+	}
+	plan, err = ctrl.Plan(ctx, "web")
+	if err != nil {
+		t.Fatalf("Plan() error = %v", err)
+	}
+	if plan.Labels["b"] != "3" {
+		t.Errorf("Plan() after reload = %+v, want b=3", plan.Labels)
+	}
+}
@@ -2,23 +2,35 @@ package discriminator
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 
-	"github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
 
+	"sidus.io/discriminator/internal/pkg/api"
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/backup"
 	"sidus.io/discriminator/internal/pkg/docker"
-	"sidus.io/discriminator/internal/pkg/parsing"
+	"sidus.io/discriminator/internal/pkg/logging"
+	"sidus.io/discriminator/internal/pkg/policy"
+	"sidus.io/discriminator/internal/pkg/ratelimit"
 	"sidus.io/discriminator/internal/pkg/settings"
-	"sidus.io/discriminator/internal/pkg/templates"
+	"sidus.io/discriminator/internal/pkg/sources"
+	"sidus.io/discriminator/internal/pkg/state"
+	"sidus.io/discriminator/internal/pkg/tracing"
+	"sidus.io/discriminator/internal/pkg/webhook"
+	"sidus.io/discriminator/pkg/engine"
 )
 
 func Start() error {
-	ctx := context.WithValue(context.Background(), "phase", "setup")
+	ctx := logging.With(context.Background(), logging.FieldPhase, "setup")
 
 	logrus.WithContext(ctx).Infof("Loading settings")
 	s, err := settings.NewSettings(ctx)
@@ -29,133 +41,862 @@ func Start() error {
 
 	logrus.SetFormatter(s.LogFormatter())
 	logrus.SetLevel(s.LogLevel())
+	logrus.AddHook(logging.Hook{})
+
+	ctx, exporter, err := setupTracing(ctx, s)
+	if err != nil {
+		return err
+	}
+	if exporter != nil {
+		defer exporter.Close()
+	}
 
 	logrus.WithContext(ctx).Infof("Setting up necessary services")
-	dockerService, parser, err := setup(ctx, s)
+	svc, err := setup(ctx, s)
 	if err != nil {
 		return errors.Wrapf(err, "failed during setup")
 	}
-	defer func() {
-		err := dockerService.Close()
+	defer svc.close()
+	logrus.WithContext(ctx).Infof("Setup completed")
+
+	ctrl := newController(s)
+	if address := s.APIAddress(); address != "" {
+		server, err := startAPI(ctx, address, ctrl)
 		if err != nil {
-			logrus.WithError(err).Errorf("Could not close docker service")
+			return err
 		}
-	}()
-	logrus.WithContext(ctx).Infof("Setup completed")
+		defer func() {
+			err := server.Close()
+			if err != nil {
+				logrus.WithContext(ctx).WithError(err).Errorf("Could not close api server")
+			}
+		}()
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	defer signal.Stop(c)
 
-	ctx = context.WithValue(ctx, "phase", "operating")
-	stop := false
-	for {
+	ctx = logging.With(ctx, logging.FieldPhase, "operating")
+	return loop(ctx, svc, s, ctrl, c)
+}
+
+// loop runs an iteration every run interval and executes api requests in between, until stopped
+func loop(ctx context.Context, svc services, s settings.Settings, ctrl *controller, stop <-chan os.Signal) error {
+	iterate := func() error {
+		ctx := logging.With(ctx, logging.FieldIteration, logging.NewIterationID())
 		logrus.WithContext(ctx).Infof("Starting iteration...")
-		ctx := context.WithValue(ctx, "runStartedAt", time.Now())
-		err := run(ctx, dockerService, parser, s)
+		status, err := run(ctx, svc, s)
 		if err != nil {
 			return err
 		}
+		ctrl.setStatus(status)
 		logrus.WithContext(ctx).Infof("Iteration completed, sleeping for %.0f minutes.", s.RunInterval().Minutes())
-
+		return nil
+	}
+	if err := iterate(); err != nil {
+		return err
+	}
+	timer := time.NewTimer(s.RunInterval())
+	defer timer.Stop()
+	for {
 		select {
-		case <-c:
-			stop = true
+		case <-stop:
 			logrus.WithContext(ctx).Infof("Received stop signal")
-			break
-		case <-time.After(s.RunInterval()):
-			break
+			return nil
+		case <-timer.C:
+			if err := iterate(); err != nil {
+				return err
+			}
+			timer.Reset(s.RunInterval())
+		case request := <-ctrl.requests:
+			request(ctx, &svc)
 		}
+	}
+}
 
-		if stop {
-			break
-		}
+// startAPI serves the api on the address in the background
+func startAPI(ctx context.Context, address string, ctrl *controller) (*api.Server, error) {
+	listener, err := api.Listen(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to listen on %s", address)
 	}
-	return nil
+	server, err := api.NewServer(ctx, ctrl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create api server")
+	}
+	logrus.WithContext(ctx).Infof("Serving api on %s", address)
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			logrus.WithContext(ctx).WithError(err).Errorf("API server stopped")
+		}
+	}()
+	return server, nil
+}
+
+// services holds everything needed to run an iteration
+type services struct {
+	engine   *engine.Engine
+	notifier *webhook.Notifier
+	state    *state.Store
+	hosts    []host
+}
+
+// host holds everything needed to reconcile the containers of one docker host
+type host struct {
+	name    string
+	docker  *docker.Service
+	sources sources.Sources
+	limiter *ratelimit.Limiter
 }
 
 // Creates all services needed to run the application
-func setup(ctx context.Context, s settings.Settings) (*docker.Service, parsing.Parser, error) {
-	logrus.WithContext(ctx).Infof("Building templates directory...")
-	tmpls, err := templates.LoadTemplatesFromPath(ctx, s.TemplatesPath(), s.TemplatesExtension())
+func setup(ctx context.Context, s settings.Settings) (services, error) {
+	e, err := setupEngine(ctx, s)
 	if err != nil {
-		return nil, parsing.Parser{}, errors.Wrapf(err, "failed to load templates")
+		return services{}, err
+	}
+
+	options, err := setupServiceOptions(ctx, s)
+	if err != nil {
+		return services{}, err
+	}
+	notifier, err := setupNotifier(ctx, s)
+	if err != nil {
+		return services{}, err
+	}
+	if notifier != nil {
+		logs := auditLogs{notifier}
+		if options.AuditLog != nil {
+			logs = append(logs, options.AuditLog)
+		}
+		options.AuditLog = logs
 	}
-	templateDirectory, err := templates.NewDirectory(ctx, tmpls, s.TemplatesExtension())
+	fileSources, err := setupFileSource(ctx, s)
 	if err != nil {
-		return nil, parsing.Parser{}, errors.Wrapf(err, "failed to create template directory")
+		return services{}, err
 	}
-	logrus.WithContext(ctx).Infof("Built templates directory with %d templates", templateDirectory.Count(ctx))
 
-	parser, err := parsing.NewParser(ctx, templateDirectory)
+	endpoints, err := setupEndpoints(ctx, s)
 	if err != nil {
-		return nil, parsing.Parser{}, errors.Wrapf(err, "failed to create parser")
+		return services{}, err
 	}
+	store, err := setupState(ctx, s)
+	if err != nil {
+		return services{}, err
+	}
+	svc := services{engine: e, notifier: notifier, state: store}
+	for _, endpoint := range endpoints {
+		dockerClient, backend, err := connect(ctx, endpoint)
+		if err != nil {
+			svc.close()
+			return services{}, err
+		}
+		h, err := setupHost(ctx, s, endpoint.Name, dockerClient, backend, options, fileSources)
+		if err != nil {
+			dockerClient.Close()
+			svc.close()
+			return services{}, err
+		}
+		svc.hosts = append(svc.hosts, h)
+	}
+	return svc, nil
+}
 
-	logrus.WithContext(ctx).Infof("Connecting to docker client")
-	dockerClient, err := client.NewEnvClient()
+// setupEndpoints returns the docker hosts of the hosts file, or the host configured by the environment
+func setupEndpoints(ctx context.Context, s settings.Settings) ([]docker.Endpoint, error) {
+	path := s.HostsFile()
+	if path == "" {
+		return []docker.Endpoint{docker.EnvEndpoint()}, nil
+	}
+	logrus.WithContext(ctx).Infof("Loading docker hosts from %s", path)
+	endpoints, err := docker.LoadEndpointsFromPath(ctx, path)
 	if err != nil {
-		return nil, parsing.Parser{}, errors.Wrapf(err, "failed to create docker client from environment")
+		return nil, errors.Wrapf(err, "failed to load docker hosts")
+	}
+	return endpoints, nil
+}
+
+// connect creates a client for the endpoint and returns it with the backend of the endpoint
+//
+// The backend is detected unless configured, a backend that can't be detected is assumed to be docker
+func connect(ctx context.Context, endpoint docker.Endpoint) (*docker.EndpointClient, string, error) {
+	logrus.WithContext(ctx).Infof("Connecting to docker host %s at %s", endpoint.Name, endpoint.Address)
+	dockerClient, err := docker.NewEndpointClient(ctx, endpoint)
+	if err != nil {
+		return nil, "", err
+	}
+	if endpoint.Backend != "" {
+		return dockerClient, endpoint.Backend, nil
 	}
-	dockerService, err := docker.NewService(ctx, dockerClient)
+	backend, err := dockerClient.DetectBackend(ctx)
 	if err != nil {
-		return nil, parsing.Parser{}, errors.Wrapf(err, "failed to create docker service")
+		logrus.WithContext(ctx).WithError(err).Warnf(
+			"Could not detect the backend of docker host %s, assuming %s", endpoint.Name, docker.BackendDocker,
+		)
+		return dockerClient, docker.BackendDocker, nil
 	}
-	return dockerService, parser, nil
+	logrus.WithContext(ctx).Infof("Docker host %s is served by %s", endpoint.Name, backend)
+	return dockerClient, backend, nil
 }
 
-// Run runs the application for one iteration
-func run(ctx context.Context, dockerService *docker.Service, parser parsing.Parser, s settings.Settings) error {
-	containers, err := dockerService.GetContainers(ctx, s.IncludeStoppedContainers())
+// setupHost creates the services of a docker host from a connected client
+func setupHost(
+	ctx context.Context,
+	s settings.Settings,
+	name string,
+	dockerClient *docker.EndpointClient,
+	backend string,
+	options docker.ServiceOptions,
+	shared sources.Sources,
+) (host, error) {
+	options.Host = name
+	options.Backend = backend
+	options.SwarmClient = dockerClient
+	dockerService, err := docker.NewService(ctx, dockerClient, options)
 	if err != nil {
-		return err
+		return host{}, errors.Wrapf(err, "failed to create docker service for host %s", name)
+	}
+	instructionSources, err := setupSources(ctx, s, shared, dockerService)
+	if err != nil {
+		return host{}, err
+	}
+	limiter, err := setupLimiter(ctx, s)
+	if err != nil {
+		return host{}, err
+	}
+	return host{
+		name:    name,
+		docker:  dockerService,
+		sources: instructionSources,
+		limiter: limiter,
+	}, nil
+}
+
+// close closes the docker clients of all hosts and sends the remaining notifications
+func (svc services) close() {
+	for _, h := range svc.hosts {
+		err := h.docker.Close()
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not close docker service of host %s", h.name)
+		}
+	}
+	if svc.notifier != nil {
+		err := svc.notifier.Close()
+		if err != nil {
+			logrus.WithError(err).Errorf("Could not close webhook notifier")
+		}
+	}
+}
+
+// setupLimiter creates a limiter with the configured rate limits and maintenance windows
+func setupLimiter(ctx context.Context, s settings.Settings) (*ratelimit.Limiter, error) {
+	options := ratelimit.Options{
+		MaxPerIteration: s.MaxRecreationsPerIteration(),
+		MaxPerHour:      s.MaxRecreationsPerHour(),
+		MinInterval:     s.MinRecreationInterval(),
+	}
+	for _, window := range s.MaintenanceWindows() {
+		parsed, err := ratelimit.ParseWindow(window)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse maintenance window")
+		}
+		options.Windows = append(options.Windows, parsed)
+	}
+	if len(options.Windows) > 0 {
+		logrus.WithContext(ctx).Infof("Limiting updates to %d maintenance windows", len(options.Windows))
+	}
+	limiter, err := ratelimit.NewLimiter(ctx, options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create rate limiter")
+	}
+	return limiter, nil
+}
+
+// setupServiceOptions creates the configured audit log and backup directory
+func setupServiceOptions(ctx context.Context, s settings.Settings) (docker.ServiceOptions, error) {
+	options := docker.ServiceOptions{
+		HealthCheck: docker.HealthCheckOptions{
+			Timeout:   s.HealthCheckTimeout(),
+			MinUptime: s.MinUptime(),
+		},
+		StrategyLabel:   s.StrategyLabel(),
+		DefaultStrategy: s.DefaultStrategy(),
+		Dependents:      s.DependentsPolicy(),
+	}
+	for _, selector := range s.StrategySelectors() {
+		options.StrategySelectors = append(options.StrategySelectors, docker.StrategySelector{
+			Pattern:  selector[0],
+			Strategy: selector[1],
+		})
+	}
+	if path := s.AuditLogPath(); path != "" {
+		logrus.WithContext(ctx).Infof("Writing audit log to %s", path)
+		auditLog, err := audit.NewFile(ctx, path)
+		if err != nil {
+			return docker.ServiceOptions{}, errors.Wrapf(err, "failed to create audit log")
+		}
+		options.AuditLog = auditLog
+	}
+	if s.BackupPath() != "" {
+		backups, err := setupBackups(ctx, s)
+		if err != nil {
+			return docker.ServiceOptions{}, err
+		}
+		options.Backups = backups
+	}
+	return options, nil
+}
+
+// setupNotifier creates a notifier for the configured webhooks, or nil if there are none
+func setupNotifier(ctx context.Context, s settings.Settings) (*webhook.Notifier, error) {
+	path := s.WebhooksFile()
+	if path == "" {
+		return nil, nil
+	}
+	logrus.WithContext(ctx).Infof("Loading webhooks from %s", path)
+	targets, err := webhook.LoadTargetsFromPath(ctx, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load webhooks")
+	}
+	notifier, err := webhook.NewNotifier(ctx, webhook.Options{
+		Targets:     targets,
+		QueueSize:   s.WebhookQueueSize(),
+		MaxAttempts: s.WebhookMaxAttempts(),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create webhook notifier")
+	}
+	return notifier, nil
+}
+
+// setupTracing adds a tracer exporting spans to the configured output to the context, if there is one
+//
+// Returns the exporter so that it can be closed, nil if tracing is disabled
+func setupTracing(ctx context.Context, s settings.Settings) (context.Context, *tracing.JSONExporter, error) {
+	output := s.TraceOutput()
+	if output == "" {
+		return ctx, nil, nil
+	}
+	logrus.WithContext(ctx).Infof("Writing traces to %s", output)
+	exporter, err := tracing.NewFileExporter(ctx, output)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create trace exporter")
+	}
+	tracer, err := tracing.NewTracer(ctx, exporter, func(err error) {
+		logrus.WithError(err).Warnf("Could not export span")
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to create tracer")
+	}
+	return tracing.WithTracer(ctx, tracer), exporter, nil
+}
+
+// setupState creates the store for the reconciliation history of containers,
+// kept in memory if there is no data directory
+func setupState(ctx context.Context, s settings.Settings) (*state.Store, error) {
+	dir := s.DataDir()
+	if dir == "" {
+		return state.NewMemoryStore(ctx)
+	}
+	logrus.WithContext(ctx).Infof("Keeping reconciliation history in %s", dir)
+	store, err := state.NewStore(ctx, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create state store")
+	}
+	return store, nil
+}
+
+// auditLogs appends entries to several audit logs, ex. the audit file and webhooks
+type auditLogs []docker.AuditLog
+
+func (logs auditLogs) Append(entry audit.Entry) error {
+	var failed []string
+	for _, log := range logs {
+		if err := log.Append(entry); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
 	}
-	logrus.WithContext(ctx).Infof("Retrieved %d containers from the docker client", len(containers))
+	return nil
+}
+
+// setupBackups creates the configured backup directory
+func setupBackups(ctx context.Context, s settings.Settings) (*backup.Directory, error) {
+	logrus.WithContext(ctx).Infof("Writing container backups to %s", s.BackupPath())
+	backups, err := backup.NewDirectory(ctx, s.BackupPath(), s.BackupRetentionCount(), s.BackupRetentionAge())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create backup directory")
+	}
+	return backups, nil
+}
+
+// setupEngine loads templates and aliases and creates the label engine from them
+func setupEngine(ctx context.Context, s settings.Settings) (*engine.Engine, error) {
+	logrus.WithContext(ctx).Infof("Building label engine...")
+	namespaces, err := policy.ParseNamespaces(s.TemplateNamespaces())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse template namespaces")
+	}
+	e, err := engine.NewEngine(ctx, engine.Options{
+		Sources: []engine.Source{engine.Directory{
+			Path:              s.TemplatesPath(),
+			TemplateExtension: s.TemplatesExtension(),
+			AliasExtension:    s.AliasesExtension(),
+		}},
+		Label:         s.ContainerLabel(),
+		MaxIterations: s.MaxLabelIterations(),
+		Protected:     s.ProtectedLabels(),
+		Namespaces:    namespaces,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create label engine")
+	}
+	logrus.WithContext(ctx).Infof("Built label engine with %d templates and aliases", e.Count(ctx))
+	return e, nil
+}
+
+// setupFileSource loads the instructions file, if configured
+//
+// The returned sources are shared by all hosts
+func setupFileSource(ctx context.Context, s settings.Settings) (sources.Sources, error) {
+	path := s.InstructionsFile()
+	if path == "" {
+		return nil, nil
+	}
+	logrus.WithContext(ctx).Infof("Loading instructions from %s", path)
+	fileSource, err := sources.LoadFileSourceFromPath(ctx, path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load instructions file")
+	}
+	return sources.Sources{fileSource}, nil
+}
+
+// setupSources creates the configured instruction sources of a host besides the container labels
+func setupSources(
+	ctx context.Context,
+	s settings.Settings,
+	shared sources.Sources,
+	dockerService *docker.Service,
+) (sources.Sources, error) {
+	instructionSources := append(sources.Sources{}, shared...)
+	if variable := s.InstructionsEnv(); variable != "" {
+		logrus.WithContext(ctx).Infof("Reading instructions from container environment variable %s", variable)
+		envSource, err := sources.NewEnvSource(ctx, variable, dockerService)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create environment instruction source")
+		}
+		instructionSources = append(instructionSources, envSource)
+	}
+	return instructionSources, nil
+}
+
+// Run runs the application for one iteration, reconciling all hosts in parallel
+//
+// Returns the status of the iteration, errors for single containers and hosts are only logged
+// and recorded in the status. Fails only if no host could be reconciled.
+func run(ctx context.Context, svc services, s settings.Settings) (api.Status, error) {
+	ctx, span := tracing.Start(ctx, "iteration", "iteration", logging.Value(ctx, logging.FieldIteration))
+	status := api.Status{LastIteration: time.Now()}
+	statuses := make([]api.Status, len(svc.hosts))
+	errs := make([]error, len(svc.hosts))
+	var wg sync.WaitGroup
+	for i, h := range svc.hosts {
+		wg.Add(1)
+		go func(i int, h host) {
+			defer wg.Done()
+			statuses[i], errs[i] = runHost(ctx, svc, h, s)
+		}(i, h)
+	}
+	wg.Wait()
+
+	failed := 0
+	for i, h := range svc.hosts {
+		if errs[i] != nil {
+			failed++
+			logrus.WithContext(ctx).WithError(errs[i]).Errorf("encountered error while reconciling host %s", h.name)
+			status.Errors = append(status.Errors, fmt.Sprintf("%s: %v", h.name, errs[i]))
+			continue
+		}
+		status.Errors = append(status.Errors, statuses[i].Errors...)
+		status.Pending = append(status.Pending, statuses[i].Pending...)
+		status.Violations = append(status.Violations, statuses[i].Violations...)
+		status.Quarantined = append(status.Quarantined, statuses[i].Quarantined...)
+	}
+	status.DurationSeconds = time.Since(status.LastIteration).Seconds()
+	var err error
+	switch {
+	case len(svc.hosts) == 1 && failed == 1:
+		err = errs[0]
+	case failed > 0 && failed == len(svc.hosts):
+		err = fmt.Errorf("all %d docker hosts failed", failed)
+	}
+	span.End(err)
+	if err != nil {
+		return api.Status{}, err
+	}
+	return status, nil
+}
+
+// runHost reconciles the containers of one host
+func runHost(ctx context.Context, svc services, h host, s settings.Settings) (api.Status, error) {
+	ctx = logging.With(ctx, logging.FieldHost, h.name)
+	ctx, span := tracing.Start(ctx, "host", "host", h.name)
+	var status api.Status
+	containers, err := h.docker.GetContainers(ctx, s.IncludeStoppedContainers())
+	if err != nil {
+		span.End(err)
+		return api.Status{}, err
+	}
+	logrus.WithContext(ctx).Infof("Retrieved %d containers from docker host %s", len(containers), h.name)
+	h.limiter.StartIteration()
 
 	for _, container := range containers {
-		value, ok := container.Labels[s.ContainerLabel()]
-		if ok {
-			logrus.WithContext(ctx).Infof("Processing container %s (%s) with options: %v", container.Name, container.ID, value)
-			logrus.WithContext(ctx).Debugf("Containers initial labels: %+v", container.Labels)
-
-			modifiers, err := parser.Process(ctx, value, templates.ContainerData{
-				Labels: container.Labels,
-				Name:   container.Name,
-			})
-			if err != nil {
-				logrus.WithError(err).Errorf("encountered error while processing container %s (%s)", container.Name, container.ID)
-			}
+		plan, err := reconcileContainer(ctx, svc, h, s, container)
+		if err != nil {
+			status.Errors = append(status.Errors, fmt.Sprintf("%s: %v", qualifiedName(container), err))
+		}
+		switch {
+		case plan.Quarantined:
+			status.Quarantined = append(status.Quarantined, plan)
+		case plan.Reason != "":
+			status.Pending = append(status.Pending, plan)
+		}
+		if len(plan.Violations) > 0 {
+			status.Violations = append(status.Violations, plan)
+		}
+	}
+	reportOrphans(ctx, svc, h)
+	span.SetAttribute("containers", strconv.Itoa(len(containers)))
+	span.End(nil)
+	return status, nil
+}
 
-			logrus.WithContext(ctx).Debugf("Applying modifiers %+v", modifiers)
-			newLabels := stringMapClone(container.Labels)
-			modifiers.Apply(newLabels)
-			logrus.WithContext(ctx).Debugf("Container labels after applied modifiers: %+v", newLabels)
-			if !stringMapEquals(newLabels, container.Labels) {
-				logrus.WithContext(ctx).Infof("Updating %s (%s) with new labels", container.Name, container.ID)
-				err = dockerService.SetLabels(ctx, container.ID, newLabels)
-				if err != nil {
-					logrus.WithError(err).Errorf(
-						"encountered error while setting labels on container %s (%s)",
-						container.Name,
-						container.ID,
-					)
+// reportOrphans logs and notifies about the containers left behind by updates on the host
+func reportOrphans(ctx context.Context, svc services, h host) {
+	onHost := func(key string) bool {
+		return strings.HasPrefix(key, h.docker.Host()+"/")
+	}
+	records, err := svc.state.List(onHost)
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Could not read the replaced containers of host %s", h.name)
+	}
+	names := make(map[string]string)
+	for _, record := range records {
+		for id, name := range record.Replaced {
+			names[id] = name
+		}
+		for id, name := range record.Created {
+			names[id] = name
+		}
+	}
+	orphans, err := h.docker.Orphans(ctx, names)
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Could not look for orphaned containers on host %s", h.name)
+		return
+	}
+	orphaned := make(map[string]bool)
+	for _, orphan := range orphans {
+		orphaned[orphan.ID] = true
+	}
+	// Containers that were removed or have the names they should have don't need to be remembered
+	stale := make(map[string]bool)
+	for _, record := range records {
+		for _, ids := range []map[string]string{record.Replaced, record.Created} {
+			for id := range ids {
+				if !orphaned[id] {
+					stale[record.Key] = true
 				}
 			}
 		}
 	}
-	return nil
+	_, err = svc.state.Update(func(key string) bool { return stale[key] }, func(record *state.Record) {
+		for _, ids := range []map[string]string{record.Replaced, record.Created} {
+			for id := range ids {
+				if !orphaned[id] {
+					delete(ids, id)
+				}
+			}
+		}
+	})
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Could not forget the replaced containers of host %s", h.name)
+	}
+	for _, orphan := range orphans {
+		logrus.WithContext(ctx).Warnf(
+			"Container %s (%s) was left behind by an update and might need manual recovery", orphan.Name, orphan.ID,
+		)
+		if svc.notifier != nil {
+			svc.notifier.Orphan(orphan.Host, orphan.Name, orphan.ID)
+		}
+	}
 }
 
-// stringMapClone clones a string map
-func stringMapClone(original map[string]string) map[string]string {
-	if original == nil {
-		return nil
+// reconcileContainer applies the instructions of the container, if it has any
+//
+// Returns the plan of the container, with the reason if a change was planned but not applied,
+// because it was postponed, failed before or the container is quarantined
+func reconcileContainer(
+	ctx context.Context,
+	svc services,
+	h host,
+	s settings.Settings,
+	container docker.Container,
+) (api.Plan, error) {
+	ctx = containerContext(ctx, container)
+	ctx, span := tracing.Start(ctx, "container", "container", container.Name, "containerId", container.ID)
+	plan, err := applyInstructions(ctx, svc, h, s, container)
+	if plan.Reason != "" {
+		span.SetAttribute("reason", plan.Reason)
+	}
+	span.End(err)
+	return plan, err
+}
+
+// applyInstructions plans the labels of the container and applies them unless the update has to wait
+func applyInstructions(
+	ctx context.Context,
+	svc services,
+	h host,
+	s settings.Settings,
+	container docker.Container,
+) (api.Plan, error) {
+	now := time.Now()
+	record, err := svc.state.Get(stateKey(container))
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Could not read the history of container %s", container.Name)
+		record = state.Record{Key: stateKey(container)}
 	}
-	newMap := make(map[string]string)
-	for key, value := range original {
-		newMap[key] = value
+	if record.Quarantined {
+		logrus.WithContext(ctx).Debugf("Skipping quarantined container %s (%s)", container.Name, container.ID)
+		return api.Plan{
+			Host:        container.Host,
+			Name:        container.Name,
+			ID:          container.ID,
+			Labels:      container.Labels,
+			Reason:      fmt.Sprintf("quarantined after %d failed updates (%s)", record.Failures, record.LastError),
+			Quarantined: true,
+		}, nil
+	}
+	plan, err := planContainer(ctx, svc, h, s, container)
+	if err != nil {
+		// Labels that can't be resolved are retried with the same backoff as updates, without repeating the error
+		if record.Waiting(now, "") {
+			return api.Plan{Host: container.Host, Name: container.Name, ID: container.ID, Reason: waitReason(record)}, nil
+		}
+		logrus.WithContext(ctx).WithError(err).Errorf(
+			"encountered error while processing container %s (%s)", container.Name, container.ID,
+		)
+		recordFailure(ctx, svc, s, record, container, "", err)
+		return api.Plan{}, err
+	}
+	hash := state.Hash(plan.Labels)
+	if plan.Instruction == "" || stringMapEquals(plan.Labels, container.Labels) {
+		if record.Failures > 0 {
+			record.Succeeded(now, container.ID, hash)
+			saveRecord(ctx, svc, record)
+		}
+		return plan, nil
+	}
+	if record.Waiting(now, hash) {
+		plan.Reason = waitReason(record)
+		logrus.WithContext(ctx).Infof("Planned update of %s (%s) skipped, %s", container.Name, container.ID, plan.Reason)
+		return plan, nil
+	}
+
+	update, err := h.docker.PrepareUpdate(ctx, container.ID)
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Errorf(
+			"encountered error while selecting update strategy for container %s (%s)", container.Name, container.ID,
+		)
+		plan.Reason = err.Error()
+		recordFailure(ctx, svc, s, record, container, hash, err)
+		return plan, err
 	}
-	return newMap
+	if err := h.limiter.Allow(now, container.Name); err != nil {
+		logrus.WithContext(ctx).Infof(
+			"Planned update of %s (%s) postponed (%v), labels to change: %s",
+			container.Name, container.ID, err, strings.Join(plan.Diff.Keys(), ", "),
+		)
+		plan.Reason = err.Error()
+		return plan, nil
+	}
+	if update.Replaces() {
+		// Failed attempts stop and restore the container too, so they count towards the limits as well
+		h.limiter.Record(now, container.Name)
+		// The container is renamed before it is replaced, if the update can't be rolled back
+		// the container is recognized by its id
+		record.Replacing(container.ID, container.Name)
+		saveRecord(ctx, svc, record)
+	}
+	logrus.WithContext(ctx).Infof("Updating %s (%s) with new labels", container.Name, container.ID)
+	newID, err := h.docker.ApplyUpdate(ctx, update, plan.Instruction, plan.Labels)
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Errorf(
+			"encountered error while setting labels on container %s (%s)",
+			container.Name,
+			container.ID,
+		)
+		plan.Reason = err.Error()
+		if newID != "" {
+			// The new container couldn't be removed, it is recognized by its id if it has a temporary name
+			record.Creating(newID, container.Name)
+		}
+		recordFailure(ctx, svc, s, record, container, hash, err)
+		return plan, err
+	}
+	record.Succeeded(now, container.ID, hash)
+	saveRecord(ctx, svc, record)
+	return plan, nil
+}
+
+// Labels compose sets on the containers of a service
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// stateKey is the key of the history of the container, the compose service if it belongs to one or its name,
+// qualified with the name of the host, ex. "local/project/service" or "local/web"
+func stateKey(container docker.Container) string {
+	project, service := container.Labels[composeProjectLabel], container.Labels[composeServiceLabel]
+	if project != "" && service != "" {
+		return container.Host + "/" + project + "/" + service
+	}
+	return qualifiedName(container)
+}
+
+// recordFailure records a failed attempt to apply the labels with the hash to the container,
+// quarantining the container if it failed too many times
+func recordFailure(
+	ctx context.Context,
+	svc services,
+	s settings.Settings,
+	record state.Record,
+	container docker.Container,
+	hash string,
+	err error,
+) {
+	record.Failed(time.Now(), container.ID, hash, err, state.Backoff{
+		Initial:         s.RetryBackoff(),
+		Max:             s.MaxRetryBackoff(),
+		QuarantineAfter: s.QuarantineAfterFailures(),
+	})
+	if record.Quarantined {
+		logrus.WithContext(ctx).Warnf(
+			"Container %s (%s) quarantined after %d failed updates, it won't be updated until it is released",
+			container.Name, container.ID, record.Failures,
+		)
+	}
+	saveRecord(ctx, svc, record)
+}
+
+// waitReason describes why the container waits before being updated again
+func waitReason(record state.Record) string {
+	return fmt.Sprintf(
+		"update failed %d times, retrying after %s (%s)",
+		record.Failures, record.RetryAt.Format(time.RFC3339), record.LastError,
+	)
+}
+
+// saveRecord saves the history of a container, failing to do so only affects later skip decisions
+func saveRecord(ctx context.Context, svc services, record state.Record) {
+	if err := svc.state.Put(record); err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Could not save the history of %s", record.Key)
+	}
+}
+
+// planContainer resolves the labels the container would get from its instructions
+func planContainer(
+	ctx context.Context,
+	svc services,
+	h host,
+	s settings.Settings,
+	container docker.Container,
+) (api.Plan, error) {
+	ctx = containerContext(ctx, container)
+	plan := api.Plan{
+		Host:   container.Host,
+		Name:   container.Name,
+		ID:     container.ID,
+		Labels: container.Labels,
+	}
+	external, err := h.sources.Instruction(ctx, container)
+	if err != nil {
+		return api.Plan{}, errors.Wrapf(err, "failed to read instructions")
+	}
+	plan.Instruction = svc.engine.Instruction(external, container.Labels)
+	if plan.Instruction == "" {
+		return plan, nil
+	}
+	logrus.WithContext(ctx).Infof("Processing container %s (%s)", container.Name, container.ID)
+	logrus.WithContext(ctx).Debugf("Containers initial labels: %+v", container.Labels)
+
+	result, err := svc.engine.Evaluate(ctx, external, engine.ContainerData{
+		Name:   container.Name,
+		Host:   container.Host,
+		Labels: container.Labels,
+	})
+	if err != nil {
+		return api.Plan{}, err
+	}
+	plan.Labels = result.Labels
+	for _, violation := range result.Violations {
+		plan.Violations = append(plan.Violations, policy.Violation(violation))
+	}
+	for _, violation := range plan.Violations {
+		logrus.WithContext(ctx).Warnf("Change to container %s (%s) not allowed, %s", container.Name, container.ID, violation)
+	}
+	logrus.WithContext(ctx).Debugf("Container labels after applied modifiers: %+v", plan.Labels)
+	plan.Diff = audit.NewDiff(container.Labels, plan.Labels)
+	return plan, nil
+}
+
+// findContainer finds a container by name, with or without the leading "/"
+//
+// The name can be qualified with the name of the host, ex. "prod/web",
+// otherwise the first match on any host is returned
+func findContainer(
+	ctx context.Context,
+	svc services,
+	s settings.Settings,
+	name string,
+) (host, docker.Container, error) {
+	hostName := ""
+	name = strings.TrimPrefix(name, "/")
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		hostName, name = parts[0], parts[1]
+	}
+	for _, h := range svc.hosts {
+		if hostName != "" && h.name != hostName {
+			continue
+		}
+		containers, err := h.docker.GetContainers(ctx, s.IncludeStoppedContainers())
+		if err != nil {
+			return host{}, docker.Container{}, errors.Wrapf(err, "failed to list containers of host %s", h.name)
+		}
+		for _, container := range containers {
+			if strings.TrimPrefix(container.Name, "/") == name {
+				return h, container, nil
+			}
+		}
+	}
+	return host{}, docker.Container{}, errors.Wrapf(api.ErrContainerNotFound, "no container named %s", name)
+}
+
+// containerContext returns a context with the host, name and id of the container as log fields
+func containerContext(ctx context.Context, container docker.Container) context.Context {
+	ctx = logging.With(ctx, logging.FieldHost, container.Host)
+	ctx = logging.With(ctx, logging.FieldContainerName, strings.TrimPrefix(container.Name, "/"))
+	return logging.With(ctx, logging.FieldContainerID, container.ID)
+}
+
+// qualifiedName is the name of the container prefixed with the name of its host, ex. "local/web"
+func qualifiedName(container docker.Container) string {
+	return container.Host + "/" + strings.TrimPrefix(container.Name, "/")
 }
 
 // stringMapEquals compare two maps of type map[string]string
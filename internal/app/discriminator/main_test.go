@@ -1,6 +1,29 @@
 package discriminator
 
-import "testing"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+	"sidus.io/discriminator/internal/pkg/ratelimit"
+	"sidus.io/discriminator/internal/pkg/settings"
+	"sidus.io/discriminator/internal/pkg/state"
+	"sidus.io/discriminator/internal/pkg/tracing"
+	"sidus.io/discriminator/internal/pkg/webhook"
+	"sidus.io/discriminator/pkg/engine"
+)
 
 func Test_stringMapEquals(t *testing.T) {
 	tests := []struct {
@@ -68,3 +91,668 @@ func Test_stringMapEquals(t *testing.T) {
 		})
 	}
 }
+
+// newEngine creates an engine with fixed templates, evaluating the instructions in the label
+func newEngine(t *testing.T, label string, tmpls map[string]string) *engine.Engine {
+	t.Helper()
+	e, err := engine.NewEngine(context.Background(), engine.Options{
+		Sources: []engine.Source{engine.Static{Templates: tmpls}},
+		Label:   label,
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	return e
+}
+
+func Test_run(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:     "web",
+		Running:  true,
+		Labels:   map[string]string{label: "extra()"},
+		Networks: map[string]string{"frontend": "n1"},
+	})
+	client.AddContainer(dockertest.Container{
+		Name:    "converged",
+		Running: true,
+		Labels:  map[string]string{label: "extra()", "b": "2"},
+	})
+	client.AddContainer(dockertest.Container{
+		Name:    "failing",
+		Running: true,
+		Labels:  map[string]string{label: "unknown()"},
+	})
+	client.AddContainer(dockertest.Container{
+		Name:    "unlabeled",
+		Running: true,
+	})
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, label, map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+
+	status, err := run(ctx, svc, s)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(status.Errors) != 1 || !strings.Contains(status.Errors[0], "failing") {
+		t.Errorf("run() errors = %v, want one error for container failing", status.Errors)
+	}
+	web, ok := client.Container("web")
+	if !ok {
+		t.Fatalf("container web is missing after run")
+	}
+	if web.Config.Labels["b"] != "2" || !web.State.Running || web.NetworkSettings.Networks["frontend"] == nil {
+		t.Errorf("container web not recreated as expected: %+v, %+v", web.Config.Labels, web.State)
+	}
+	want := []string{"converged", "failing", "unlabeled", "web"}
+	if got := client.Names(); !reflect.DeepEqual(got, want) {
+		t.Errorf("container names = %v, want %v", got, want)
+	}
+
+	// A second iteration should not touch any container
+	before := len(client.Calls())
+	if _, err := run(ctx, svc, s); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for _, method := range client.Methods()[before:] {
+		if method != dockertest.MethodContainerList {
+			t.Errorf("second iteration called %s, want only %s", method, dockertest.MethodContainerList)
+		}
+	}
+
+	client.Fail(dockertest.MethodContainerList, errors.New("injected failure"))
+	if _, err := run(ctx, svc, s); err == nil {
+		t.Errorf("run() expected error when listing containers fails")
+	}
+}
+
+func Test_run_limited(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	client := dockertest.NewClient()
+	names := []string{"a", "b", "c"}
+	for _, name := range names {
+		client.AddContainer(dockertest.Container{
+			Name:    name,
+			Running: true,
+			Labels:  map[string]string{label: "extra()"},
+		})
+	}
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, label, map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{MaxPerIteration: 1, MaxPerHour: 2})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+
+	// Each iteration updates one container until the hourly limit is reached
+	for _, want := range []int{1, 2, 2} {
+		status, err := run(ctx, svc, s)
+		if err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+		if len(status.Pending) != len(names)-want {
+			t.Errorf("pending updates = %d, want %d", len(status.Pending), len(names)-want)
+		}
+		updated := 0
+		for _, name := range names {
+			container, _ := client.Container(name)
+			if container.Config.Labels["b"] == "2" {
+				updated++
+			}
+		}
+		if updated != want {
+			t.Errorf("updated containers = %d, want %d", updated, want)
+		}
+	}
+}
+
+func Test_run_limitedRecreations(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "notified",
+		Running: true,
+		Labels:  map[string]string{label: "extra()", s.StrategyLabel(): docker.StrategyNotify},
+	})
+	for _, name := range []string{"web1", "web2", "web3"} {
+		client.AddContainer(dockertest.Container{
+			Name:    name,
+			Running: true,
+			Labels:  map[string]string{label: "extra()"},
+		})
+	}
+	// A broken template change fails every recreation
+	injected := errors.New("injected")
+	client.Fail(dockertest.MethodContainerCreate, injected, injected, injected)
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{StrategyLabel: s.StrategyLabel()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{MaxPerIteration: 1})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: newEngine(t, label, map[string]string{"extra": "+b=2"}),
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+
+	// The notification doesn't use up the limit, but the failed recreation does
+	status, err := run(ctx, svc, s)
+	if err != nil || len(status.Errors) != 1 || len(status.Pending) != 3 {
+		t.Fatalf("run() = %+v, %v, want one failed recreation and the rest postponed", status, err)
+	}
+	creates := 0
+	for _, call := range client.Calls() {
+		if call.Method == dockertest.MethodContainerCreate {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Errorf("containers created %d times, want 1", creates)
+	}
+}
+
+func Test_run_hosts(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	svc := services{engine: newEngine(t, label, map[string]string{"host": "+host={{.Host}}"})}
+	clients := make(map[string]*dockertest.Client)
+	for _, name := range []string{"a", "b", "broken"} {
+		client := dockertest.NewClient()
+		client.AddContainer(dockertest.Container{
+			Name:    "web",
+			Running: true,
+			Labels:  map[string]string{label: "host()"},
+		})
+		dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{Host: name})
+		if err != nil {
+			t.Fatalf("NewService() error = %v", err)
+		}
+		limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+		if err != nil {
+			t.Fatalf("NewLimiter() error = %v", err)
+		}
+		svc.hosts = append(svc.hosts, host{name: name, docker: dockerService, limiter: limiter})
+		clients[name] = client
+	}
+	clients["broken"].Fail(dockertest.MethodContainerList, errors.New("injected failure"))
+
+	status, err := run(ctx, svc, s)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		web, _ := clients[name].Container("web")
+		if web.Config.Labels["host"] != name {
+			t.Errorf("container web on host %s has labels %v, want host=%s", name, web.Config.Labels, name)
+		}
+	}
+	if len(status.Errors) != 1 || !strings.HasPrefix(status.Errors[0], "broken:") {
+		t.Errorf("run() errors = %v, want one error for host broken", status.Errors)
+	}
+
+	for _, h := range svc.hosts {
+		clients[h.name].Fail(dockertest.MethodContainerList, errors.New("injected failure"))
+	}
+	if _, err := run(ctx, svc, s); err == nil {
+		t.Errorf("run() expected error when all hosts fail")
+	}
+}
+
+func Test_run_webhooks(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	var mu sync.Mutex
+	var events []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhook.Payload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, fmt.Sprintf("%s %s", payload.Event, payload.Name))
+	}))
+	defer server.Close()
+	notifier, err := webhook.NewNotifier(ctx, webhook.Options{Targets: []webhook.Target{{URL: server.URL}}})
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{label: "extra()"},
+	})
+	// Containers of users that happen to have the names of temporary containers aren't orphans
+	client.AddContainer(dockertest.Container{Name: "db-old"})
+	client.AddContainer(dockertest.Container{Name: "db-new"})
+	// Earlier updates renamed api before they failed and left a new cache container behind
+	apiID := client.AddContainer(dockertest.Container{Name: "api-old"})
+	cacheID := client.AddContainer(dockertest.Container{Name: "cache-new"})
+	store, err := state.NewMemoryStore(ctx)
+	if err != nil {
+		t.Fatalf("NewMemoryStore() error = %v", err)
+	}
+	record := state.Record{Key: docker.DefaultHost + "/api"}
+	record.Replacing(apiID, "/api")
+	record.Replacing("removed", "/worker")
+	record.Creating(cacheID, "/cache")
+	record.Creating("renamed", "/queue")
+	if err := store.Put(record); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{AuditLog: auditLogs{notifier}})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, label, map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine:   e,
+		notifier: notifier,
+		state:    store,
+		hosts:    []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := run(ctx, svc, s); err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+	}
+	svc.close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"success /web", "orphan /api-old", "orphan /cache-new"}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("webhook events = %v, want %v", events, want)
+	}
+	record, _ = store.Get(docker.DefaultHost + "/api")
+	if !reflect.DeepEqual(record.Replaced, map[string]string{apiID: "/api"}) ||
+		!reflect.DeepEqual(record.Created, map[string]string{cacheID: "/cache"}) {
+		t.Errorf("containers = %v, %v, want only the orphans %s and %s", record.Replaced, record.Created, apiID, cacheID)
+	}
+	if record, _ := store.Get(docker.DefaultHost + "/web"); len(record.Replaced) != 0 {
+		t.Errorf("replaced containers = %v, want none after the successful update", record.Replaced)
+	}
+}
+
+// memoryAuditLog keeps audit entries in memory
+func Test_run_orphans(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{label: "extra()", s.StrategyLabel(): docker.StrategyBlueGreen},
+	})
+	// The new container can't be removed when the old one can't be stopped
+	client.Fail(dockertest.MethodContainerStop, errors.New("injected"))
+	client.Fail(dockertest.MethodContainerRemove, errors.New("injected"))
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{StrategyLabel: s.StrategyLabel()})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	store, err := state.NewMemoryStore(ctx)
+	if err != nil {
+		t.Fatalf("NewMemoryStore() error = %v", err)
+	}
+	svc := services{
+		engine: newEngine(t, label, map[string]string{"extra": "+b=2"}),
+		state:  store,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+	if status, err := run(ctx, svc, s); err != nil || len(status.Errors) != 1 {
+		t.Fatalf("run() = %+v, %v, want the update of web to fail", status, err)
+	}
+
+	left, ok := client.Container("web-new")
+	if !ok {
+		t.Fatalf("container web-new is missing, containers: %v", client.Names())
+	}
+	record, _ := store.Get(docker.DefaultHost + "/web")
+	if !reflect.DeepEqual(record.Created, map[string]string{left.ID: "/web"}) {
+		t.Errorf("created containers = %v, want the new container %s left behind", record.Created, left.ID)
+	}
+}
+
+type memoryAuditLog []audit.Entry
+
+func (l *memoryAuditLog) Append(entry audit.Entry) error {
+	*l = append(*l, entry)
+	return nil
+}
+
+func Test_run_notify(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+	store, err := state.NewMemoryStore(ctx)
+	if err != nil {
+		t.Fatalf("NewMemoryStore() error = %v", err)
+	}
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{label: "extra()"},
+	})
+	auditLog := &memoryAuditLog{}
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{
+		AuditLog:        auditLog,
+		DefaultStrategy: docker.StrategyNotify,
+	})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: newEngine(t, label, map[string]string{"extra": "+b=2"}),
+		state:  store,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+
+	// The labels are never set, but are only reported once
+	for i := 0; i < 2; i++ {
+		status, err := run(ctx, svc, s)
+		if err != nil || len(status.Errors) != 0 || len(status.Pending) != 0 {
+			t.Fatalf("run() = %+v, %v, want no errors or pending updates", status, err)
+		}
+	}
+	if len(*auditLog) != 1 || (*auditLog)[0].Outcome != audit.OutcomeNotified {
+		t.Errorf("audit entries = %+v, want a single notification", *auditLog)
+	}
+}
+
+func Test_run_state(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	label := s.ContainerLabel()
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := state.NewStore(ctx, dir)
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{label: "extra()", composeProjectLabel: "app", composeServiceLabel: "web"},
+	})
+	client.Fail(dockertest.MethodContainerCreate, errors.New("injected"))
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, label, map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		state:  store,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+	key := docker.DefaultHost + "/app/web"
+
+	// The failed update is recorded and not retried before the next regular iteration
+	for _, wantErrors := range []int{1, 0} {
+		status, err := run(ctx, svc, s)
+		if err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+		if len(status.Errors) != wantErrors || len(status.Pending) != 1 {
+			t.Errorf("run() status = %+v, want %d errors and the update pending", status, wantErrors)
+		}
+	}
+	record, err := store.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if record.Failures != 1 || !strings.Contains(record.LastError, "injected") {
+		t.Errorf("record after failure = %+v", record)
+	}
+
+	// Other labels, ex. after fixing the templates, are attempted right away
+	svc.engine = newEngine(t, label, map[string]string{"extra": "+b=3"})
+	status, err := run(ctx, svc, s)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(status.Errors) != 0 || len(status.Pending) != 0 {
+		t.Errorf("run() status = %+v, want the container updated", status)
+	}
+	record, err = store.Get(key)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if record.Failures != 0 || record.AppliedHash == "" {
+		t.Errorf("record after success = %+v", record)
+	}
+}
+
+func Test_run_quarantine(t *testing.T) {
+	ctx := context.Background()
+	os.Setenv("DISCRIMINATOR_RETRY_BACKOFF", "0")
+	defer os.Unsetenv("DISCRIMINATOR_RETRY_BACKOFF")
+	os.Setenv("DISCRIMINATOR_QUARANTINE_AFTER_FAILURES", "2")
+	defer os.Unsetenv("DISCRIMINATOR_QUARANTINE_AFTER_FAILURES")
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	store, err := state.NewMemoryStore(ctx)
+	if err != nil {
+		t.Fatalf("NewMemoryStore() error = %v", err)
+	}
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{s.ContainerLabel(): "extra()"},
+	})
+	client.Fail(dockertest.MethodContainerCreate, errors.New("injected"), errors.New("injected"))
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, s.ContainerLabel(), map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		state:  store,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+
+	// Without a backoff every iteration retries, until the container is quarantined
+	for i, wantQuarantined := range []bool{false, false, true} {
+		status, err := run(ctx, svc, s)
+		if err != nil {
+			t.Fatalf("run() error = %v", err)
+		}
+		quarantined := len(status.Quarantined) == 1 && status.Quarantined[0].Quarantined
+		failed := len(status.Errors) > 0
+		if quarantined != wantQuarantined || failed == wantQuarantined {
+			t.Errorf("run() %d status = %+v, want quarantined %v", i+1, status, wantQuarantined)
+		}
+	}
+	if creates := strings.Count(strings.Join(client.Methods(), " "), dockertest.MethodContainerCreate); creates != 2 {
+		t.Errorf("containers created = %d, want 2 before quarantine", creates)
+	}
+
+	ctrl := newController(s)
+	defer serveRequests(ctx, ctrl, &svc)()
+	if err := ctrl.Release(ctx, "web"); err != nil {
+		t.Fatalf("Release() error = %v", err)
+	}
+	status, err := run(ctx, svc, s)
+	if err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+	if len(status.Errors) != 0 || len(status.Quarantined) != 0 {
+		t.Errorf("run() after Release() status = %+v, want the container updated", status)
+	}
+	if web, _ := client.Container("web"); web.Config.Labels["b"] != "2" {
+		t.Errorf("container web not updated after Release(), labels: %v", web.Config.Labels)
+	}
+}
+
+// spanRecorder is a tracing exporter keeping the exported spans
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []tracing.Data
+}
+
+func (r *spanRecorder) Export(span tracing.Data) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+	return nil
+}
+
+func Test_run_tracing(t *testing.T) {
+	ctx := context.Background()
+	s, err := settings.NewSettings(ctx)
+	if err != nil {
+		t.Fatalf("NewSettings() error = %v", err)
+	}
+	recorder := &spanRecorder{}
+	tracer, err := tracing.NewTracer(ctx, recorder, nil)
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+	ctx = tracing.WithTracer(ctx, tracer)
+
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{s.ContainerLabel(): "extra()"},
+	})
+	dockerService, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	e := newEngine(t, s.ContainerLabel(), map[string]string{"extra": "+b=2"})
+	limiter, err := ratelimit.NewLimiter(ctx, ratelimit.Options{})
+	if err != nil {
+		t.Fatalf("NewLimiter() error = %v", err)
+	}
+	svc := services{
+		engine: e,
+		hosts:  []host{{name: docker.DefaultHost, docker: dockerService, limiter: limiter}},
+	}
+	if _, err := run(ctx, svc, s); err != nil {
+		t.Fatalf("run() error = %v", err)
+	}
+
+	// Every span is drawn as its path from the iteration, ex. "iteration/host/container"
+	byID := make(map[string]tracing.Data)
+	for _, span := range recorder.spans {
+		byID[span.SpanID] = span
+	}
+	paths := make(map[string]bool)
+	for _, span := range recorder.spans {
+		path := span.Name
+		for parent, ok := byID[span.ParentID]; ok; parent, ok = byID[parent.ParentID] {
+			path = parent.Name + "/" + path
+		}
+		paths[path] = true
+	}
+	for _, want := range []string{
+		"iteration/host/docker.ContainerList",
+		"iteration/host/container/template",
+		"iteration/host/container/docker.ContainerInspect",
+		"iteration/host/container/update/docker.ContainerStop",
+		"iteration/host/container/update/docker.ContainerRename",
+		"iteration/host/container/update/docker.ContainerCreate",
+		"iteration/host/container/update/docker.ContainerStart",
+		"iteration/host/container/update/docker.ContainerRemove",
+	} {
+		if !paths[want] {
+			t.Errorf("no span %s, got %v", want, paths)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/policy"
+)
+
+var (
+	// ErrContainerNotFound is returned by a Controller for requests about containers that don't exist
+	ErrContainerNotFound = errors.New("container not found")
+	// ErrPostponed is returned by a Controller when a change is planned but not allowed yet, ex. by rate limits
+	ErrPostponed = errors.New("update postponed")
+)
+
+// Controller executes the requests made to the api
+type Controller interface {
+	// Reconcile runs an iteration, only for the named container if the name isn't empty
+	Reconcile(ctx context.Context, container string) error
+	// Status describes the last iteration
+	Status(ctx context.Context) Status
+	// Plan returns the labels the named container would get
+	Plan(ctx context.Context, container string) (Plan, error)
+	// ReloadTemplates loads the templates and aliases again
+	ReloadTemplates(ctx context.Context) error
+	// Release releases the named container from quarantine and forgets its failed updates
+	Release(ctx context.Context, container string) error
+}
+
+// Status describes the last iteration
+type Status struct {
+	LastIteration   time.Time `json:"lastIteration"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	// Errors are the errors encountered during the last iteration
+	Errors []string `json:"errors"`
+	// Pending are the changes that were planned but not applied during the last iteration
+	Pending []Plan `json:"pending"`
+	// Violations are the plans of the containers with changes the label policy didn't allow
+	Violations []Plan `json:"violations"`
+	// Quarantined are the containers that aren't updated after failing too many times
+	Quarantined []Plan `json:"quarantined"`
+}
+
+// Plan describes the labels a container would get
+type Plan struct {
+	Host        string            `json:"host"`
+	Name        string            `json:"name"`
+	ID          string            `json:"id"`
+	Instruction string            `json:"instruction"`
+	Labels      map[string]string `json:"labels"`
+	Diff        audit.Diff        `json:"diff"`
+	// Reason describes why a pending change wasn't applied
+	Reason string `json:"reason,omitempty"`
+	// Violations are the changes of the templates the label policy didn't allow
+	Violations []policy.Violation `json:"violations,omitempty"`
+	// Quarantined is true if the container isn't updated until it is released
+	Quarantined bool `json:"quarantined,omitempty"`
+}
+
+// Server serves the api over http
+type Server struct {
+	controller Controller
+	server     *http.Server
+}
+
+// NewServer creates a server for the controller
+func NewServer(_ context.Context, controller Controller) (*Server, error) {
+	s := &Server{controller: controller}
+	s.server = &http.Server{Handler: s}
+	return s, nil
+}
+
+// Listen creates a listener for an address on the form "unix:///path/to/socket" or "tcp://host:port"
+//
+// Stale unix sockets are removed before listening, other files at the path are left as they are
+func Listen(address string) (net.Listener, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid api address %s", address)
+	}
+	switch u.Scheme {
+	case "unix":
+		path := u.Host + u.Path
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case "tcp":
+		return net.Listen("tcp", u.Host)
+	default:
+		return nil, fmt.Errorf("unsupported api address %s, expected unix:// or tcp://", address)
+	}
+}
+
+// removeStaleSocket removes the unix socket at the path, if any, and fails if there is another kind of file
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to check old socket %s", path)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to listen on %s since it exists and isn't a unix socket", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove old socket %s", path)
+	}
+	return nil
+}
+
+// Serve serves requests on the listener until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	err := s.server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+// ServeHTTP routes the request to the controller
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logrus.WithContext(ctx).Debugf("API request %s %s", r.Method, r.URL.Path)
+	switch {
+	case r.URL.Path == "/reconcile":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := s.controller.Reconcile(ctx, r.URL.Query().Get("container"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/status":
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, s.controller.Status(ctx))
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/plan"):
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/plan")
+		plan, err := s.controller.Plan(ctx, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, plan)
+	case strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/release"):
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/release")
+		err := s.controller.Release(ctx, name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case r.URL.Path == "/templates/reload":
+		if !allowMethod(w, r, http.MethodPost) {
+			return
+		}
+		err := s.controller.ReloadTemplates(ctx)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown endpoint %s", r.URL.Path)})
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// allowMethod responds with method not allowed unless the request uses the method
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: fmt.Sprintf("method %s not allowed", r.Method)})
+	return false
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch errors.Cause(err) {
+	case ErrContainerNotFound:
+		status = http.StatusNotFound
+	case ErrPostponed:
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		logrus.WithError(err).Warnf("Failed to write api response")
+	}
+}
@@ -0,0 +1,248 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeController records the requests it gets and fails for containers named "missing" and "limited"
+type fakeController struct {
+	reconciled []string
+	released   []string
+	reloads    int
+}
+
+func (c *fakeController) Reconcile(_ context.Context, container string) error {
+	switch container {
+	case "missing":
+		return errors.Wrapf(ErrContainerNotFound, "no container named %s", container)
+	case "limited":
+		return errors.Wrapf(ErrPostponed, "limit reached")
+	}
+	c.reconciled = append(c.reconciled, container)
+	return nil
+}
+
+func (c *fakeController) Status(context.Context) Status {
+	return Status{LastIteration: time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC), Errors: []string{"broken"}}
+}
+
+func (c *fakeController) Plan(_ context.Context, container string) (Plan, error) {
+	if container == "missing" {
+		return Plan{}, ErrContainerNotFound
+	}
+	return Plan{Name: container, Labels: map[string]string{"a": "1"}}, nil
+}
+
+func (c *fakeController) ReloadTemplates(context.Context) error {
+	c.reloads++
+	if c.reloads > 1 {
+		return fmt.Errorf("failed to load templates")
+	}
+	return nil
+}
+
+func (c *fakeController) Release(_ context.Context, container string) error {
+	if container == "missing" {
+		return ErrContainerNotFound
+	}
+	c.released = append(c.released, container)
+	return nil
+}
+
+func TestServer_ServeHTTP(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "reconcile",
+			method:     http.MethodPost,
+			path:       "/reconcile",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "reconcile container",
+			method:     http.MethodPost,
+			path:       "/reconcile?container=web",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "reconcile missing",
+			method:     http.MethodPost,
+			path:       "/reconcile?container=missing",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "reconcile postponed",
+			method:     http.MethodPost,
+			path:       "/reconcile?container=limited",
+			wantStatus: http.StatusConflict,
+		},
+		{
+			name:       "reconcile with get",
+			method:     http.MethodGet,
+			path:       "/reconcile",
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "status",
+			method:     http.MethodGet,
+			path:       "/status",
+			wantStatus: http.StatusOK,
+			wantBody:   `"errors":["broken"]`,
+		},
+		{
+			name:       "plan",
+			method:     http.MethodGet,
+			path:       "/containers/web/plan",
+			wantStatus: http.StatusOK,
+			wantBody:   `"labels":{"a":"1"}`,
+		},
+		{
+			name:       "plan missing",
+			method:     http.MethodGet,
+			path:       "/containers/missing/plan",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "release",
+			method:     http.MethodPost,
+			path:       "/containers/web/release",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "release missing",
+			method:     http.MethodPost,
+			path:       "/containers/missing/release",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "reload",
+			method:     http.MethodPost,
+			path:       "/templates/reload",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "reload failing",
+			method:     http.MethodPost,
+			path:       "/templates/reload",
+			wantStatus: http.StatusInternalServerError,
+		},
+		{
+			name:       "unknown",
+			method:     http.MethodGet,
+			path:       "/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	controller := &fakeController{}
+	server, err := NewServer(context.Background(), controller)
+	if err != nil {
+		t.Fatalf("NewServer() error = %v", err)
+	}
+	// The tests share the controller and run in order
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			server.ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, nil))
+			if recorder.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d, body: %s", recorder.Code, tt.wantStatus, recorder.Body.String())
+			}
+			if !strings.Contains(recorder.Body.String(), tt.wantBody) {
+				t.Errorf("body = %s, want it to contain %s", recorder.Body.String(), tt.wantBody)
+			}
+			if recorder.Code >= 400 {
+				var response errorResponse
+				if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.Error == "" {
+					t.Errorf("error response %s is not json with an error", recorder.Body.String())
+				}
+			}
+		})
+	}
+	if want := []string{"", "web"}; fmt.Sprint(controller.reconciled) != fmt.Sprint(want) {
+		t.Errorf("reconciled = %q, want %q", controller.reconciled, want)
+	}
+	if want := []string{"web"}; fmt.Sprint(controller.released) != fmt.Sprint(want) {
+		t.Errorf("released = %q, want %q", controller.released, want)
+	}
+}
+
+func TestListen(t *testing.T) {
+	tests := []struct {
+		name    string
+		address string
+		wantErr bool
+	}{
+		{
+			name:    "tcp",
+			address: "tcp://127.0.0.1:0",
+		},
+		{
+			name:    "unsupported",
+			address: "http://127.0.0.1:0",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := Listen(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Listen() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if listener != nil {
+				listener.Close()
+			}
+		})
+	}
+}
+
+func TestListen_unix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "api")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A socket left behind by an earlier run is replaced
+	stale := filepath.Join(dir, "stale.sock")
+	old, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatalf("ListenUnix() error = %v", err)
+	}
+	old.SetUnlinkOnClose(false)
+	old.Close()
+	listener, err := Listen("unix://" + stale)
+	if err != nil {
+		t.Fatalf("Listen() error = %v, want the stale socket replaced", err)
+	}
+	listener.Close()
+
+	// Other files are never removed
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, []byte("content"), 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if listener, err := Listen("unix://" + file); err == nil {
+		listener.Close()
+		t.Errorf("Listen() expected error for a path that isn't a socket")
+	}
+	if content, err := ioutil.ReadFile(file); err != nil || string(content) != "content" {
+		t.Errorf("file = %q, %v, want it untouched", content, err)
+	}
+}
@@ -0,0 +1,95 @@
+package audit
+
+import (
+	"sort"
+	"time"
+)
+
+// Outcome is the result of a container recreation
+type Outcome string
+
+const (
+	// OutcomeSuccess means the container was recreated with the new labels
+	OutcomeSuccess Outcome = "success"
+	// OutcomeRolledBack means the recreation failed and the old container was restored
+	OutcomeRolledBack Outcome = "rolled-back"
+	// OutcomeFailed means the recreation failed and the old container might need manual recovery
+	OutcomeFailed Outcome = "failed"
+	// OutcomeNotified means the labels were only reported and the container was left untouched
+	OutcomeNotified Outcome = "notified"
+)
+
+// Entry is a record of one container recreation
+type Entry struct {
+	Time            time.Time `json:"time"`
+	Host            string    `json:"host,omitempty"`
+	Name            string    `json:"name"`
+	OldID           string    `json:"oldId"`
+	NewID           string    `json:"newId,omitempty"`
+	Instruction     string    `json:"instruction,omitempty"`
+	Strategy        string    `json:"strategy,omitempty"`
+	Backup          string    `json:"backup,omitempty"`
+	Diff            Diff      `json:"diff"`
+	DurationSeconds float64   `json:"durationSeconds"`
+	Outcome         Outcome   `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+	Rollback        *Rollback `json:"rollback,omitempty"`
+}
+
+// Rollback describes an attempt to restore the old container
+type Rollback struct {
+	Restored bool   `json:"restored"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Diff is the difference between two sets of labels
+type Diff struct {
+	Added   map[string]string `json:"added,omitempty"`
+	Removed map[string]string `json:"removed,omitempty"`
+	Changed map[string]Change `json:"changed,omitempty"`
+}
+
+// Change is a label with a changed value
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// NewDiff computes the difference going from the old to the new labels
+func NewDiff(oldLabels, newLabels map[string]string) Diff {
+	d := Diff{
+		Added:   make(map[string]string),
+		Removed: make(map[string]string),
+		Changed: make(map[string]Change),
+	}
+	for key, value := range newLabels {
+		oldValue, ok := oldLabels[key]
+		if !ok {
+			d.Added[key] = value
+		} else if oldValue != value {
+			d.Changed[key] = Change{From: oldValue, To: value}
+		}
+	}
+	for key, value := range oldLabels {
+		if _, ok := newLabels[key]; !ok {
+			d.Removed[key] = value
+		}
+	}
+	return d
+}
+
+// Keys returns the sorted keys of all labels in the diff
+func (d Diff) Keys() []string {
+	keys := make([]string, 0, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for key := range d.Added {
+		keys = append(keys, key)
+	}
+	for key := range d.Removed {
+		keys = append(keys, key)
+	}
+	for key := range d.Changed {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,79 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// File is an append-only audit log stored as json lines
+type File struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFile creates an audit log writing to the file at the given path
+func NewFile(_ context.Context, path string) (*File, error) {
+	return &File{path: path}, nil
+}
+
+// Append writes an entry to the end of the log
+func (f *File) Append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode audit entry")
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open audit log %s", f.path)
+	}
+	_, err = file.Write(line)
+	if err != nil {
+		_ = file.Close()
+		return errors.Wrapf(err, "failed to write to audit log %s", f.path)
+	}
+	return file.Close()
+}
+
+// Query returns all entries for the container with the given name, in the order they were written
+//
+// An empty name returns all entries
+func (f *File) Query(_ context.Context, name string) ([]Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open audit log %s", f.path)
+	}
+	defer file.Close()
+
+	name = strings.TrimPrefix(name, "/")
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode audit log %s", f.path)
+		}
+		if name == "" || strings.TrimPrefix(entry.Name, "/") == name {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "failed to read audit log %s", f.path)
+	}
+	return entries, nil
+}
@@ -0,0 +1,81 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNewDiff(t *testing.T) {
+	got := NewDiff(
+		map[string]string{"same": "1", "changed": "a", "removed": "x"},
+		map[string]string{"same": "1", "changed": "b", "added": "y"},
+	)
+	want := Diff{
+		Added:   map[string]string{"added": "y"},
+		Removed: map[string]string{"removed": "x"},
+		Changed: map[string]Change{"changed": {From: "a", To: "b"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("NewDiff() = %+v, want %+v", got, want)
+	}
+	if keys := got.Keys(); !reflect.DeepEqual(keys, []string{"added", "changed", "removed"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+}
+
+func TestFile_Query(t *testing.T) {
+	dir, err := ioutil.TempDir("", "discriminator-audit")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	f, err := NewFile(ctx, filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatalf("NewFile() error = %v", err)
+	}
+
+	entries, err := f.Query(ctx, "web")
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Query() on missing file = %v, %v, want no entries", entries, err)
+	}
+
+	for _, entry := range []Entry{
+		{Name: "/web", OldID: "1", NewID: "2", Outcome: OutcomeSuccess},
+		{Name: "/db", OldID: "3", Outcome: OutcomeFailed},
+		{Name: "/web", OldID: "2", Outcome: OutcomeRolledBack, Rollback: &Rollback{Restored: true}},
+	} {
+		if err := f.Append(entry); err != nil {
+			t.Fatalf("Append() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		wantIDs []string
+	}{
+		{name: "web", wantIDs: []string{"1", "2"}},
+		{name: "/db", wantIDs: []string{"3"}},
+		{name: "", wantIDs: []string{"1", "3", "2"}},
+		{name: "missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := f.Query(ctx, tt.name)
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			var ids []string
+			for _, entry := range entries {
+				ids = append(ids, entry.OldID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("Query() ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
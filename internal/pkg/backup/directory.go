@@ -0,0 +1,169 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const extension = ".json"
+
+// Backup is a stored snapshot of an inspected container
+type Backup struct {
+	// File is the name of the backup file in the directory
+	File        string
+	Name        string
+	ContainerID string
+	Time        time.Time
+}
+
+// Directory stores backups of inspected containers as json files
+type Directory struct {
+	path     string
+	maxCount int
+	maxAge   time.Duration
+}
+
+// NewDirectory creates a backup directory at the given path
+//
+// Only the maxCount newest backups of each container are kept, and backups older than maxAge are removed.
+// A zero value disables the respective limit.
+func NewDirectory(_ context.Context, path string, maxCount int, maxAge time.Duration) (*Directory, error) {
+	err := os.MkdirAll(path, 0750)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create backup directory %s", path)
+	}
+	return &Directory{
+		path:     path,
+		maxCount: maxCount,
+		maxAge:   maxAge,
+	}, nil
+}
+
+// Save writes the inspected container to a new backup file and prunes old backups
+//
+// Returns the name of the backup file
+func (d *Directory) Save(ctx context.Context, container types.ContainerJSON) (string, error) {
+	content, err := json.MarshalIndent(container, "", "  ")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to encode container %s", container.ID)
+	}
+	name := strings.TrimPrefix(container.Name, "/")
+	file := fmt.Sprintf("%s.%d.%s%s", name, time.Now().UnixNano(), shortID(container.ID), extension)
+	err = ioutil.WriteFile(filepath.Join(d.path, file), content, 0640)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to write backup %s", file)
+	}
+
+	err = d.prune(ctx, name)
+	if err != nil {
+		logrus.WithContext(ctx).WithError(err).Warnf("Failed to remove old backups of %s", name)
+	}
+	return file, nil
+}
+
+// Load reads the container snapshot in the backup file
+//
+// The backup can be given as a file name in the directory or as a path
+func (d *Directory) Load(_ context.Context, backup string) (types.ContainerJSON, error) {
+	path := backup
+	if _, err := os.Stat(path); err != nil {
+		path = filepath.Join(d.path, filepath.Base(backup))
+	}
+	content, err := ioutil.ReadFile(path) //nolint:gosec
+	if err != nil {
+		return types.ContainerJSON{}, errors.Wrapf(err, "failed to read backup %s", backup)
+	}
+	var container types.ContainerJSON
+	err = json.Unmarshal(content, &container)
+	if err != nil {
+		return types.ContainerJSON{}, errors.Wrapf(err, "failed to decode backup %s", backup)
+	}
+	if container.ContainerJSONBase == nil || container.Config == nil {
+		return types.ContainerJSON{}, fmt.Errorf("backup %s is not an inspected container", backup)
+	}
+	return container, nil
+}
+
+// List returns the backups of the container with the given name, newest first
+//
+// An empty name lists the backups of all containers
+func (d *Directory) List(_ context.Context, name string) ([]Backup, error) {
+	files, err := ioutil.ReadDir(d.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read backup directory %s", d.path)
+	}
+	name = strings.TrimPrefix(name, "/")
+	var backups []Backup
+	for _, file := range files {
+		backup, ok := parseFileName(file.Name())
+		if !ok || (name != "" && backup.Name != name) {
+			continue
+		}
+		backups = append(backups, backup)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// prune removes the backups of the container exceeding the retention limits
+func (d *Directory) prune(ctx context.Context, name string) error {
+	backups, err := d.List(ctx, name)
+	if err != nil {
+		return err
+	}
+	for i, backup := range backups {
+		tooMany := d.maxCount > 0 && i >= d.maxCount
+		tooOld := d.maxAge > 0 && time.Since(backup.Time) > d.maxAge
+		if !tooMany && !tooOld {
+			continue
+		}
+		logrus.WithContext(ctx).Debugf("Removing backup %s", backup.File)
+		err := os.Remove(filepath.Join(d.path, backup.File))
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove backup %s", backup.File)
+		}
+	}
+	return nil
+}
+
+// parseFileName parses a backup file name on the form "<name>.<unix nano>.<short id>.json"
+func parseFileName(file string) (Backup, bool) {
+	if !strings.HasSuffix(file, extension) {
+		return Backup{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(file, extension), ".")
+	if len(parts) < 3 {
+		return Backup{}, false
+	}
+	nanos, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return Backup{}, false
+	}
+	return Backup{
+		File:        file,
+		Name:        strings.Join(parts[:len(parts)-2], "."),
+		ContainerID: parts[len(parts)-1],
+		Time:        time.Unix(0, nanos),
+	}, true
+}
+
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
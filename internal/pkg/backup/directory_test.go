@@ -0,0 +1,69 @@
+package backup
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+func TestDirectory(t *testing.T) {
+	path, err := ioutil.TempDir("", "discriminator-backup")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(path)
+	ctx := context.Background()
+	d, err := NewDirectory(ctx, path, 2, 0)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+
+	snapshot := func(id, name string) types.ContainerJSON {
+		return types.ContainerJSON{
+			ContainerJSONBase: &types.ContainerJSONBase{ID: id, Name: name, State: &types.ContainerState{Running: true}},
+			Config:            &container.Config{Labels: map[string]string{"id": id}},
+		}
+	}
+	var files []string
+	for _, id := range []string{"a1", "a2", "a3"} {
+		file, err := d.Save(ctx, snapshot(id, "/web.app"))
+		if err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		files = append(files, file)
+	}
+	if _, err := d.Save(ctx, snapshot("b1", "/db")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	backups, err := d.List(ctx, "web.app")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	var ids []string
+	for _, b := range backups {
+		ids = append(ids, b.ContainerID)
+	}
+	if !reflect.DeepEqual(ids, []string{"a3", "a2"}) {
+		t.Errorf("List() ids = %v, want only the two newest", ids)
+	}
+	if all, _ := d.List(ctx, ""); len(all) != 3 {
+		t.Errorf("List() of all containers returned %d backups, want 3", len(all))
+	}
+
+	loaded, err := d.Load(ctx, files[2])
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if loaded.ID != "a3" || loaded.Name != "/web.app" || !loaded.State.Running || loaded.Config.Labels["id"] != "a3" {
+		t.Errorf("Load() = %+v, want the snapshot of a3", loaded)
+	}
+	if _, err := d.Load(ctx, files[0]); err == nil {
+		t.Errorf("Load() of pruned backup expected error")
+	}
+}
@@ -0,0 +1,340 @@
+// Package compose reads and rewrites the labels of the services in docker compose files
+package compose
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// File is a parsed compose file
+//
+// The file is kept as a yaml node tree, so the order of all keys, comments, anchors
+// and aliases are kept when it is written. Only the labels that are set are rewritten
+type File struct {
+	document yaml.Node
+}
+
+// Service is a service in a compose file with the labels declared for it
+type Service struct {
+	Name   string
+	Labels map[string]string
+}
+
+// LoadFromPath reads and parses the compose file at the path
+func LoadFromPath(_ context.Context, filePath string) (*File, error) {
+	content, err := ioutil.ReadFile(filePath) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read compose file %s", filePath)
+	}
+	f, err := Parse(content)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse compose file %s", filePath)
+	}
+	return f, nil
+}
+
+// Parse parses the content of a compose file
+func Parse(content []byte) (*File, error) {
+	f := &File{}
+	if err := yaml.Unmarshal(content, &f.document); err != nil {
+		return nil, err
+	}
+	if root := f.root(); root != nil && root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("compose file is not a mapping")
+	}
+	untagMerges(&f.document)
+	// Validates the services and their labels
+	if _, err := f.Services(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Services returns the services of the file in the order they are declared
+func (f *File) Services() ([]Service, error) {
+	services := mapping(lookup(f.root(), "services"))
+	result := make([]Service, 0, len(services)/2)
+	for _, pair := range pairs(services) {
+		name := pair[0].Value
+		service := resolve(pair[1])
+		if service.Kind != yaml.MappingNode && !isNull(service) {
+			return nil, fmt.Errorf("service %s is not a mapping", name)
+		}
+		labels, err := parseLabels(lookup(service, "labels"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid labels of service %s", name)
+		}
+		result = append(result, Service{Name: name, Labels: labels})
+	}
+	return result, nil
+}
+
+// SetLabels replaces the labels of the service
+//
+// Labels declared as a list are written as a list, otherwise as a mapping, sorted by key.
+// Comments of labels that are kept stay with them
+func (f *File) SetLabels(name string, labels map[string]string) error {
+	for _, pair := range pairs(mapping(lookup(f.root(), "services"))) {
+		if pair[0].Value != name {
+			continue
+		}
+		service := pair[1]
+		switch {
+		case isNull(service):
+			*service = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		case service.Kind == yaml.AliasNode:
+			// The aliased service is merged into a mapping of its own, so it's left as is
+			alias := *service
+			*service = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{mergeKey(), &alias}}
+		}
+		if service.Kind != yaml.MappingNode {
+			return fmt.Errorf("service %s is not a mapping", name)
+		}
+		current := ownValue(service, "labels")
+		if current != nil && current.Anchor != "" {
+			return fmt.Errorf("labels of service %s are an anchor, declare them without one to rewrite them", name)
+		}
+		if len(labels) == 0 && lookup(service, "labels") == current {
+			remove(service, "labels")
+			return nil
+		}
+		var value *yaml.Node
+		if declared := resolve(lookup(service, "labels")); declared != nil && declared.Kind == yaml.SequenceNode {
+			value = listLabels(declared, labels)
+		} else {
+			value = mappingLabels(declared, labels)
+		}
+		set(service, "labels", value)
+		return nil
+	}
+	return fmt.Errorf("no service named %s", name)
+}
+
+// Marshal returns the content of the file
+func (f *File) Marshal() ([]byte, error) {
+	if f.root() == nil {
+		return nil, nil
+	}
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&f.document); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// root returns the top level node of the file, or nil if the file is empty
+func (f *File) root() *yaml.Node {
+	if f.document.Kind != yaml.DocumentNode || len(f.document.Content) == 0 {
+		return nil
+	}
+	return resolve(f.document.Content[0])
+}
+
+// parseLabels reads labels declared as a mapping or as a list of "key=value"
+func parseLabels(node *yaml.Node) (map[string]string, error) {
+	labels := make(map[string]string)
+	node = resolve(node)
+	switch {
+	case node == nil || isNull(node):
+	case node.Kind == yaml.MappingNode:
+		for _, pair := range pairs(node.Content) {
+			value := resolve(pair[1])
+			if value.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("label %s is not a scalar", pair[0].Value)
+			}
+			labels[pair[0].Value] = scalar(value)
+		}
+	case node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			item = resolve(item)
+			if item.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("labels in a list have to be scalars")
+			}
+			key, value := splitLabel(scalar(item))
+			labels[key] = value
+		}
+	default:
+		return nil, fmt.Errorf("labels have to be a mapping or a list")
+	}
+	return labels, nil
+}
+
+// mappingLabels returns a mapping of the labels, reusing the nodes of the labels declared before
+func mappingLabels(declared *yaml.Node, labels map[string]string) *yaml.Node {
+	previous := make(map[string][2]*yaml.Node)
+	if declared != nil && declared.Kind == yaml.MappingNode {
+		for _, pair := range pairs(declared.Content) {
+			previous[pair[0].Value] = pair
+		}
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, key := range sortedKeys(labels) {
+		keyNode, value := stringNode(key), stringNode(labels[key])
+		if pair, ok := previous[key]; ok {
+			keyNode = pair[0]
+			copyComments(value, pair[1])
+		}
+		node.Content = append(node.Content, keyNode, value)
+	}
+	return node
+}
+
+// listLabels returns a list of the labels, reusing the items of the labels declared before
+func listLabels(declared *yaml.Node, labels map[string]string) *yaml.Node {
+	items := make(map[string]*yaml.Node)
+	for _, item := range declared.Content {
+		key, _ := splitLabel(item.Value)
+		items[key] = item
+	}
+	node := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, key := range sortedKeys(labels) {
+		item := stringNode(key + "=" + labels[key])
+		if previous, ok := items[key]; ok {
+			copyComments(item, previous)
+		}
+		node.Content = append(node.Content, item)
+	}
+	return node
+}
+
+func copyComments(to, from *yaml.Node) {
+	to.HeadComment = from.HeadComment
+	to.LineComment = from.LineComment
+	to.FootComment = from.FootComment
+}
+
+func splitLabel(label string) (string, string) {
+	parts := strings.SplitN(label, "=", 2)
+	if len(parts) == 1 {
+		parts = append(parts, "")
+	}
+	return parts[0], parts[1]
+}
+
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func mergeKey() *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: "<<"}
+}
+
+func stringNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// scalar returns the value of a scalar node, null is an empty string
+func scalar(node *yaml.Node) string {
+	if isNull(node) {
+		return ""
+	}
+	return node.Value
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+// untagMerges clears the tags of merge keys, the encoder would otherwise write them as "!!merge <<"
+func untagMerges(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!!merge" {
+		node.Tag = ""
+	}
+	for _, child := range node.Content {
+		untagMerges(child)
+	}
+}
+
+// resolve returns the node an alias refers to
+func resolve(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+// mapping returns the keys and values of a mapping node, or nil if it isn't one
+func mapping(node *yaml.Node) []*yaml.Node {
+	if node = resolve(node); node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	return node.Content
+}
+
+// pairs groups the content of a mapping node into keys and values
+func pairs(content []*yaml.Node) [][2]*yaml.Node {
+	result := make([][2]*yaml.Node, 0, len(content)/2)
+	for i := 0; i+1 < len(content); i += 2 {
+		result = append(result, [2]*yaml.Node{content[i], content[i+1]})
+	}
+	return result
+}
+
+// ownValue returns the value of the key declared in the mapping itself, or nil if missing
+func ownValue(node *yaml.Node, key string) *yaml.Node {
+	for _, pair := range pairs(mapping(node)) {
+		if pair[0].Value == key {
+			return pair[1]
+		}
+	}
+	return nil
+}
+
+// lookup returns the value of the key in the mapping, including keys merged with "<<", or nil if missing
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if value := ownValue(node, key); value != nil {
+		return value
+	}
+	merged := ownValue(node, "<<")
+	if merged = resolve(merged); merged == nil {
+		return nil
+	}
+	if merged.Kind == yaml.MappingNode {
+		return lookup(merged, key)
+	}
+	for _, item := range merged.Content {
+		if value := lookup(resolve(item), key); value != nil {
+			return value
+		}
+	}
+	return nil
+}
+
+// set sets the value of the key declared in the mapping, adding the key if missing
+func set(node *yaml.Node, key string, value *yaml.Node) {
+	for i, pair := range pairs(node.Content) {
+		if pair[0].Value == key {
+			copyComments(value, pair[1])
+			node.Content[2*i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, stringNode(key), value)
+}
+
+// remove removes the key declared in the mapping, keys merged with "<<" are kept
+func remove(node *yaml.Node, key string) {
+	for i, pair := range pairs(node.Content) {
+		if pair[0].Value == key {
+			node.Content = append(node.Content[:2*i], node.Content[2*i+2:]...)
+			return
+		}
+	}
+}
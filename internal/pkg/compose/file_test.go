@@ -0,0 +1,164 @@
+package compose
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFile_Services(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []Service
+		wantErr bool
+	}{
+		{
+			name: "mapping and list",
+			content: `
+services:
+  web:
+    image: nginx
+    labels:
+      a: "1"
+      b:
+  db:
+    labels: ["c=2", "d"]
+  cache:
+`,
+			want: []Service{
+				{Name: "web", Labels: map[string]string{"a": "1", "b": ""}},
+				{Name: "db", Labels: map[string]string{"c": "2", "d": ""}},
+				{Name: "cache", Labels: map[string]string{}},
+			},
+		},
+		{
+			name:    "no services",
+			content: "version: '3'",
+			want:    []Service{},
+		},
+		{
+			name:    "invalid labels",
+			content: "services: {web: {labels: value}}",
+			wantErr: true,
+		},
+		{
+			name:    "invalid yaml",
+			content: "services: [",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := f.Services()
+			if err != nil {
+				t.Fatalf("Services() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Services() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFile_SetLabels(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		service string
+		labels  map[string]string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "mapping",
+			content: "version: \"3\"\nservices:\n  web:\n    labels:\n      b: \"2\"\n    image: nginx\n",
+			service: "web",
+			labels:  map[string]string{"b": "2", "a": "1"},
+			want:    "version: \"3\"\nservices:\n  web:\n    labels:\n      a: \"1\"\n      b: \"2\"\n    image: nginx\n",
+		},
+		{
+			name:    "list",
+			content: "services:\n  web:\n    labels: [b=2]\n",
+			service: "web",
+			labels:  map[string]string{"b": "3", "a": "1"},
+			want:    "services:\n  web:\n    labels:\n      - a=1\n      - b=3\n",
+		},
+		{
+			name:    "added",
+			content: "services:\n  web:\n    image: nginx\n",
+			service: "web",
+			labels:  map[string]string{"a": "1"},
+			want:    "services:\n  web:\n    image: nginx\n    labels:\n      a: \"1\"\n",
+		},
+		{
+			name:    "removed",
+			content: "services:\n  web:\n    labels: {a: \"1\"}\n    image: nginx\n",
+			service: "web",
+			want:    "services:\n  web:\n    image: nginx\n",
+		},
+		{
+			name: "comments",
+			content: "# head\nservices:\n  web:\n    image: nginx # line\n" +
+				"    labels:\n      # kept\n      b: \"2\"\n      c: \"3\"\n",
+			service: "web",
+			labels:  map[string]string{"b": "3", "a": "1"},
+			want: "# head\nservices:\n  web:\n    image: nginx # line\n" +
+				"    labels:\n      a: \"1\"\n      # kept\n      b: \"3\"\n",
+		},
+		{
+			name:    "anchors",
+			content: "x-env: &env\n  A: \"1\"\nservices:\n  base: &base\n    environment: *env\n  web: *base\n",
+			service: "web",
+			labels:  map[string]string{"a": "1"},
+			want: "x-env: &env\n  A: \"1\"\nservices:\n  base: &base\n    environment: *env\n" +
+				"  web:\n    <<: *base\n    labels:\n      a: \"1\"\n",
+		},
+		{
+			name:    "merged",
+			content: "services:\n  base: &base\n    labels: {a: \"1\"}\n  web:\n    <<: *base\n",
+			service: "web",
+			want:    "services:\n  base: &base\n    labels: {a: \"1\"}\n  web:\n    <<: *base\n    labels: {}\n",
+		},
+		{
+			name:    "anchored labels",
+			content: "services:\n  web:\n    labels: &labels {a: \"1\"}\n  db:\n    labels: *labels\n",
+			service: "web",
+			wantErr: true,
+		},
+		{
+			name:    "missing service",
+			content: "services:\n  web:\n    image: nginx\n",
+			service: "db",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := Parse([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			err = f.SetLabels(tt.service, tt.labels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := f.Marshal()
+			if err != nil {
+				t.Fatalf("Marshal() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("Marshal() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
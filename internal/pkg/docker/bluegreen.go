@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// blueGreenUpdater starts a new container with the labels before the old container is stopped
+type blueGreenUpdater struct {
+	s *Service
+}
+
+func (blueGreenUpdater) Name() string {
+	return StrategyBlueGreen
+}
+
+func (blueGreenUpdater) Replaces() bool {
+	return true
+}
+
+// Check makes sure the container can run side by side with a copy of itself
+//
+// The container has to be running, can't bind any host ports or use the host network
+// and can only have read-only mounts
+func (blueGreenUpdater) Check(container types.ContainerJSON) error {
+	if !container.State.Running {
+		return fmt.Errorf("container is not running")
+	}
+	if container.HostConfig != nil {
+		if container.HostConfig.NetworkMode.IsHost() {
+			return fmt.Errorf("container uses the host network")
+		}
+		for port, bindings := range container.HostConfig.PortBindings {
+			if len(bindings) > 0 {
+				return fmt.Errorf("container binds host port for %s", port)
+			}
+		}
+	}
+	for _, mount := range container.Mounts {
+		if mount.RW {
+			return fmt.Errorf("container has a writable mount at %s", mount.Destination)
+		}
+	}
+	return nil
+}
+
+// UpdateLabels replaces the container with a new one with the specified labels,
+// starting the new container before the old one is stopped.
+//
+// The new container is created under a temporary name and takes over the name once the old container is stopped.
+// Returns the id of the new container, rollbacks are recorded in the entry
+func (u blueGreenUpdater) UpdateLabels(
+	ctx context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+	entry *audit.Entry,
+) (string, error) {
+	s := u.s
+	err := s.backup(ctx, container, entry)
+	if err != nil {
+		// Never destroy a container that can't be recovered
+		return "", err
+	}
+
+	temporaryName := container.Name + newSuffix
+	newID, err := s.createReplacement(ctx, container, temporaryName, labels)
+	if err == nil {
+		err = s.waitUntilHealthy(ctx, newID)
+	}
+	if err != nil {
+		// The old container has not been touched yet
+		return newID, s.rollback(ctx, container, newID, false, err, entry)
+	}
+
+	oldName := container.Name + oldSuffix
+	logrus.WithContext(ctx).Debugf("Stopping container %s", container.ID)
+	err = s.dockerClient.ContainerStop(ctx, container.ID, &timeout)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to stop container %s", container.ID)
+		return newID, s.rollback(ctx, container, newID, false, err, entry)
+	}
+	logrus.WithContext(ctx).Debugf("Changing name of container %s from %s to %s", container.ID, container.Name, oldName)
+	err = s.dockerClient.ContainerRename(ctx, container.ID, oldName)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to rename container %s from %s to %s", container.ID, container.Name, oldName)
+		return newID, s.rollback(ctx, container, newID, false, err, entry)
+	}
+	logrus.WithContext(ctx).Debugf("Changing name of container %s from %s to %s", newID, temporaryName, container.Name)
+	err = s.dockerClient.ContainerRename(ctx, newID, container.Name)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to rename container %s from %s to %s", newID, temporaryName, container.Name)
+		return newID, s.rollback(ctx, container, newID, true, err, entry)
+	}
+
+	logrus.WithContext(ctx).Debugf("Removing old container with name: %s and id: %s", oldName, container.ID)
+	err = s.dockerClient.ContainerRemove(ctx, container.ID, types.ContainerRemoveOptions{})
+	if err != nil {
+		return newID, errors.Wrapf(err, "failed to remove old container (%s) with name: %s", container.ID, oldName)
+	}
+	return newID, nil
+}
@@ -0,0 +1,156 @@
+package docker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+func TestService_SetLabels_blueGreen(t *testing.T) {
+	const strategyLabel = "strategy"
+	tests := []struct {
+		name         string
+		container    dockertest.Container
+		fail         string
+		wantStrategy string
+		wantOutcome  audit.Outcome
+		// wantOldStopped is whether the old container is expected to have been stopped at any point
+		wantOldStopped bool
+	}{
+		{
+			name: "blue green",
+			container: dockertest.Container{
+				Labels:   map[string]string{strategyLabel: docker.StrategyBlueGreen},
+				Networks: map[string]string{"frontend": "n1"},
+			},
+			wantStrategy:   docker.StrategyBlueGreen,
+			wantOutcome:    audit.OutcomeSuccess,
+			wantOldStopped: true,
+		},
+		{
+			name: "new container fails to start",
+			container: dockertest.Container{
+				Labels: map[string]string{strategyLabel: docker.StrategyBlueGreen},
+			},
+			fail:           dockertest.MethodContainerStart,
+			wantStrategy:   docker.StrategyBlueGreen,
+			wantOutcome:    audit.OutcomeRolledBack,
+			wantOldStopped: false,
+		},
+		{
+			name: "swapping names fails",
+			container: dockertest.Container{
+				Labels: map[string]string{strategyLabel: docker.StrategyBlueGreen},
+			},
+			fail:           dockertest.MethodContainerRename,
+			wantStrategy:   docker.StrategyBlueGreen,
+			wantOutcome:    audit.OutcomeRolledBack,
+			wantOldStopped: true,
+		},
+		{
+			name: "host port falls back to recreate",
+			container: dockertest.Container{
+				Labels: map[string]string{strategyLabel: docker.StrategyBlueGreen},
+				HostConfig: &container.HostConfig{
+					PortBindings: nat.PortMap{"80/tcp": {{HostPort: "8080"}}},
+				},
+			},
+			wantStrategy:   docker.StrategyRecreate,
+			wantOutcome:    audit.OutcomeSuccess,
+			wantOldStopped: true,
+		},
+		{
+			name:           "no label",
+			container:      dockertest.Container{},
+			wantStrategy:   docker.StrategyRecreate,
+			wantOutcome:    audit.OutcomeSuccess,
+			wantOldStopped: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := dockertest.NewClient()
+			spec := tt.container
+			spec.Name = "web"
+			spec.Running = true
+			id := client.AddContainer(spec)
+			if tt.fail != "" {
+				client.Fail(tt.fail, errInjected)
+			}
+			auditLog := &memoryAuditLog{}
+			service, _ := docker.NewService(ctx, client, docker.ServiceOptions{
+				AuditLog:      auditLog,
+				StrategyLabel: strategyLabel,
+			})
+
+			newLabels := map[string]string{strategyLabel: docker.StrategyBlueGreen, "new": "label"}
+			err := service.SetLabels(ctx, id, "instruction()", newLabels)
+			if (err != nil) != (tt.wantOutcome != audit.OutcomeSuccess) {
+				t.Errorf("SetLabels() error = %v, want outcome %v", err, tt.wantOutcome)
+			}
+			entry := (*auditLog)[0]
+			if entry.Strategy != tt.wantStrategy || entry.Outcome != tt.wantOutcome {
+				t.Errorf("audit entry = %v/%v, want %v/%v", entry.Strategy, entry.Outcome, tt.wantStrategy, tt.wantOutcome)
+			}
+
+			var oldStopped bool
+			for _, call := range client.Calls() {
+				if call.Method == dockertest.MethodContainerStop && call.Args[0] == id {
+					oldStopped = true
+				}
+				// The old container may only be stopped once the new one is running
+				if tt.wantStrategy == docker.StrategyBlueGreen && call.Method == dockertest.MethodContainerCreate &&
+					oldStopped {
+					t.Errorf("new container created after the old one was stopped")
+				}
+			}
+			if oldStopped != tt.wantOldStopped {
+				t.Errorf("old container stopped = %v, want %v", oldStopped, tt.wantOldStopped)
+			}
+
+			web, _ := client.Container("web")
+			if !web.State.Running {
+				t.Errorf("container web is not running")
+			}
+			if names := client.Names(); !reflect.DeepEqual(names, []string{"web"}) {
+				t.Errorf("container names = %v, want only web", names)
+			}
+			connected := web.NetworkSettings.Networks["frontend"] != nil
+			if tt.wantOutcome == audit.OutcomeSuccess && !connected && spec.Networks != nil {
+				t.Errorf("new container not connected to network")
+			}
+			if tt.wantOutcome != audit.OutcomeSuccess && web.ID != id {
+				t.Errorf("container web has id %s, want the old container %s", web.ID, id)
+			}
+		})
+	}
+}
+
+// Make sure mounts are considered when choosing strategy
+func TestService_SetLabels_blueGreenWritableMount(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	id := client.AddContainer(dockertest.Container{
+		Name:    "db",
+		Running: true,
+		Labels:  map[string]string{"strategy": docker.StrategyBlueGreen},
+		Mounts:  []types.MountPoint{{Destination: "/data", RW: true}},
+	})
+	auditLog := &memoryAuditLog{}
+	service, _ := docker.NewService(ctx, client, docker.ServiceOptions{AuditLog: auditLog, StrategyLabel: "strategy"})
+	if err := service.SetLabels(ctx, id, "instruction()", map[string]string{}); err != nil {
+		t.Fatalf("SetLabels() error = %v", err)
+	}
+	if got := (*auditLog)[0].Strategy; got != docker.StrategyRecreate {
+		t.Errorf("strategy = %v, want %v", got, docker.StrategyRecreate)
+	}
+}
@@ -3,6 +3,8 @@ package docker
 // Container is a simplistic representation of
 // a docker container
 type Container struct {
+	// Host is the name of the docker host the container runs on
+	Host   string
 	Name   string
 	ID     string
 	Labels map[string]string
@@ -0,0 +1,221 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Policies for containers depending on a container that is replaced
+const (
+	// DependentsRecreate recreates dependents referencing the container by id and restarts
+	// dependents referencing it by name, after the container has been replaced
+	DependentsRecreate = "recreate"
+	// DependentsRefuse refuses to replace containers that have dependents
+	DependentsRefuse = "refuse"
+	// DependentsIgnore leaves dependents as they are
+	DependentsIgnore = "ignore"
+)
+
+// dependent is a container referencing another container through its
+// network mode, volumes-from or links
+type dependent struct {
+	container types.ContainerJSON
+	// byID is set if any of the references uses the id of the container rather than its name
+	byID bool
+}
+
+// validateDependentsPolicy makes sure the policy is known
+func validateDependentsPolicy(policy string) error {
+	switch policy {
+	case DependentsRecreate, DependentsRefuse, DependentsIgnore:
+		return nil
+	default:
+		return fmt.Errorf("unknown dependents policy %s", policy)
+	}
+}
+
+// inspectAll inspects all containers, running or not, leaving out containers removed in the meantime
+func (s *Service) inspectAll(ctx context.Context) ([]types.ContainerJSON, error) {
+	containers, err := s.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list containers")
+	}
+	inspected := make([]types.ContainerJSON, 0, len(containers))
+	for _, c := range containers {
+		details, err := s.dockerClient.ContainerInspect(ctx, c.ID)
+		if client.IsErrNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspection failed for container with id: %s", c.ID)
+		}
+		inspected = append(inspected, details)
+	}
+	return inspected, nil
+}
+
+// findDependents returns the inspected containers that reference the target
+func findDependents(containers []types.ContainerJSON, target types.ContainerJSON) []dependent {
+	var dependents []dependent
+	for _, c := range containers {
+		if c.ID == target.ID {
+			continue
+		}
+		found, byID := false, false
+		for _, reference := range references(c.HostConfig) {
+			if matches, id := refersTo(reference, target); matches {
+				found = true
+				byID = byID || id
+			}
+		}
+		if found {
+			dependents = append(dependents, dependent{container: c, byID: byID})
+		}
+	}
+	return dependents
+}
+
+// updateDependents brings the dependents of a replaced container back in working order
+//
+// Dependents referencing the old id are recreated pointing to the new id, other running dependents
+// are restarted to pick up the new container. Dependents of dependents are handled in turn,
+// so every container is handled after the container it depends on.
+// The dependents of dependents are found among the containers inspected before the container was replaced.
+func (s *Service) updateDependents(
+	ctx context.Context,
+	old types.ContainerJSON,
+	newID string,
+	dependents []dependent,
+	containers []types.ContainerJSON,
+) error {
+	var failed []string
+	for _, d := range dependents {
+		var err error
+		if d.byID && newID != old.ID {
+			err = s.recreateDependent(ctx, d.container, old, newID, containers)
+		} else {
+			err = s.restartDependent(ctx, d.container, containers)
+		}
+		if err != nil {
+			logrus.WithContext(ctx).WithError(err).Errorf("Failed to update dependent container %s", d.container.Name)
+			failed = append(failed, d.container.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf(
+			"container %s was replaced but its dependents %s could not be updated", old.Name, strings.Join(failed, ", "),
+		)
+	}
+	return nil
+}
+
+// recreateDependent recreates the dependent with its references to the old container rewritten to the new id
+func (s *Service) recreateDependent(
+	ctx context.Context,
+	d, old types.ContainerJSON,
+	newID string,
+	containers []types.ContainerJSON,
+) error {
+	updater := s.updaters[StrategyRecreate]
+	err := updater.Check(d)
+	if err != nil {
+		return fmt.Errorf("container %s can't be recreated: %v", d.Name, err)
+	}
+	logrus.WithContext(ctx).Infof("Recreating %s since it depends on %s", d.Name, old.Name)
+	hostConfig := rewriteReferences(*d.HostConfig, old, newID)
+	d.HostConfig = &hostConfig
+	_, err = s.update(ctx, d, "", d.Config.Labels, updater, containers)
+	return err
+}
+
+// restartDependent restarts the dependent, if running, and the containers depending on it
+func (s *Service) restartDependent(ctx context.Context, d types.ContainerJSON, containers []types.ContainerJSON) error {
+	if !d.State.Running {
+		return nil
+	}
+	dependents := findDependents(containers, d)
+	logrus.WithContext(ctx).Infof("Restarting %s since it depends on a replaced container", d.Name)
+	err := s.dockerClient.ContainerStop(ctx, d.ID, &timeout)
+	if err != nil {
+		return errors.Wrapf(err, "failed to stop container %s", d.ID)
+	}
+	err = s.dockerClient.ContainerStart(ctx, d.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return errors.Wrapf(err, "failed to start container %s", d.ID)
+	}
+	return s.updateDependents(ctx, d, d.ID, dependents, containers)
+}
+
+// references returns the names or ids of all containers referenced by the host config
+func references(hostConfig *container.HostConfig) []string {
+	if hostConfig == nil {
+		return nil
+	}
+	var refs []string
+	if hostConfig.NetworkMode.IsContainer() {
+		refs = append(refs, hostConfig.NetworkMode.ConnectedContainer())
+	}
+	for _, volumesFrom := range hostConfig.VolumesFrom {
+		// On the form "container[:ro|rw]"
+		refs = append(refs, strings.SplitN(volumesFrom, ":", 2)[0])
+	}
+	for _, link := range hostConfig.Links {
+		// On the form "container:alias"
+		refs = append(refs, strings.SplitN(link, ":", 2)[0])
+	}
+	return refs
+}
+
+// refersTo checks if the reference is the name, id or an id prefix of the container
+//
+// Returns if the reference matches and if it does so by id
+func refersTo(reference string, c types.ContainerJSON) (bool, bool) {
+	if reference == "" {
+		return false, false
+	}
+	if strings.TrimPrefix(reference, "/") == strings.TrimPrefix(c.Name, "/") {
+		return true, false
+	}
+	if strings.HasPrefix(c.ID, reference) {
+		return true, true
+	}
+	return false, false
+}
+
+// rewriteReferences returns a copy of the host config with references to the id of the old container
+// replaced with the new id
+func rewriteReferences(hostConfig container.HostConfig, old types.ContainerJSON, newID string) container.HostConfig {
+	rewrite := func(reference string) string {
+		if _, byID := refersTo(reference, old); byID {
+			return newID
+		}
+		return reference
+	}
+	if hostConfig.NetworkMode.IsContainer() {
+		hostConfig.NetworkMode = container.NetworkMode("container:" + rewrite(hostConfig.NetworkMode.ConnectedContainer()))
+	}
+	hostConfig.VolumesFrom = rewriteEach(hostConfig.VolumesFrom, rewrite)
+	hostConfig.Links = rewriteEach(hostConfig.Links, rewrite)
+	return hostConfig
+}
+
+// rewriteEach rewrites the container part of references on the form "container[:suffix]"
+func rewriteEach(references []string, rewrite func(string) string) []string {
+	if references == nil {
+		return nil
+	}
+	rewritten := make([]string, len(references))
+	for i, reference := range references {
+		parts := strings.SplitN(reference, ":", 2)
+		parts[0] = rewrite(parts[0])
+		rewritten[i] = strings.Join(parts, ":")
+	}
+	return rewritten
+}
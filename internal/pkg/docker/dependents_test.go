@@ -0,0 +1,238 @@
+package docker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+func TestService_SetLabels_dependents(t *testing.T) {
+	const (
+		recreated = "recreated"
+		restarted = "restarted"
+		untouched = "untouched"
+	)
+	tests := []struct {
+		name     string
+		policy   string
+		strategy string
+		// dependents creates the dependents of the container with the given id and name
+		dependents func(c *dockertest.Client, id, name string)
+		// want maps dependent names to what is expected to have happened to them
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "network mode by id",
+			dependents: func(c *dockertest.Client, id, _ string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "sidecar",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + id)},
+				})
+			},
+			want: map[string]string{"sidecar": recreated},
+		},
+		{
+			name: "volumes from by name",
+			dependents: func(c *dockertest.Client, _, name string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "reader",
+					Running:    true,
+					HostConfig: &container.HostConfig{VolumesFrom: []string{name + ":ro"}},
+				})
+			},
+			want: map[string]string{"reader": restarted},
+		},
+		{
+			name: "link",
+			dependents: func(c *dockertest.Client, _, name string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "client",
+					Running:    true,
+					HostConfig: &container.HostConfig{Links: []string{"/" + name + ":/client/db"}},
+				})
+			},
+			want: map[string]string{"client": restarted},
+		},
+		{
+			name: "stopped dependent by name",
+			dependents: func(c *dockertest.Client, _, name string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "reader",
+					HostConfig: &container.HostConfig{VolumesFrom: []string{name}},
+				})
+			},
+			want: map[string]string{"reader": untouched},
+		},
+		{
+			name: "dependent of dependent",
+			dependents: func(c *dockertest.Client, id, _ string) {
+				sidecarID := c.AddContainer(dockertest.Container{
+					Name:       "sidecar",
+					Running:    true,
+					HostConfig: &container.HostConfig{VolumesFrom: []string{id}},
+				})
+				c.AddContainer(dockertest.Container{
+					Name:       "proxy",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + sidecarID)},
+				})
+			},
+			want: map[string]string{"sidecar": recreated, "proxy": recreated},
+		},
+		{
+			name: "unrelated",
+			dependents: func(c *dockertest.Client, _, _ string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "other",
+					Running:    true,
+					HostConfig: &container.HostConfig{Links: []string{"/database:/other/db"}},
+				})
+			},
+			want: map[string]string{"other": untouched},
+		},
+		{
+			name:   "refuse",
+			policy: docker.DependentsRefuse,
+			dependents: func(c *dockertest.Client, id, _ string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "sidecar",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + id)},
+				})
+			},
+			want:    map[string]string{"sidecar": untouched},
+			wantErr: true,
+		},
+		{
+			name:     "refuse with strategy not replacing the container",
+			policy:   docker.DependentsRefuse,
+			strategy: docker.StrategyNotify,
+			dependents: func(c *dockertest.Client, id, _ string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "sidecar",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + id)},
+				})
+			},
+			want: map[string]string{"sidecar": untouched},
+		},
+		{
+			name:   "ignore",
+			policy: docker.DependentsIgnore,
+			dependents: func(c *dockertest.Client, id, _ string) {
+				c.AddContainer(dockertest.Container{
+					Name:       "sidecar",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + id)},
+				})
+			},
+			want: map[string]string{"sidecar": untouched},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := dockertest.NewClient()
+			id := client.AddContainer(dockertest.Container{Name: "db", Running: true})
+			tt.dependents(client, id, "db")
+			before := make(map[string]string)
+			running := make(map[string]bool)
+			for name := range tt.want {
+				dependent, _ := client.Container(name)
+				before[name] = dependent.ID
+				running[name] = dependent.State.Running
+			}
+
+			service, err := docker.NewService(ctx, client, docker.ServiceOptions{
+				DefaultStrategy: tt.strategy,
+				Dependents:      tt.policy,
+			})
+			if err != nil {
+				t.Fatalf("NewService() error = %v", err)
+			}
+			err = service.SetLabels(ctx, id, "", map[string]string{"new": "label"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			for name, want := range tt.want {
+				dependent, ok := client.Container(name)
+				if !ok {
+					t.Fatalf("dependent %s is missing, containers: %v", name, client.Names())
+				}
+				stopped := false
+				for _, call := range client.Calls() {
+					if call.Method == dockertest.MethodContainerStop && call.Args[0] == before[name] {
+						stopped = true
+					}
+				}
+				got := untouched
+				switch {
+				case dependent.ID != before[name]:
+					got = recreated
+				case stopped:
+					got = restarted
+				}
+				if got != want {
+					t.Errorf("dependent %s was %s, want %s", name, got, want)
+				}
+				if dependent.State.Running != running[name] {
+					t.Errorf("dependent %s running = %v, want %v", name, dependent.State.Running, running[name])
+				}
+				if mode := dependent.HostConfig.NetworkMode; want == recreated && mode.IsContainer() &&
+					mode.ConnectedContainer() == id {
+					t.Errorf("dependent %s still uses the network of the old container %s", name, id)
+				}
+			}
+		})
+	}
+}
+
+func TestService_SetLabels_dependentsRemoved(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	id := client.AddContainer(dockertest.Container{Name: "web", Running: true})
+	goneID := client.AddContainer(dockertest.Container{Name: "gone"})
+	client.AddContainer(dockertest.Container{
+		Name:       "sidecar",
+		Running:    true,
+		HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + id)},
+	})
+	// The update inspects web and then every container, gone is removed after it was listed
+	client.Fail(dockertest.MethodContainerInspect, nil, nil, dockertest.NotFound(goneID))
+	service, err := docker.NewService(ctx, client, docker.ServiceOptions{})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	if err := service.SetLabels(ctx, id, "", map[string]string{"new": "label"}); err != nil {
+		t.Fatalf("SetLabels() error = %v, want containers removed in the meantime to be skipped", err)
+	}
+	if sidecar, _ := client.Container("sidecar"); sidecar.HostConfig.NetworkMode.ConnectedContainer() == id {
+		t.Errorf("sidecar still uses the network of the old container %s", id)
+	}
+	inspects := 0
+	for _, call := range client.Calls() {
+		if call.Method == dockertest.MethodContainerInspect {
+			inspects++
+		}
+	}
+	// Web is inspected for the update and then all containers once, not again for the dependents of the sidecar
+	if inspects != 4 {
+		t.Errorf("containers inspected %d times, want 4, calls: %v", inspects, client.Calls())
+	}
+}
+
+func TestNewService_dependents(t *testing.T) {
+	_, err := docker.NewService(context.Background(), dockertest.NewClient(), docker.ServiceOptions{
+		Dependents: "unknown",
+	})
+	if err == nil {
+		t.Errorf("NewService() expected error for unknown dependents policy")
+	}
+}
@@ -0,0 +1,634 @@
+// Package dockertest provides an in-memory docker client for testing
+package dockertest
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+// Names of the client methods, used for failure injection and call records
+const (
+	MethodClose            = "Close"
+	MethodContainerCreate  = "ContainerCreate"
+	MethodContainerRemove  = "ContainerRemove"
+	MethodContainerRename  = "ContainerRename"
+	MethodContainerList    = "ContainerList"
+	MethodContainerInspect = "ContainerInspect"
+	MethodContainerStart   = "ContainerStart"
+	MethodContainerStop    = "ContainerStop"
+	MethodNetworkConnect   = "NetworkConnect"
+	MethodServiceInspect   = "ServiceInspectWithRaw"
+	MethodServiceUpdate    = "ServiceUpdate"
+)
+
+var (
+	_ docker.Client      = (*Client)(nil)
+	_ docker.SwarmClient = (*Client)(nil)
+)
+
+// Container describes a container to add to the client
+type Container struct {
+	Name    string
+	Image   string
+	Labels  map[string]string
+	Env     []string
+	Running bool
+	// Networks maps network names to network ids
+	Networks    map[string]string
+	HostConfig  *container.HostConfig
+	Healthcheck *container.HealthConfig
+	Mounts      []types.MountPoint
+}
+
+// Call is a record of a call made to the client
+type Call struct {
+	Method string
+	// Args holds the container, network and name arguments of the call
+	Args []string
+}
+
+// Client is a stateful in-memory implementation of docker.Client
+//
+// Containers are created, renamed, started, stopped and removed in memory
+// following the same rules as the docker daemon, ex. names have to be unique.
+// Failures can be injected per method with Fail.
+type Client struct {
+	mu         sync.Mutex
+	containers map[string]*types.ContainerJSON
+	services   map[string]*swarm.Service
+	networks   map[string]string
+	failures   map[string][]error
+	calls      []Call
+	nextID     int
+	closed     bool
+	onStart    func(container *types.ContainerJSON)
+	podman     bool
+}
+
+// NewClient creates an empty client
+func NewClient() *Client {
+	return &Client{
+		containers: make(map[string]*types.ContainerJSON),
+		services:   make(map[string]*swarm.Service),
+		networks:   make(map[string]string),
+		failures:   make(map[string][]error),
+	}
+}
+
+// NewPodmanClient creates an empty client behaving like the docker compatible api of podman
+//
+// Creating containers with host config fields podman doesn't support fails, containers sharing
+// the network namespace of another container can't be connected to networks and the infra
+// container of a pod can't be removed while the pod has members
+func NewPodmanClient() *Client {
+	c := NewClient()
+	c.podman = true
+	return c
+}
+
+// AddPod adds a running pod with an infra container named "<name>-infra" and the members,
+// which share the network namespace of the infra container.
+//
+// Returns the id of the infra container
+func (c *Client) AddPod(name string, members ...Container) string {
+	infraID := c.AddContainer(Container{Name: name + "-infra", Running: true})
+	for _, member := range members {
+		hostConfig := container.HostConfig{}
+		if member.HostConfig != nil {
+			hostConfig = *member.HostConfig
+		}
+		hostConfig.NetworkMode = container.NetworkMode("container:" + infraID)
+		member.HostConfig = &hostConfig
+		c.AddContainer(member)
+	}
+	return infraID
+}
+
+// AddContainer adds a container to the client and returns its id
+func (c *Client) AddContainer(spec Container) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hostConfig := spec.HostConfig
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	id := c.newID()
+	json := &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       "/" + strings.TrimPrefix(spec.Name, "/"),
+			State:      &types.ContainerState{Running: spec.Running},
+			Image:      spec.Image,
+			HostConfig: hostConfig,
+		},
+		Mounts: append([]types.MountPoint{}, spec.Mounts...),
+		Config: &container.Config{
+			Image:       spec.Image,
+			Labels:      copyMap(spec.Labels),
+			Env:         append([]string{}, spec.Env...),
+			Healthcheck: spec.Healthcheck,
+		},
+		NetworkSettings: &types.NetworkSettings{
+			Networks: make(map[string]*network.EndpointSettings),
+		},
+	}
+	for name, networkID := range spec.Networks {
+		c.networks[networkID] = name
+		json.NetworkSettings.Networks[name] = &network.EndpointSettings{NetworkID: networkID}
+	}
+	c.containers[id] = json
+	return id
+}
+
+// AddService adds a swarm service with the given container labels and returns its id
+//
+// Tasks of the service are added as containers with the label "com.docker.swarm.service.id" set to the id
+func (c *Client) AddService(name string, labels map[string]string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.newID()
+	service := &swarm.Service{ID: id}
+	service.Version.Index = 1
+	service.Spec.Name = name
+	service.Spec.TaskTemplate.ContainerSpec.Labels = copyMap(labels)
+	c.services[id] = service
+	return id
+}
+
+// Service returns a copy of the swarm service with the given id
+func (c *Client) Service(serviceID string) (swarm.Service, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	service, ok := c.services[serviceID]
+	if !ok {
+		return swarm.Service{}, false
+	}
+	copied := *service
+	copied.Spec.TaskTemplate.ContainerSpec.Labels = copyMap(service.Spec.TaskTemplate.ContainerSpec.Labels)
+	return copied, true
+}
+
+// AddNetwork makes a network known to the client
+func (c *Client) AddNetwork(name, networkID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.networks[networkID] = name
+}
+
+// Fail injects errors for the coming calls to a method, in order.
+//
+// A nil error lets the corresponding call through, ex. Fail(MethodContainerStart, nil, err)
+// makes the second call to ContainerStart fail
+func (c *Client) Fail(method string, errs ...error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failures[method] = append(c.failures[method], errs...)
+}
+
+// OnStart sets a function that is called every time a container is started,
+// allowing the state of the container to be changed, ex. to simulate a crash or a failing health check.
+//
+// Started containers with a health check are "starting" until changed
+func (c *Client) OnStart(f func(container *types.ContainerJSON)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onStart = f
+}
+
+// Calls returns a record of all calls made to the client
+func (c *Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call{}, c.calls...)
+}
+
+// Methods returns the methods of all calls made to the client, in order
+func (c *Client) Methods() []string {
+	calls := c.Calls()
+	methods := make([]string, len(calls))
+	for i, call := range calls {
+		methods[i] = call.Method
+	}
+	return methods
+}
+
+// Closed reports whether the client has been closed
+func (c *Client) Closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Container returns a copy of the container with the given name or id
+func (c *Client) Container(nameOrID string) (types.ContainerJSON, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	json, ok := c.find(nameOrID)
+	if !ok {
+		return types.ContainerJSON{}, false
+	}
+	return copyContainer(json), true
+}
+
+// Names returns the sorted names of all containers, without the leading "/"
+func (c *Client) Names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.containers))
+	for _, json := range c.containers {
+		names = append(names, strings.TrimPrefix(json.Name, "/"))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Close marks the client as closed
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodClose); err != nil {
+		return err
+	}
+	c.closed = true
+	return nil
+}
+
+// ContainerCreate creates a stopped container without any networks
+func (c *Client) ContainerCreate(
+	_ context.Context,
+	config *container.Config,
+	hostConfig *container.HostConfig,
+	_ *network.NetworkingConfig,
+	containerName string,
+) (container.ContainerCreateCreatedBody, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerCreate, containerName); err != nil {
+		return container.ContainerCreateCreatedBody{}, err
+	}
+	name := "/" + strings.TrimPrefix(containerName, "/")
+	if _, taken := c.find(name); taken {
+		return container.ContainerCreateCreatedBody{}, fmt.Errorf("conflict: the container name %s is already in use", name)
+	}
+	if config == nil {
+		config = &container.Config{}
+	}
+	if hostConfig == nil {
+		hostConfig = &container.HostConfig{}
+	}
+	if c.podman {
+		if err := podmanUnsupported(hostConfig); err != nil {
+			return container.ContainerCreateCreatedBody{}, err
+		}
+	}
+	configCopy := *config
+	configCopy.Labels = copyMap(config.Labels)
+	hostConfigCopy := *hostConfig
+
+	id := c.newID()
+	c.containers[id] = &types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         id,
+			Name:       name,
+			State:      &types.ContainerState{},
+			Image:      config.Image,
+			HostConfig: &hostConfigCopy,
+		},
+		Config: &configCopy,
+		NetworkSettings: &types.NetworkSettings{
+			Networks: make(map[string]*network.EndpointSettings),
+		},
+	}
+	return container.ContainerCreateCreatedBody{ID: id}, nil
+}
+
+// ContainerRemove removes a container, running containers are only removed if forced
+func (c *Client) ContainerRemove(_ context.Context, containerID string, options types.ContainerRemoveOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerRemove, containerID); err != nil {
+		return err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return NotFound(containerID)
+	}
+	if json.State.Running && !options.Force {
+		return fmt.Errorf("conflict: you cannot remove a running container %s", containerID)
+	}
+	if c.podman {
+		for _, other := range c.containers {
+			if other.HostConfig.NetworkMode == container.NetworkMode("container:"+json.ID) {
+				return fmt.Errorf("container %s is the infra container of a pod and cannot be removed", containerID)
+			}
+		}
+	}
+	delete(c.containers, json.ID)
+	return nil
+}
+
+// ContainerRename renames a container, the new name has to be unused
+func (c *Client) ContainerRename(_ context.Context, containerID, newContainerName string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerRename, containerID, newContainerName); err != nil {
+		return err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return NotFound(containerID)
+	}
+	name := "/" + strings.TrimPrefix(newContainerName, "/")
+	if other, taken := c.find(name); taken && other.ID != json.ID {
+		return fmt.Errorf("conflict: the container name %s is already in use by %s", name, other.ID)
+	}
+	json.Name = name
+	return nil
+}
+
+// ContainerList lists running containers, or all containers if options.All is set
+func (c *Client) ContainerList(_ context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerList); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(c.containers))
+	for id := range c.containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var list []types.Container
+	for _, id := range ids {
+		json := c.containers[id]
+		if !json.State.Running && !options.All {
+			continue
+		}
+		state := "exited"
+		if json.State.Running {
+			state = "running"
+		}
+		summary := types.Container{
+			ID:     json.ID,
+			Names:  []string{json.Name},
+			Image:  json.Config.Image,
+			Labels: copyMap(json.Config.Labels),
+			State:  state,
+		}
+		summary.HostConfig.NetworkMode = string(json.HostConfig.NetworkMode)
+		list = append(list, summary)
+	}
+	return list, nil
+}
+
+// ContainerInspect returns a copy of the container
+func (c *Client) ContainerInspect(_ context.Context, containerID string) (types.ContainerJSON, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerInspect, containerID); err != nil {
+		return types.ContainerJSON{}, err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return types.ContainerJSON{}, NotFound(containerID)
+	}
+	return copyContainer(json), nil
+}
+
+// ContainerStart marks a container as running
+func (c *Client) ContainerStart(_ context.Context, containerID string, _ types.ContainerStartOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerStart, containerID); err != nil {
+		return err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return NotFound(containerID)
+	}
+	json.State.Running = true
+	if json.Config.Healthcheck != nil {
+		json.State.Health = &types.Health{Status: types.Starting}
+	}
+	if c.onStart != nil {
+		c.onStart(json)
+	}
+	return nil
+}
+
+// ContainerStop marks a container as stopped
+func (c *Client) ContainerStop(_ context.Context, containerID string, _ *time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodContainerStop, containerID); err != nil {
+		return err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return NotFound(containerID)
+	}
+	json.State.Running = false
+	return nil
+}
+
+// NetworkConnect connects a container to a known network
+func (c *Client) NetworkConnect(
+	_ context.Context,
+	networkID, containerID string,
+	config *network.EndpointSettings,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodNetworkConnect, networkID, containerID); err != nil {
+		return err
+	}
+	json, ok := c.find(containerID)
+	if !ok {
+		return NotFound(containerID)
+	}
+	name, ok := c.networks[networkID]
+	if !ok {
+		return fmt.Errorf("network %s not found", networkID)
+	}
+	if c.podman && json.HostConfig.NetworkMode.IsContainer() {
+		return fmt.Errorf("container %s shares the network namespace of another container", containerID)
+	}
+	if _, connected := json.NetworkSettings.Networks[name]; connected {
+		return fmt.Errorf("container %s is already connected to network %s", containerID, name)
+	}
+	endpoint := network.EndpointSettings{}
+	if config != nil {
+		endpoint = *config
+	}
+	endpoint.NetworkID = networkID
+	json.NetworkSettings.Networks[name] = &endpoint
+	return nil
+}
+
+// ServiceInspectWithRaw returns a copy of the swarm service
+func (c *Client) ServiceInspectWithRaw(_ context.Context, serviceID string) (swarm.Service, []byte, error) {
+	c.mu.Lock()
+	if err := c.record(MethodServiceInspect, serviceID); err != nil {
+		c.mu.Unlock()
+		return swarm.Service{}, nil, err
+	}
+	c.mu.Unlock()
+	service, ok := c.Service(serviceID)
+	if !ok {
+		return swarm.Service{}, nil, fmt.Errorf("no such service: %s", serviceID)
+	}
+	return service, nil, nil
+}
+
+// ServiceUpdate replaces the spec of the swarm service, the version has to be the current one
+func (c *Client) ServiceUpdate(
+	_ context.Context,
+	serviceID string,
+	version swarm.Version,
+	spec swarm.ServiceSpec,
+	_ types.ServiceUpdateOptions,
+) (types.ServiceUpdateResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.record(MethodServiceUpdate, serviceID); err != nil {
+		return types.ServiceUpdateResponse{}, err
+	}
+	service, ok := c.services[serviceID]
+	if !ok {
+		return types.ServiceUpdateResponse{}, fmt.Errorf("no such service: %s", serviceID)
+	}
+	if version.Index != service.Version.Index {
+		return types.ServiceUpdateResponse{}, fmt.Errorf("update out of sequence for service %s", serviceID)
+	}
+	service.Spec = spec
+	service.Spec.TaskTemplate.ContainerSpec.Labels = copyMap(spec.TaskTemplate.ContainerSpec.Labels)
+	service.Version.Index++
+	return types.ServiceUpdateResponse{}, nil
+}
+
+// record saves the call and returns the next injected failure for the method, if any
+//
+// Has to be called with the lock held
+func (c *Client) record(method string, args ...string) error {
+	c.calls = append(c.calls, Call{Method: method, Args: args})
+	failures := c.failures[method]
+	if len(failures) == 0 {
+		return nil
+	}
+	c.failures[method] = failures[1:]
+	return failures[0]
+}
+
+// find looks up a container by id or name
+//
+// Has to be called with the lock held
+func (c *Client) find(nameOrID string) (*types.ContainerJSON, bool) {
+	if json, ok := c.containers[nameOrID]; ok {
+		return json, true
+	}
+	name := "/" + strings.TrimPrefix(nameOrID, "/")
+	for _, json := range c.containers {
+		if json.Name == name {
+			return json, true
+		}
+	}
+	return nil, false
+}
+
+// newID returns an unused container id
+//
+// Has to be called with the lock held
+func (c *Client) newID() string {
+	c.nextID++
+	return fmt.Sprintf("%012d", c.nextID)
+}
+
+// podmanUnsupported returns an error for host config fields podman doesn't support
+func podmanUnsupported(hostConfig *container.HostConfig) error {
+	unsupported := []struct {
+		field string
+		set   bool
+	}{
+		{"KernelMemory", hostConfig.KernelMemory != 0},
+		{"CPURealtimePeriod", hostConfig.CPURealtimePeriod != 0},
+		{"CPURealtimeRuntime", hostConfig.CPURealtimeRuntime != 0},
+		{"VolumeDriver", hostConfig.VolumeDriver != ""},
+		{"Runtime", hostConfig.Runtime != ""},
+		{"Isolation", hostConfig.Isolation != ""},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			return fmt.Errorf("%s is not supported by podman", u.field)
+		}
+	}
+	return nil
+}
+
+// NotFound returns the error of a missing container, ex. to inject a container removed by someone else with Fail
+func NotFound(containerID string) error {
+	return notFoundError(containerID)
+}
+
+// notFoundError is recognized as a missing container by client.IsErrNotFound, like the errors of the docker client
+type notFoundError string
+
+func (e notFoundError) Error() string {
+	return fmt.Sprintf("no such container: %s", string(e))
+}
+
+// NotFound marks the error as a missing container
+func (e notFoundError) NotFound() bool {
+	return true
+}
+
+func copyContainer(json *types.ContainerJSON) types.ContainerJSON {
+	base := *json.ContainerJSONBase
+	state := *json.State
+	if json.State.Health != nil {
+		health := *json.State.Health
+		state.Health = &health
+	}
+	base.State = &state
+	hostConfig := *json.HostConfig
+	base.HostConfig = &hostConfig
+
+	config := *json.Config
+	config.Labels = copyMap(json.Config.Labels)
+	config.Env = append([]string{}, json.Config.Env...)
+
+	networks := make(map[string]*network.EndpointSettings, len(json.NetworkSettings.Networks))
+	for name, endpoint := range json.NetworkSettings.Networks {
+		endpointCopy := *endpoint
+		networks[name] = &endpointCopy
+	}
+	return types.ContainerJSON{
+		ContainerJSONBase: &base,
+		Mounts:            append([]types.MountPoint{}, json.Mounts...),
+		Config:            &config,
+		NetworkSettings:   &types.NetworkSettings{Networks: networks},
+	}
+}
+
+func copyMap(original map[string]string) map[string]string {
+	if original == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(original))
+	for key, value := range original {
+		copied[key] = value
+	}
+	return copied
+}
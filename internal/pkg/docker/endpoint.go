@@ -0,0 +1,189 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/go-connections/sockets"
+	"github.com/docker/go-connections/tlsconfig"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// DefaultHost is the name of the docker host configured by the environment
+const DefaultHost = "local"
+
+// Endpoint describes how to connect to a docker host
+type Endpoint struct {
+	// Name is the name of the host in logs and template data
+	Name string `yaml:"name"`
+	// Address is the docker host, ex. "unix:///var/run/docker.sock" or "tcp://10.0.0.2:2376"
+	Address string `yaml:"address"`
+	// Version is the api version to use, defaults to the version of the client
+	Version string `yaml:"version"`
+	// Backend is the engine serving the docker api, BackendDocker or BackendPodman, detected if empty
+	Backend string       `yaml:"backend"`
+	TLS     *EndpointTLS `yaml:"tls"`
+}
+
+// EndpointTLS holds the paths of the certificates used to connect to a docker host over tls
+type EndpointTLS struct {
+	CA   string `yaml:"ca"`
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// InsecureSkipVerify disables verification of the certificate of the host
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+// LoadEndpointsFromPath loads a list of endpoints from a yaml file on the form
+//
+//   - name: prod
+//     address: tcp://10.0.0.2:2376
+//     tls: {ca: /certs/ca.pem, cert: /certs/cert.pem, key: /certs/key.pem}
+//
+// Names have to be unique
+func LoadEndpointsFromPath(_ context.Context, filePath string) ([]Endpoint, error) {
+	content, err := ioutil.ReadFile(filePath) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read hosts file %s", filePath)
+	}
+	var endpoints []Endpoint
+	if err := yaml.UnmarshalStrict(content, &endpoints); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse hosts file %s", filePath)
+	}
+	names := make(map[string]bool, len(endpoints))
+	for _, endpoint := range endpoints {
+		if endpoint.Name == "" || endpoint.Address == "" {
+			return nil, fmt.Errorf("hosts in %s need both a name and an address", filePath)
+		}
+		if endpoint.Backend != "" && endpoint.Backend != BackendDocker && endpoint.Backend != BackendPodman {
+			return nil, fmt.Errorf("unknown backend %s of host %s", endpoint.Backend, endpoint.Name)
+		}
+		if names[endpoint.Name] {
+			return nil, fmt.Errorf("host %s is defined more than once in %s", endpoint.Name, filePath)
+		}
+		names[endpoint.Name] = true
+	}
+	return endpoints, nil
+}
+
+// EnvEndpoint describes the docker host configured by the environment,
+// through DOCKER_HOST, DOCKER_API_VERSION, DOCKER_CERT_PATH and DOCKER_TLS_VERIFY
+func EnvEndpoint() Endpoint {
+	endpoint := Endpoint{
+		Name:    DefaultHost,
+		Address: os.Getenv("DOCKER_HOST"),
+		Version: os.Getenv("DOCKER_API_VERSION"),
+	}
+	if endpoint.Address == "" {
+		endpoint.Address = client.DefaultDockerHost
+	}
+	if certPath := os.Getenv("DOCKER_CERT_PATH"); certPath != "" {
+		endpoint.TLS = &EndpointTLS{
+			CA:                 filepath.Join(certPath, "ca.pem"),
+			Cert:               filepath.Join(certPath, "cert.pem"),
+			Key:                filepath.Join(certPath, "key.pem"),
+			InsecureSkipVerify: os.Getenv("DOCKER_TLS_VERIFY") == "",
+		}
+	}
+	return endpoint
+}
+
+// EndpointClient is a docker client connected to an endpoint
+type EndpointClient struct {
+	*client.Client
+	http *http.Client
+	// url is the base url of the api
+	url string
+}
+
+// NewEndpointClient creates a docker client connecting to the endpoint
+func NewEndpointClient(_ context.Context, endpoint Endpoint) (*EndpointClient, error) {
+	proto, addr, basePath, err := client.ParseHost(endpoint.Address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid address of host %s", endpoint.Name)
+	}
+	transport := &http.Transport{}
+	scheme := "http"
+	if endpoint.TLS != nil {
+		transport.TLSClientConfig, err = tlsconfig.Client(tlsconfig.Options{
+			CAFile:             endpoint.TLS.CA,
+			CertFile:           endpoint.TLS.Cert,
+			KeyFile:            endpoint.TLS.Key,
+			InsecureSkipVerify: endpoint.TLS.InsecureSkipVerify,
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load tls configuration of host %s", endpoint.Name)
+		}
+		scheme = "https"
+	}
+	err = sockets.ConfigureTransport(transport, proto, addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to configure connection to host %s", endpoint.Name)
+	}
+	httpClient := &http.Client{Transport: transport}
+
+	version := endpoint.Version
+	if version == "" {
+		version = client.DefaultVersion
+	}
+	dockerClient, err := client.NewClient(endpoint.Address, version, httpClient, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create docker client for host %s", endpoint.Name)
+	}
+	if proto != "tcp" {
+		// Requests over sockets are dialed by the transport, the host of the url isn't used
+		addr = proto
+	}
+	return &EndpointClient{
+		Client: dockerClient,
+		http:   httpClient,
+		url:    scheme + "://" + addr + basePath,
+	}, nil
+}
+
+// engineVersion is the part of the response of /version describing the engine
+//
+// The components aren't part of types.Version in the docker api version used by the client
+type engineVersion struct {
+	Version    string
+	Components []struct {
+		Name    string
+		Version string
+	}
+}
+
+// DetectBackend asks the endpoint for its version and returns the backend serving the docker api,
+// BackendPodman if any component of the engine is podman and otherwise BackendDocker
+func (c *EndpointClient) DetectBackend(ctx context.Context) (string, error) {
+	request, err := http.NewRequest(http.MethodGet, c.url+"/version", nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create version request")
+	}
+	response, err := c.http.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to request version")
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("version request failed with status %s", response.Status)
+	}
+	var version engineVersion
+	err = json.NewDecoder(response.Body).Decode(&version)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to decode version")
+	}
+	for _, component := range version.Components {
+		if strings.Contains(strings.ToLower(component.Name), BackendPodman) {
+			return BackendPodman, nil
+		}
+	}
+	return BackendDocker, nil
+}
@@ -0,0 +1,192 @@
+package docker_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+func TestLoadEndpointsFromPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []docker.Endpoint
+		wantErr bool
+	}{
+		{
+			name: "hosts",
+			content: `
+- name: local
+  address: unix:///var/run/docker.sock
+- name: prod
+  address: tcp://10.0.0.2:2376
+  tls: {ca: /certs/ca.pem, cert: /certs/cert.pem, key: /certs/key.pem}
+`,
+			want: []docker.Endpoint{
+				{Name: "local", Address: "unix:///var/run/docker.sock"},
+				{
+					Name:    "prod",
+					Address: "tcp://10.0.0.2:2376",
+					TLS:     &docker.EndpointTLS{CA: "/certs/ca.pem", Cert: "/certs/cert.pem", Key: "/certs/key.pem"},
+				},
+			},
+		},
+		{
+			name:    "duplicate name",
+			content: "- {name: a, address: tcp://a:2375}\n- {name: a, address: tcp://b:2375}",
+			wantErr: true,
+		},
+		{
+			name:    "missing address",
+			content: "- {name: a}",
+			wantErr: true,
+		},
+		{
+			name:    "backend",
+			content: "- {name: a, address: tcp://a:2375, backend: podman}",
+			want:    []docker.Endpoint{{Name: "a", Address: "tcp://a:2375", Backend: docker.BackendPodman}},
+		},
+		{
+			name:    "unknown backend",
+			content: "- {name: a, address: tcp://a:2375, backend: containerd}",
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			content: "- {name: a, address: tcp://a:2375, port: 2375}",
+			wantErr: true,
+		},
+	}
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "hosts.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+			got, err := docker.LoadEndpointsFromPath(context.Background(), path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadEndpointsFromPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadEndpointsFromPath() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewEndpointClient(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint docker.Endpoint
+		wantErr  bool
+	}{
+		{
+			name:     "unix",
+			endpoint: docker.Endpoint{Name: "local", Address: "unix:///var/run/docker.sock"},
+		},
+		{
+			name:     "tcp",
+			endpoint: docker.Endpoint{Name: "remote", Address: "tcp://10.0.0.2:2375", Version: "1.25"},
+		},
+		{
+			name: "missing certificates",
+			endpoint: docker.Endpoint{
+				Name:    "remote",
+				Address: "tcp://10.0.0.2:2376",
+				TLS:     &docker.EndpointTLS{CA: "/missing/ca.pem", Cert: "/missing/cert.pem", Key: "/missing/key.pem"},
+			},
+			wantErr: true,
+		},
+		{
+			name:     "invalid address",
+			endpoint: docker.Endpoint{Name: "broken", Address: "10.0.0.2"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := docker.NewEndpointClient(context.Background(), tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewEndpointClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEndpointClient_DetectBackend(t *testing.T) {
+	tests := []struct {
+		name    string
+		version string
+		status  int
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "docker",
+			version: `{"Version":"19.03.8","Components":[{"Name":"Engine","Version":"19.03.8"}]}`,
+			want:    docker.BackendDocker,
+		},
+		{
+			name:    "docker without components",
+			version: `{"Version":"1.13.1"}`,
+			want:    docker.BackendDocker,
+		},
+		{
+			name:    "podman",
+			version: `{"Version":"3.4.2","Components":[{"Name":"Podman Engine","Version":"3.4.2"}]}`,
+			want:    docker.BackendPodman,
+		},
+		{
+			name:    "failing",
+			status:  http.StatusInternalServerError,
+			wantErr: true,
+		},
+		{
+			name:    "invalid",
+			version: "not json",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/version" {
+					http.NotFound(w, r)
+					return
+				}
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				fmt.Fprint(w, tt.version)
+			}))
+			defer server.Close()
+			endpoint := docker.Endpoint{Name: "test", Address: "tcp://" + strings.TrimPrefix(server.URL, "http://")}
+			dockerClient, err := docker.NewEndpointClient(context.Background(), endpoint)
+			if err != nil {
+				t.Fatalf("NewEndpointClient() error = %v", err)
+			}
+			got, err := dockerClient.DetectBackend(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DetectBackend() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DetectBackend() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/tracing"
+)
+
+// HealthCheckOptions configures how a new container is verified before the old one is removed
+type HealthCheckOptions struct {
+	// Timeout is how long to wait for a container with a health check to become healthy, disabled if 0
+	Timeout time.Duration
+	// MinUptime is how long a container without a health check has to stay running, disabled if 0
+	MinUptime time.Duration
+	// Interval is how often the container is inspected while waiting, defaults to one second
+	Interval time.Duration
+}
+
+// waitUntilHealthy waits for a started container to prove that it works
+//
+// A container with a health check has to become healthy within the timeout,
+// other containers have to stay running for the minimum uptime
+func (s *Service) waitUntilHealthy(ctx context.Context, containerID string) error {
+	options := s.options.HealthCheck
+	if options.Timeout <= 0 && options.MinUptime <= 0 {
+		return nil
+	}
+	ctx, span := tracing.Start(ctx, "healthCheck", "containerId", containerID)
+	err := s.checkHealth(ctx, containerID, options)
+	span.End(err)
+	return err
+}
+
+// checkHealth waits for the container to become healthy or stay running according to the options
+func (s *Service) checkHealth(ctx context.Context, containerID string, options HealthCheckOptions) error {
+	interval := options.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	container, err := s.dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return errors.Wrapf(err, "inspection failed for container with id: %s", containerID)
+	}
+	if container.State.Health != nil && options.Timeout > 0 {
+		logrus.WithContext(ctx).Debugf("Waiting up to %s for container %s to become healthy", options.Timeout, containerID)
+		return s.poll(ctx, containerID, options.Timeout, interval, func(state *types.ContainerState) (bool, error) {
+			if !state.Running {
+				return false, fmt.Errorf("container %s stopped before becoming healthy", containerID)
+			}
+			switch state.Health.Status {
+			case types.Healthy:
+				return true, nil
+			case types.Unhealthy:
+				return false, fmt.Errorf("container %s is unhealthy", containerID)
+			}
+			return false, nil
+		}, fmt.Errorf("container %s did not become healthy within %s", containerID, options.Timeout))
+	}
+	if options.MinUptime > 0 {
+		logrus.WithContext(ctx).Debugf("Making sure container %s stays running for %s", containerID, options.MinUptime)
+		return s.poll(ctx, containerID, options.MinUptime, interval, func(state *types.ContainerState) (bool, error) {
+			if !state.Running || state.Restarting {
+				return false, fmt.Errorf("container %s stopped within %s of starting", containerID, options.MinUptime)
+			}
+			return false, nil
+		}, nil)
+	}
+	return nil
+}
+
+// poll inspects the container every interval until check is done, fails or the duration has passed
+//
+// Returns timeoutErr if the duration passes before check is done
+func (s *Service) poll(
+	ctx context.Context,
+	containerID string,
+	duration, interval time.Duration,
+	check func(state *types.ContainerState) (bool, error),
+	timeoutErr error,
+) error {
+	deadline := time.Now().Add(duration)
+	for {
+		container, err := s.dockerClient.ContainerInspect(ctx, containerID)
+		if err != nil {
+			return errors.Wrapf(err, "inspection failed for container with id: %s", containerID)
+		}
+		done, err := check(container.State)
+		if err != nil || done {
+			return err
+		}
+		if !time.Now().Before(deadline) {
+			return timeoutErr
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package docker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+func TestService_SetLabels_healthCheck(t *testing.T) {
+	healthcheck := &container.HealthConfig{Test: []string{"CMD", "true"}}
+	tests := []struct {
+		name        string
+		healthcheck *container.HealthConfig
+		// onNewStart changes the state of the new container when started
+		onNewStart  func(state *types.ContainerState)
+		wantOutcome audit.Outcome
+	}{
+		{
+			name:        "becomes healthy",
+			healthcheck: healthcheck,
+			onNewStart: func(state *types.ContainerState) {
+				state.Health.Status = types.Healthy
+			},
+			wantOutcome: audit.OutcomeSuccess,
+		},
+		{
+			name:        "becomes unhealthy",
+			healthcheck: healthcheck,
+			onNewStart: func(state *types.ContainerState) {
+				state.Health.Status = types.Unhealthy
+			},
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+		{
+			name:        "never becomes healthy",
+			healthcheck: healthcheck,
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+		{
+			name:        "stays running",
+			wantOutcome: audit.OutcomeSuccess,
+		},
+		{
+			name: "crashes",
+			onNewStart: func(state *types.ContainerState) {
+				state.Running = false
+			},
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := dockertest.NewClient()
+			id := client.AddContainer(dockertest.Container{
+				Name:        "web",
+				Labels:      map[string]string{"old": "label"},
+				Running:     true,
+				Healthcheck: tt.healthcheck,
+			})
+			client.OnStart(func(c *types.ContainerJSON) {
+				if tt.onNewStart != nil && c.ID != id {
+					tt.onNewStart(c.State)
+				}
+			})
+			auditLog := &memoryAuditLog{}
+			service, _ := docker.NewService(ctx, client, docker.ServiceOptions{
+				AuditLog: auditLog,
+				HealthCheck: docker.HealthCheckOptions{
+					Timeout:   20 * time.Millisecond,
+					MinUptime: 20 * time.Millisecond,
+					Interval:  5 * time.Millisecond,
+				},
+			})
+
+			err := service.SetLabels(ctx, id, "instruction()", map[string]string{"new": "label"})
+			if (err != nil) != (tt.wantOutcome != audit.OutcomeSuccess) {
+				t.Errorf("SetLabels() error = %v, want outcome %v", err, tt.wantOutcome)
+			}
+			if got := (*auditLog)[0].Outcome; got != tt.wantOutcome {
+				t.Errorf("outcome = %v, want %v", got, tt.wantOutcome)
+			}
+			web, _ := client.Container("web")
+			wantLabels := map[string]string{"new": "label"}
+			if tt.wantOutcome != audit.OutcomeSuccess {
+				wantLabels = map[string]string{"old": "label"}
+				if web.ID != id {
+					t.Errorf("container web has id %s, want the old container %s", web.ID, id)
+				}
+			}
+			if !reflect.DeepEqual(web.Config.Labels, wantLabels) || !web.State.Running {
+				t.Errorf("container web = %v, running %v, want %v and running", web.Config.Labels, web.State.Running, wantLabels)
+			}
+			if names := client.Names(); len(names) != 1 {
+				t.Errorf("container names = %v, want only web", names)
+			}
+		})
+	}
+}
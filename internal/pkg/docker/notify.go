@@ -0,0 +1,64 @@
+package docker
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/docker/docker/api/types"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// notifyUpdater leaves the container untouched and only reports the labels that would have been set
+//
+// Every change is only reported once per container, until the labels change again
+type notifyUpdater struct {
+	mu sync.Mutex
+	// notified holds the labels last reported for each container id
+	notified map[string]map[string]string
+}
+
+func (*notifyUpdater) Name() string {
+	return StrategyNotify
+}
+
+func (*notifyUpdater) Replaces() bool {
+	return false
+}
+
+func (*notifyUpdater) Check(types.ContainerJSON) error {
+	return nil
+}
+
+// Applied reports if the labels were already reported for the container
+func (u *notifyUpdater) Applied(
+	_ context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+) (bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	notified, ok := u.notified[container.ID]
+	return ok && reflect.DeepEqual(notified, labels), nil
+}
+
+// UpdateLabels logs the label changes and records them in the entry as notified
+func (u *notifyUpdater) UpdateLabels(
+	ctx context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+	entry *audit.Entry,
+) (string, error) {
+	logrus.WithContext(ctx).Infof(
+		"Container %s (%s) would have its labels changed: %s",
+		container.Name, container.ID, strings.Join(entry.Diff.Keys(), ", "),
+	)
+	u.mu.Lock()
+	u.notified[container.ID] = labels
+	u.mu.Unlock()
+	entry.Outcome = audit.OutcomeNotified
+	return "", nil
+}
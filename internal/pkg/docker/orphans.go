@@ -0,0 +1,30 @@
+package docker
+
+import (
+	"context"
+)
+
+// Suffixes of the names containers get while they are replaced
+const (
+	oldSuffix = "-old"
+	newSuffix = "-new"
+)
+
+// Orphans returns the containers left behind by updates that could neither be completed nor rolled back
+//
+// Names maps the ids of the containers updates replaced or created to the names they should have,
+// ex. a replaced container renamed to "web-old" or a new container still named "web-new" instead of "web".
+// Containers are never recognized by their names alone, since the names can be chosen by users as well.
+func (s *Service) Orphans(ctx context.Context, names map[string]string) ([]Container, error) {
+	containers, err := s.GetContainers(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Container
+	for _, container := range containers {
+		if name, ok := names[container.ID]; ok && name != container.Name {
+			orphans = append(orphans, container)
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,63 @@
+package docker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+func TestService_Orphans(t *testing.T) {
+	const strategyLabel = "strategy"
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	// Containers of users that happen to have the names of temporary containers
+	client.AddContainer(dockertest.Container{Name: "api-old", Running: true})
+	client.AddContainer(dockertest.Container{Name: "api-new", Running: true})
+	dbID := client.AddContainer(dockertest.Container{Name: "db", Running: true})
+	webID := client.AddContainer(dockertest.Container{
+		Name:    "web",
+		Running: true,
+		Labels:  map[string]string{strategyLabel: docker.StrategyBlueGreen},
+	})
+	workerID := client.AddContainer(dockertest.Container{Name: "worker", Running: true})
+	service, _ := docker.NewService(ctx, client, docker.ServiceOptions{StrategyLabel: strategyLabel})
+
+	// The new container can't be removed when the old one can't be stopped
+	client.Fail(dockertest.MethodContainerStop, errInjected)
+	client.Fail(dockertest.MethodContainerRemove, errInjected)
+	labels := map[string]string{strategyLabel: docker.StrategyBlueGreen, "new": "label"}
+	update, err := service.PrepareUpdate(ctx, webID)
+	if err != nil {
+		t.Fatalf("PrepareUpdate() error = %v", err)
+	}
+	newID, err := service.ApplyUpdate(ctx, update, "instruction()", labels)
+	if err == nil || newID == "" {
+		t.Fatalf("ApplyUpdate() = %s, %v, want the id of the new container and the injected error", newID, err)
+	}
+	// The old container can't get its name back when the new one can't be created
+	client.Fail(dockertest.MethodContainerCreate, errInjected)
+	client.Fail(dockertest.MethodContainerRename, nil, errInjected)
+	if err := service.SetLabels(ctx, workerID, "instruction()", labels); err == nil {
+		t.Fatalf("SetLabels() expected injected error")
+	}
+
+	orphans, err := service.Orphans(ctx, map[string]string{dbID: "/db", workerID: "/worker", newID: "/web"})
+	if err != nil {
+		t.Fatalf("Orphans() error = %v", err)
+	}
+	var names []string
+	for _, orphan := range orphans {
+		names = append(names, orphan.Name)
+	}
+	if want := []string{"/worker-old", "/web-new"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Orphans() = %v, want %v", names, want)
+	}
+
+	client.Fail(dockertest.MethodContainerList, errInjected)
+	if _, err := service.Orphans(ctx, nil); err == nil {
+		t.Errorf("Orphans() expected injected error")
+	}
+}
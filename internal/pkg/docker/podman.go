@@ -0,0 +1,78 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/pkg/errors"
+)
+
+// Backends serving the docker api
+const (
+	// BackendDocker is the docker daemon
+	BackendDocker = "docker"
+	// BackendPodman is the docker compatible api of podman
+	BackendPodman = "podman"
+)
+
+func validateBackend(backend string) error {
+	switch backend {
+	case BackendDocker, BackendPodman:
+		return nil
+	default:
+		return fmt.Errorf("unknown backend %s", backend)
+	}
+}
+
+// checkReplaceable makes sure the backend allows the container to be replaced
+//
+// Podman won't remove a container while other containers join its namespaces, ex. the infra container
+// of a pod with members, and a new infra container wouldn't be part of the pod
+func (s *Service) checkReplaceable(ctx context.Context, target types.ContainerJSON) error {
+	if s.options.Backend != BackendPodman {
+		return nil
+	}
+	containers, err := s.dockerClient.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return errors.Wrapf(err, "failed to list containers")
+	}
+	for _, c := range containers {
+		mode := container.NetworkMode(c.HostConfig.NetworkMode)
+		if c.ID == target.ID || !mode.IsContainer() {
+			continue
+		}
+		if matches, _ := refersTo(mode.ConnectedContainer(), target); matches {
+			return fmt.Errorf(
+				"refusing to replace container %s since other containers join its namespaces, ex. as the infra container of a pod",
+				target.Name,
+			)
+		}
+	}
+	return nil
+}
+
+// joinsNamespace reports whether the container shares the network namespace of another container,
+// ex. a member of a podman pod, and gets its networks from it
+func joinsNamespace(container types.ContainerJSON) bool {
+	return container.HostConfig != nil && container.HostConfig.NetworkMode.IsContainer()
+}
+
+// createHostConfig returns the host config to create a copy of the container with
+//
+// Podman rejects fields of the docker api it doesn't support, so they are cleared
+// on podman, where they never have an effect anyway
+func (s *Service) createHostConfig(hostConfig *container.HostConfig) *container.HostConfig {
+	if s.options.Backend != BackendPodman || hostConfig == nil {
+		return hostConfig
+	}
+	supported := *hostConfig
+	supported.KernelMemory = 0
+	supported.CPURealtimePeriod = 0
+	supported.CPURealtimeRuntime = 0
+	supported.VolumeDriver = ""
+	supported.Runtime = ""
+	supported.Isolation = ""
+	return &supported
+}
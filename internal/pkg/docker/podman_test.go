@@ -0,0 +1,147 @@
+package docker_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+// flavours are the backends the recreate path is tested against
+var flavours = []struct {
+	backend   string
+	newClient func() *dockertest.Client
+}{
+	{backend: docker.BackendDocker, newClient: dockertest.NewClient},
+	{backend: docker.BackendPodman, newClient: dockertest.NewPodmanClient},
+}
+
+func TestService_SetLabels_backends(t *testing.T) {
+	tests := []struct {
+		name string
+		// add adds the containers and returns the name of the container to update
+		add func(c *dockertest.Client) string
+		// check verifies the updated container
+		check func(t *testing.T, c *dockertest.Client, backend string, updated container.HostConfig)
+		// wantErr is the backends the update is expected to fail on
+		wantErr map[string]bool
+	}{
+		{
+			name: "container",
+			add: func(c *dockertest.Client) string {
+				c.AddContainer(dockertest.Container{
+					Name:     "web",
+					Running:  true,
+					Networks: map[string]string{"frontend": "net1"},
+				})
+				return "web"
+			},
+		},
+		{
+			name: "unsupported host config",
+			add: func(c *dockertest.Client) string {
+				hostConfig := &container.HostConfig{Runtime: "runc"}
+				hostConfig.KernelMemory = 1 << 20
+				c.AddContainer(dockertest.Container{Name: "web", Running: true, HostConfig: hostConfig})
+				return "web"
+			},
+			check: func(t *testing.T, _ *dockertest.Client, backend string, updated container.HostConfig) {
+				kept := updated.KernelMemory != 0 || updated.Runtime != ""
+				if kept != (backend == docker.BackendDocker) {
+					t.Errorf("kernel memory = %d, runtime = %q on %s", updated.KernelMemory, updated.Runtime, backend)
+				}
+			},
+		},
+		{
+			name: "pod member",
+			add: func(c *dockertest.Client) string {
+				c.AddPod("app", dockertest.Container{
+					Name:     "web",
+					Running:  true,
+					Networks: map[string]string{"podman": "net1"},
+				})
+				return "web"
+			},
+			check: func(t *testing.T, c *dockertest.Client, _ string, updated container.HostConfig) {
+				infra, _ := c.Container("app-infra")
+				if mode := updated.NetworkMode; !mode.IsContainer() || mode.ConnectedContainer() != infra.ID {
+					t.Errorf("network mode = %s, want the namespace of the infra container %s", mode, infra.ID)
+				}
+			},
+		},
+		{
+			name: "pod infra",
+			add: func(c *dockertest.Client) string {
+				c.AddPod("app", dockertest.Container{Name: "web", Running: true})
+				return "app-infra"
+			},
+			wantErr: map[string]bool{docker.BackendPodman: true},
+		},
+		{
+			name: "pod infra with custom name",
+			add: func(c *dockertest.Client) string {
+				infraID := c.AddContainer(dockertest.Container{Name: "holder", Running: true})
+				c.AddContainer(dockertest.Container{
+					Name:       "web",
+					Running:    true,
+					HostConfig: &container.HostConfig{NetworkMode: container.NetworkMode("container:" + infraID)},
+				})
+				return "holder"
+			},
+			wantErr: map[string]bool{docker.BackendPodman: true},
+		},
+		{
+			name: "infra suffix outside a pod",
+			add: func(c *dockertest.Client) string {
+				c.AddContainer(dockertest.Container{Name: "monitoring-infra", Running: true})
+				return "monitoring-infra"
+			},
+		},
+	}
+	for _, flavour := range flavours {
+		for _, tt := range tests {
+			t.Run(flavour.backend+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+				client := flavour.newClient()
+				name := tt.add(client)
+				old, _ := client.Container(name)
+				service, err := docker.NewService(ctx, client, docker.ServiceOptions{Backend: flavour.backend})
+				if err != nil {
+					t.Fatalf("NewService() error = %v", err)
+				}
+				err = service.SetLabels(ctx, old.ID, "", map[string]string{"new": "label"})
+				if (err != nil) != tt.wantErr[flavour.backend] {
+					t.Fatalf("SetLabels() error = %v, wantErr %v", err, tt.wantErr[flavour.backend])
+				}
+				updated, ok := client.Container(name)
+				if !ok {
+					t.Fatalf("container %s is missing, containers: %v", name, client.Names())
+				}
+				if err != nil {
+					if updated.ID != old.ID {
+						t.Errorf("container %s was replaced although the update failed", name)
+					}
+					return
+				}
+				if updated.Config.Labels["new"] != "label" || !updated.State.Running {
+					t.Errorf("container %s not updated, labels: %v", name, updated.Config.Labels)
+				}
+				if tt.check != nil {
+					tt.check(t, client, flavour.backend, *updated.HostConfig)
+				}
+			})
+		}
+	}
+}
+
+func TestNewService_backend(t *testing.T) {
+	_, err := docker.NewService(context.Background(), dockertest.NewClient(), docker.ServiceOptions{
+		Backend: "containerd",
+	})
+	if err == nil {
+		t.Errorf("NewService() expected error for unknown backend")
+	}
+}
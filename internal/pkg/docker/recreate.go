@@ -0,0 +1,92 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// recreateUpdater stops the old container before a new one is created with the labels
+type recreateUpdater struct {
+	s *Service
+}
+
+func (recreateUpdater) Name() string {
+	return StrategyRecreate
+}
+
+func (recreateUpdater) Replaces() bool {
+	return true
+}
+
+// Check makes sure the container isn't managed by an orchestrator that would replace it on its own
+func (recreateUpdater) Check(container types.ContainerJSON) error {
+	if _, ok := container.Config.Labels[swarmServiceLabel]; ok {
+		return fmt.Errorf("container is a task of a swarm service")
+	}
+	return nil
+}
+
+// UpdateLabels replaces the container with a new one with the specified labels
+//
+// If the new container can't be created, connected or started, or doesn't pass the health check,
+// the old container is restored.
+// Returns the id of the new container, rollbacks are recorded in the entry
+func (u recreateUpdater) UpdateLabels(
+	ctx context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+	entry *audit.Entry,
+) (string, error) {
+	s := u.s
+	containerID := container.ID
+	err := s.backup(ctx, container, entry)
+	if err != nil {
+		// Never destroy a container that can't be recovered
+		return "", err
+	}
+
+	logrus.WithContext(ctx).Debugf("Stopping container %s", containerID)
+	err = s.dockerClient.ContainerStop(ctx, containerID, &timeout)
+	if err != nil {
+		// TODO: should maybe be handled? what happens on timeout?
+		return "", errors.Wrapf(err, "failed to stop container %s", containerID)
+	}
+
+	newName := container.Name + oldSuffix
+	logrus.WithContext(ctx).Debugf("Changing name of container %s from %s to %s", containerID, container.Name, newName)
+	err = s.dockerClient.ContainerRename(ctx, containerID, newName)
+	if err != nil {
+		// TODO: retry mechanism
+		err = errors.Wrapf(err, "failed to rename container %s from %s to %s", containerID, container.Name, newName)
+		return "", s.rollback(ctx, container, "", false, err, entry)
+	}
+
+	newID, err := s.createReplacement(ctx, container, container.Name, labels)
+	if err != nil {
+		return newID, s.rollback(ctx, container, newID, true, err, entry)
+	}
+
+	if container.State.Running {
+		err = s.waitUntilHealthy(ctx, newID)
+		if err != nil {
+			return newID, s.rollback(ctx, container, newID, true, err, entry)
+		}
+	}
+
+	logrus.WithContext(ctx).Debugf("Removing old container with name: %s and id: %s", container.Name, containerID)
+	err = s.dockerClient.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
+		RemoveVolumes: false,
+		RemoveLinks:   false,
+		Force:         false,
+	})
+	if err != nil {
+		return newID, errors.Wrapf(err, "failed to remove old container (%s) with name: %s", containerID, newName)
+	}
+	return newID, nil
+}
@@ -2,6 +2,8 @@ package docker
 
 import (
 	"context"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -10,22 +12,95 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/client"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/logging"
+	"sidus.io/discriminator/internal/pkg/tracing"
 )
 
 var timeout = 30 * time.Second
 
+// AuditLog records container recreations
+type AuditLog interface {
+	Append(entry audit.Entry) error
+}
+
+// Backups stores inspected containers before they are recreated
+type Backups interface {
+	Save(ctx context.Context, container types.ContainerJSON) (string, error)
+}
+
+// ServiceOptions configures the optional parts of a Service
+type ServiceOptions struct {
+	// Host is the name of the docker host, defaults to DefaultHost
+	Host string
+	// AuditLog records every container recreation, if set
+	AuditLog AuditLog
+	// Backups stores every container before it is recreated, if set
+	Backups Backups
+	// HealthCheck configures how new containers are verified before the old ones are removed
+	HealthCheck HealthCheckOptions
+	// StrategyLabel is the label containers use to choose update strategy, ex. StrategyBlueGreen
+	StrategyLabel string
+	// StrategySelectors choose update strategy for containers without the strategy label, first match wins
+	StrategySelectors []StrategySelector
+	// DefaultStrategy is used for containers not selecting a strategy, defaults to StrategyRecreate
+	DefaultStrategy string
+	// SwarmClient enables updates of swarm services through StrategySwarm, if set
+	SwarmClient SwarmClient
+	// Updaters are additional update strategies
+	Updaters []LabelUpdater
+	// Dependents is the policy for containers depending on a replaced container, defaults to DependentsRecreate
+	Dependents string
+	// Backend is the engine serving the docker api, defaults to BackendDocker
+	Backend string
+}
+
 type Service struct {
 	dockerClient Client
+	options      ServiceOptions
+	updaters     map[string]LabelUpdater
 }
 
 // NewService creates a dervice to be used for docker communication
-func NewService(_ context.Context, dockerClient Client) (*Service, error) {
+func NewService(_ context.Context, dockerClient Client, options ServiceOptions) (*Service, error) {
 	c := Service{
-		dockerClient: dockerClient,
+		dockerClient: tracedClient{dockerClient},
+		options:      options,
+	}
+	if c.options.Host == "" {
+		c.options.Host = DefaultHost
+	}
+	if c.options.DefaultStrategy == "" {
+		c.options.DefaultStrategy = StrategyRecreate
+	}
+	if c.options.Dependents == "" {
+		c.options.Dependents = DependentsRecreate
+	}
+	if c.options.Backend == "" {
+		c.options.Backend = BackendDocker
+	}
+	err := validateDependentsPolicy(c.options.Dependents)
+	if err != nil {
+		return nil, err
+	}
+	err = validateBackend(c.options.Backend)
+	if err != nil {
+		return nil, err
+	}
+	err = c.registerUpdaters()
+	if err != nil {
+		return nil, err
 	}
 	return &c, nil
 }
 
+// Host returns the name of the docker host
+func (s *Service) Host() string {
+	return s.options.Host
+}
+
 func (s *Service) Close() error {
 	return s.dockerClient.Close()
 }
@@ -41,6 +116,7 @@ func (s *Service) GetContainers(ctx context.Context, includeStopped bool) ([]Con
 	containers := make([]Container, len(dockerContainers))
 	for i, dockerContainer := range dockerContainers {
 		containers[i] = Container{
+			Host:   s.options.Host,
 			Name:   firstOrEmpty(dockerContainer.Names),
 			ID:     dockerContainer.ID,
 			Labels: dockerContainer.Labels,
@@ -49,58 +125,231 @@ func (s *Service) GetContainers(ctx context.Context, includeStopped bool) ([]Con
 	return containers, nil
 }
 
-// SetLabels removes the old container and creat a new, identical one with the specified labels.
+// GetEnv retrieves the environment variables of a container
 //
-// New container will not have the same id
-func (s *Service) SetLabels(ctx context.Context, containerID string, labels map[string]string) error {
-	ctx = context.WithValue(ctx, "containerID", containerID)
-	ctx = context.WithValue(ctx, "newContainerLabels", labels)
-
-	logrus.WithContext(ctx).Debugf("Inspecting container %s", containerID)
+// A container removed since it was listed has no environment variables
+func (s *Service) GetEnv(ctx context.Context, containerID string) ([]string, error) {
 	container, err := s.dockerClient.ContainerInspect(ctx, containerID)
+	if client.IsErrNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "inspection failed for container with id: %s", containerID)
+	}
+	if container.Config == nil {
+		return nil, nil
+	}
+	return container.Config.Env, nil
+}
+
+// SetLabels applies the labels to the container with the update strategy selected for it.
+//
+// Labels can't be changed on an existing container, so most strategies replace the container
+// with a new, identical one with the specified labels, and the new container will not have the same id.
+// The instruction that resulted in the labels is only used for the audit log.
+func (s *Service) SetLabels(ctx context.Context, containerID, instruction string, labels map[string]string) error {
+	update, err := s.PrepareUpdate(ctx, containerID)
+	if err != nil {
+		return err
+	}
+	_, err = s.ApplyUpdate(ctx, update, instruction, labels)
+	return err
+}
+
+// ApplyUpdate applies the labels to the container of the update and returns the id of the new container, if any.
+//
+// The id of the new container is also returned on errors, if the new container couldn't be removed
+// The instruction that resulted in the labels is only used for the audit log.
+func (s *Service) ApplyUpdate(
+	ctx context.Context,
+	update Update,
+	instruction string,
+	labels map[string]string,
+) (string, error) {
+	container := update.container
+	ctx = logging.With(ctx, logging.FieldContainerID, container.ID)
+	ctx = logging.With(ctx, logging.FieldContainerName, strings.TrimPrefix(container.Name, "/"))
+	ctx, span := tracing.Start(ctx, "update", "containerId", container.ID, "strategy", update.Strategy())
+	logrus.WithContext(ctx).Debugf("Changing labels from %+v to %+v", container.Config.Labels, labels)
+	newID, err := s.update(ctx, container, instruction, labels, update.updater, nil)
+	span.End(err)
+	return newID, err
+}
+
+// update applies the labels to the inspected container with the update strategy and records it in the audit log.
+//
+// Strategies that leave the container untouched skip labels they already applied.
+// Containers depending on the container are handled according to the dependents policy
+// if the strategy replaces the container. They are found among the inspected containers,
+// which are inspected first if nil.
+func (s *Service) update(
+	ctx context.Context,
+	container types.ContainerJSON,
+	instruction string,
+	labels map[string]string,
+	updater LabelUpdater,
+	containers []types.ContainerJSON,
+) (string, error) {
+	if checker, ok := updater.(appliedChecker); ok {
+		applied, err := checker.Applied(ctx, container, labels)
+		if err != nil {
+			return "", err
+		}
+		if applied {
+			logrus.WithContext(ctx).Debugf("Labels of %s already applied with %s", container.Name, updater.Name())
+			return "", nil
+		}
+	}
+	var dependents []dependent
+	if updater.Replaces() {
+		err := s.checkReplaceable(ctx, container)
+		if err != nil {
+			return "", err
+		}
+	}
+	if updater.Replaces() && s.options.Dependents != DependentsIgnore {
+		if containers == nil {
+			var err error
+			containers, err = s.inspectAll(ctx)
+			if err != nil {
+				return "", errors.Wrapf(err, "failed to find dependents of container %s", container.Name)
+			}
+		}
+		dependents = findDependents(containers, container)
+		if len(dependents) > 0 && s.options.Dependents == DependentsRefuse {
+			names := make([]string, len(dependents))
+			for i, d := range dependents {
+				names[i] = d.container.Name
+			}
+			return "", fmt.Errorf(
+				"refusing to replace container %s since %s depend on it", container.Name, strings.Join(names, ", "),
+			)
+		}
+	}
+
+	started := time.Now()
+	entry := audit.Entry{
+		Time:        started,
+		Host:        s.options.Host,
+		Name:        container.Name,
+		OldID:       container.ID,
+		Instruction: instruction,
+		Diff:        audit.NewDiff(container.Config.Labels, labels),
+		Strategy:    updater.Name(),
+	}
+	logrus.WithContext(ctx).Debugf("Updating container %s with strategy %s", container.ID, entry.Strategy)
+	var err error
+	entry.NewID, err = updater.UpdateLabels(ctx, container, labels, &entry)
+	entry.DurationSeconds = time.Since(started).Seconds()
+	switch {
+	case entry.Outcome != "":
+		// Already decided by the strategy
+	case err == nil:
+		entry.Outcome = audit.OutcomeSuccess
+	case entry.Rollback != nil && entry.Rollback.Restored:
+		entry.Outcome = audit.OutcomeRolledBack
+		entry.NewID = ""
+	default:
+		entry.Outcome = audit.OutcomeFailed
+	}
 	if err != nil {
-		return errors.Wrapf(err, "inspection failed for container with id: %s", containerID)
+		entry.Error = err.Error()
 	}
-	ctx = context.WithValue(ctx, "oldContainerLabels", container.Config.Labels)
-	ctx = context.WithValue(ctx, "containerName", container.Name)
+	s.audit(ctx, entry)
+	if err != nil {
+		return entry.NewID, err
+	}
+	return entry.NewID, s.updateDependents(ctx, container, entry.NewID, dependents, containers)
+}
 
-	logrus.WithContext(ctx).Debugf("Stopping container %s", containerID)
-	err = s.dockerClient.ContainerStop(ctx, containerID, &timeout)
+// backup saves the container before it is destroyed, if backups are enabled
+//
+// The name of the backup is recorded in the entry
+func (s *Service) backup(ctx context.Context, container types.ContainerJSON, entry *audit.Entry) error {
+	if s.options.Backups == nil {
+		return nil
+	}
+	logrus.WithContext(ctx).Debugf("Backing up container %s", container.ID)
+	var err error
+	entry.Backup, err = s.options.Backups.Save(ctx, container)
 	if err != nil {
-		// TODO: should maybe be handled? what happens on timeout?
-		return errors.Wrapf(err, "failed to stop container %s", containerID)
+		return errors.Wrapf(err, "failed to back up container %s", container.ID)
 	}
+	return nil
+}
 
-	newName := container.Name + "-old"
-	logrus.WithContext(ctx).Debugf("Changing name of container %s from %s to %s", containerID, container.Name, newName)
-	err = s.dockerClient.ContainerRename(ctx, containerID, newName)
+// audit appends the entry to the audit log, if there is one
+func (s *Service) audit(ctx context.Context, entry audit.Entry) {
+	if s.options.AuditLog == nil {
+		return
+	}
+	err := s.options.AuditLog.Append(entry)
 	if err != nil {
-		// TODO: retry mechanism
-		return errors.Wrapf(err, "failed to rename container %s from %s to %s", containerID, container.Name, newName)
+		logrus.WithContext(ctx).WithError(err).Errorf("Failed to write audit entry for container %s", entry.Name)
 	}
+}
 
-	logrus.WithContext(ctx).Debugf("creating new container with name: %s", container.Name)
-	config := container.Config
+// Restore creates a container from an inspected container, ex. a backup.
+//
+// The container gets the name, configuration, networks and running state of the inspected container.
+// Returns the id of the new container
+func (s *Service) Restore(ctx context.Context, container types.ContainerJSON) (string, error) {
+	if container.ContainerJSONBase == nil || container.Config == nil || container.State == nil {
+		return "", fmt.Errorf("incomplete container snapshot")
+	}
+	_, err := s.dockerClient.ContainerInspect(ctx, container.Name)
+	if err == nil {
+		return "", fmt.Errorf("a container with name %s already exists", container.Name)
+	}
+	if !client.IsErrNotFound(err) {
+		return "", errors.Wrapf(err, "failed to check if name %s is taken", container.Name)
+	}
+	if container.NetworkSettings == nil {
+		container.NetworkSettings = &types.NetworkSettings{}
+	}
+	newID, err := s.createReplacement(ctx, container, container.Name, container.Config.Labels)
+	if err != nil && newID != "" {
+		removeErr := s.dockerClient.ContainerRemove(ctx, newID, types.ContainerRemoveOptions{Force: true})
+		if removeErr != nil {
+			logrus.WithContext(ctx).WithError(removeErr).Errorf("Failed to remove partially restored container %s", newID)
+		}
+		return "", err
+	}
+	return newID, err
+}
+
+// createReplacement creates, connects and, if the old container was running, starts a copy of
+// the container with the specified name and labels.
+//
+// Returns the id of the new container, also on failure if it was created
+func (s *Service) createReplacement(
+	ctx context.Context,
+	container types.ContainerJSON,
+	name string,
+	labels map[string]string,
+) (string, error) {
+	logrus.WithContext(ctx).Debugf("creating new container with name: %s", name)
+	config := *container.Config
 	// Setting labels
 	config.Labels = labels
-	newID, err := s.dockerClient.ContainerCreate(ctx, config, container.HostConfig, &network.NetworkingConfig{}, container.Name)
+	hostConfig := s.createHostConfig(container.HostConfig)
+	newID, err := s.dockerClient.ContainerCreate(ctx, &config, hostConfig, &network.NetworkingConfig{}, name)
 	if err != nil {
-		// TODO: restore old container
-		return errors.Wrapf(
-			err,
-			"failed to create new container with name: %s, old container can be restored from (id: %s, name:%s)",
-			container.Name, containerID, newName,
-		)
+		return "", errors.Wrapf(err, "failed to create new container with name: %s", name)
 	}
 
-	for networkName, network := range container.NetworkSettings.Networks {
+	networks := container.NetworkSettings.Networks
+	if joinsNamespace(container) {
+		// The networks belong to the joined container
+		networks = nil
+	}
+	for networkName, network := range networks {
 		err = s.dockerClient.NetworkConnect(ctx, network.NetworkID, newID.ID, network)
 		if err != nil {
-			// TODO: restore old container
-			return errors.Wrapf(
+			return newID.ID, errors.Wrapf(
 				err,
-				"failed to connect new container with name: %s, id: %s to network with name: %s, id: %s , old container can be restored from (id: %s, name:%s)",
-				container.Name, newID.ID, networkName, network.NetworkID, containerID, newName,
+				"failed to connect new container with name: %s, id: %s to network with name: %s, id: %s",
+				name, newID.ID, networkName, network.NetworkID,
 			)
 		}
 	}
@@ -108,23 +357,61 @@ func (s *Service) SetLabels(ctx context.Context, containerID string, labels map[
 	if container.State.Running {
 		err = s.dockerClient.ContainerStart(ctx, newID.ID, types.ContainerStartOptions{})
 		if err != nil {
-			// TODO: restore old container
-			return errors.Wrapf(
-				err,
-				"failed to start new container with (name: %s, id: %s), old container can be restored from (id: %s, name:%s)",
-				container.Name, newID, containerID, newName,
-			)
+			return newID.ID, errors.Wrapf(err, "failed to start new container with (name: %s, id: %s)", name, newID.ID)
 		}
 	}
+	return newID.ID, nil
+}
 
-	logrus.WithContext(ctx).Debugf("Removing old container with name: %s and id: %s", container.Name, containerID)
-	err = s.dockerClient.ContainerRemove(ctx, containerID, types.ContainerRemoveOptions{
-		RemoveVolumes: false,
-		RemoveLinks:   false,
-		Force:         false,
-	})
+// rollback restores the old container after a failed update and returns the cause annotated with the outcome.
+//
+// The new container, if any, is removed and the old container gets back its name, if renamed, and state.
+// A running old container is started again even if it was never stopped, which has no effect.
+// The outcome of the rollback is recorded in the entry.
+func (s *Service) rollback(
+	ctx context.Context,
+	container types.ContainerJSON,
+	newID string,
+	renamed bool,
+	cause error,
+	entry *audit.Entry,
+) error {
+	logrus.WithContext(ctx).WithError(cause).Warnf("Restoring container %s (%s)", container.Name, container.ID)
+	err := s.restore(ctx, container, newID, renamed)
+	entry.Rollback = &audit.Rollback{Restored: err == nil}
 	if err != nil {
-		return errors.Wrapf(err, "failed to remove old container (%s) with name: %s", containerID, newName)
+		entry.Rollback.Error = err.Error()
+		return errors.Wrapf(
+			cause,
+			"failed to restore old container (%v), it can be restored from (id: %s, name: %s)",
+			err, container.ID, container.Name+oldSuffix,
+		)
+	}
+	return errors.Wrapf(cause, "old container (%s) with name: %s restored", container.ID, container.Name)
+}
+
+func (s *Service) restore(ctx context.Context, container types.ContainerJSON, newID string, renamed bool) error {
+	if newID != "" {
+		err := s.dockerClient.ContainerStop(ctx, newID, &timeout)
+		if err != nil {
+			logrus.WithContext(ctx).WithError(err).Warnf("Failed to stop new container %s, removing it by force", newID)
+		}
+		err = s.dockerClient.ContainerRemove(ctx, newID, types.ContainerRemoveOptions{Force: true})
+		if err != nil {
+			return errors.Wrapf(err, "failed to remove new container %s", newID)
+		}
+	}
+	if renamed {
+		err := s.dockerClient.ContainerRename(ctx, container.ID, container.Name)
+		if err != nil {
+			return errors.Wrapf(err, "failed to rename container %s back to %s", container.ID, container.Name)
+		}
+	}
+	if container.State.Running {
+		err := s.dockerClient.ContainerStart(ctx, container.ID, types.ContainerStartOptions{})
+		if err != nil {
+			return errors.Wrapf(err, "failed to start container %s", container.ID)
+		}
 	}
 	return nil
 }
@@ -0,0 +1,319 @@
+package docker_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+var errInjected = errors.New("injected failure")
+
+// memoryAuditLog keeps audit entries in memory
+type memoryAuditLog []audit.Entry
+
+func (l *memoryAuditLog) Append(entry audit.Entry) error {
+	*l = append(*l, entry)
+	return nil
+}
+
+func TestService_SetLabels(t *testing.T) {
+	newLabels := map[string]string{"new": "label"}
+	tests := []struct {
+		name string
+		// setup adds containers and failures to the client and returns the id of the container to update
+		setup   func(c *dockertest.Client) string
+		wantErr bool
+		// wantLabels are the expected labels of the container named "web" afterwards
+		wantLabels  map[string]string
+		wantRunning bool
+		wantNames   []string
+		wantNetwork []string
+		wantOutcome audit.Outcome
+	}{
+		{
+			name: "recreate",
+			setup: func(c *dockertest.Client) string {
+				return c.AddContainer(dockertest.Container{
+					Name:     "web",
+					Labels:   map[string]string{"old": "label"},
+					Running:  true,
+					Networks: map[string]string{"frontend": "n1", "backend": "n2"},
+				})
+			},
+			wantLabels:  newLabels,
+			wantRunning: true,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeSuccess,
+			wantNetwork: []string{"backend", "frontend"},
+		},
+		{
+			name: "stopped container stays stopped",
+			setup: func(c *dockertest.Client) string {
+				return c.AddContainer(dockertest.Container{Name: "web"})
+			},
+			wantLabels:  newLabels,
+			wantRunning: false,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeSuccess,
+		},
+		{
+			name: "rename collision",
+			setup: func(c *dockertest.Client) string {
+				c.AddContainer(dockertest.Container{Name: "web-old"})
+				return c.AddContainer(dockertest.Container{
+					Name:    "web",
+					Labels:  map[string]string{"old": "label"},
+					Running: true,
+				})
+			},
+			wantErr:     true,
+			wantLabels:  map[string]string{"old": "label"},
+			wantRunning: true,
+			wantNames:   []string{"web", "web-old"},
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+		{
+			name: "create fails",
+			setup: func(c *dockertest.Client) string {
+				c.Fail(dockertest.MethodContainerCreate, errInjected)
+				return c.AddContainer(dockertest.Container{
+					Name:    "web",
+					Labels:  map[string]string{"old": "label"},
+					Running: true,
+				})
+			},
+			wantErr:     true,
+			wantLabels:  map[string]string{"old": "label"},
+			wantRunning: true,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+		{
+			name: "network connect fails",
+			setup: func(c *dockertest.Client) string {
+				c.Fail(dockertest.MethodNetworkConnect, errInjected)
+				return c.AddContainer(dockertest.Container{
+					Name:     "web",
+					Labels:   map[string]string{"old": "label"},
+					Running:  true,
+					Networks: map[string]string{"frontend": "n1"},
+				})
+			},
+			wantErr:     true,
+			wantLabels:  map[string]string{"old": "label"},
+			wantRunning: true,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeRolledBack,
+			wantNetwork: []string{"frontend"},
+		},
+		{
+			name: "start fails",
+			setup: func(c *dockertest.Client) string {
+				c.Fail(dockertest.MethodContainerStart, errInjected)
+				return c.AddContainer(dockertest.Container{
+					Name:    "web",
+					Labels:  map[string]string{"old": "label"},
+					Running: true,
+				})
+			},
+			wantErr:     true,
+			wantLabels:  map[string]string{"old": "label"},
+			wantRunning: true,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeRolledBack,
+		},
+		{
+			name: "rollback fails",
+			setup: func(c *dockertest.Client) string {
+				c.Fail(dockertest.MethodContainerCreate, errInjected)
+				c.Fail(dockertest.MethodContainerRename, nil, errInjected)
+				return c.AddContainer(dockertest.Container{
+					Name:    "web",
+					Labels:  map[string]string{"old": "label"},
+					Running: true,
+				})
+			},
+			wantErr:     true,
+			wantNames:   []string{"web-old"},
+			wantOutcome: audit.OutcomeFailed,
+		},
+		{
+			name: "stop fails",
+			setup: func(c *dockertest.Client) string {
+				c.Fail(dockertest.MethodContainerStop, errInjected)
+				return c.AddContainer(dockertest.Container{
+					Name:    "web",
+					Labels:  map[string]string{"old": "label"},
+					Running: true,
+				})
+			},
+			wantErr:     true,
+			wantLabels:  map[string]string{"old": "label"},
+			wantRunning: true,
+			wantNames:   []string{"web"},
+			wantOutcome: audit.OutcomeFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := dockertest.NewClient()
+			id := tt.setup(client)
+			auditLog := &memoryAuditLog{}
+			service, err := docker.NewService(ctx, client, docker.ServiceOptions{AuditLog: auditLog})
+			if err != nil {
+				t.Fatalf("NewService() error = %v", err)
+			}
+
+			err = service.SetLabels(ctx, id, "instruction()", newLabels)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("SetLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(*auditLog) != 1 || (*auditLog)[0].Outcome != tt.wantOutcome {
+				t.Errorf("audit log = %+v, want one entry with outcome %v", *auditLog, tt.wantOutcome)
+			}
+			if got := client.Names(); !reflect.DeepEqual(got, tt.wantNames) {
+				t.Errorf("container names = %v, want %v", got, tt.wantNames)
+			}
+			web, ok := client.Container("web")
+			if tt.wantLabels == nil {
+				if ok {
+					t.Errorf("container web exists, want it to be missing")
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("container web is missing")
+			}
+			if !reflect.DeepEqual(web.Config.Labels, tt.wantLabels) {
+				t.Errorf("labels = %v, want %v", web.Config.Labels, tt.wantLabels)
+			}
+			if web.State.Running != tt.wantRunning {
+				t.Errorf("running = %v, want %v", web.State.Running, tt.wantRunning)
+			}
+			var networks []string
+			for name := range web.NetworkSettings.Networks {
+				networks = append(networks, name)
+			}
+			sort.Strings(networks)
+			if !reflect.DeepEqual(networks, tt.wantNetwork) {
+				t.Errorf("networks = %v, want %v", networks, tt.wantNetwork)
+			}
+		})
+	}
+}
+
+func TestService_GetContainers(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	client.AddContainer(dockertest.Container{Name: "running", Running: true, Labels: map[string]string{"a": "1"}})
+	client.AddContainer(dockertest.Container{Name: "stopped"})
+	service, _ := docker.NewService(ctx, client, docker.ServiceOptions{})
+
+	running, err := service.GetContainers(ctx, false)
+	if err != nil {
+		t.Fatalf("GetContainers() error = %v", err)
+	}
+	if len(running) != 1 || running[0].Name != "/running" || running[0].Labels["a"] != "1" ||
+		running[0].Host != docker.DefaultHost {
+		t.Errorf("GetContainers(false) = %+v, want only /running", running)
+	}
+	all, err := service.GetContainers(ctx, true)
+	if err != nil {
+		t.Fatalf("GetContainers() error = %v", err)
+	}
+	if len(all) != 2 {
+		t.Errorf("GetContainers(true) returned %d containers, want 2", len(all))
+	}
+
+	client.Fail(dockertest.MethodContainerList, errInjected)
+	if _, err := service.GetContainers(ctx, true); err == nil {
+		t.Errorf("GetContainers() expected injected error")
+	}
+}
+
+func TestService_GetEnv(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	id := client.AddContainer(dockertest.Container{Name: "web", Env: []string{"A=1"}})
+	service, _ := docker.NewService(ctx, client, docker.ServiceOptions{})
+
+	env, err := service.GetEnv(ctx, id)
+	if err != nil || !reflect.DeepEqual(env, []string{"A=1"}) {
+		t.Errorf("GetEnv() = %v, %v, want [A=1]", env, err)
+	}
+	// Containers can be removed between being listed and inspected
+	env, err = service.GetEnv(ctx, "removed")
+	if err != nil || env != nil {
+		t.Errorf("GetEnv() = %v, %v, want no environment for a removed container", env, err)
+	}
+	client.Fail(dockertest.MethodContainerInspect, errInjected)
+	if _, err := service.GetEnv(ctx, id); err == nil {
+		t.Errorf("GetEnv() expected injected error")
+	}
+}
+
+// memoryBackups keeps backups in memory
+type memoryBackups []types.ContainerJSON
+
+func (b *memoryBackups) Save(_ context.Context, container types.ContainerJSON) (string, error) {
+	*b = append(*b, container)
+	return container.ID, nil
+}
+
+func TestService_Restore(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	id := client.AddContainer(dockertest.Container{
+		Name:     "web",
+		Labels:   map[string]string{"old": "label"},
+		Running:  true,
+		Networks: map[string]string{"frontend": "n1"},
+	})
+	backups := &memoryBackups{}
+	auditLog := &memoryAuditLog{}
+	service, _ := docker.NewService(ctx, client, docker.ServiceOptions{Backups: backups, AuditLog: auditLog})
+
+	if err := service.SetLabels(ctx, id, "instruction()", map[string]string{"new": "label"}); err != nil {
+		t.Fatalf("SetLabels() error = %v", err)
+	}
+	if len(*backups) != 1 || (*backups)[0].ID != id || (*auditLog)[0].Backup != id {
+		t.Fatalf("backups = %+v, want a backup of %s referenced in the audit log", *backups, id)
+	}
+
+	if _, err := service.Restore(ctx, (*backups)[0]); err == nil {
+		t.Errorf("Restore() expected error when the name is taken")
+	}
+	web, _ := client.Container("web")
+	if err := client.ContainerRemove(ctx, web.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+		t.Fatalf("ContainerRemove() error = %v", err)
+	}
+	// Only a missing container means the name is free
+	client.Fail(dockertest.MethodContainerInspect, errInjected)
+	if _, err := service.Restore(ctx, (*backups)[0]); err == nil {
+		t.Errorf("Restore() expected error when the name can't be checked")
+	}
+	if _, ok := client.Container("web"); ok {
+		t.Errorf("Restore() created a container without checking the name")
+	}
+	if _, err := service.Restore(ctx, (*backups)[0]); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	restored, ok := client.Container("web")
+	if !ok {
+		t.Fatalf("container web is missing after restore")
+	}
+	if !reflect.DeepEqual(restored.Config.Labels, map[string]string{"old": "label"}) ||
+		!restored.State.Running ||
+		restored.NetworkSettings.Networks["frontend"] == nil {
+		t.Errorf("restored container = %+v, %+v, want the backed up container", restored.Config, restored.State)
+	}
+}
@@ -0,0 +1,113 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+const (
+	// swarmServiceLabel is set by swarm on all containers that are tasks of a service
+	swarmServiceLabel = "com.docker.swarm.service.id"
+	// swarmLabelPrefix is the prefix of all labels swarm sets on task containers
+	swarmLabelPrefix = "com.docker.swarm."
+)
+
+// SwarmClient specifies the methods of the docker client required to update swarm services
+//
+// Interface can be realized by the official docker client: github.com/docker/docker/client
+type SwarmClient interface {
+	ServiceInspectWithRaw(ctx context.Context, serviceID string) (swarm.Service, []byte, error)
+	ServiceUpdate(ctx context.Context, serviceID string, version swarm.Version, service swarm.ServiceSpec, options types.ServiceUpdateOptions) (types.ServiceUpdateResponse, error) //nolint:lll
+}
+
+// swarmUpdater sets the labels in the container spec of the swarm service the container is a task of
+type swarmUpdater struct {
+	client SwarmClient
+}
+
+func (swarmUpdater) Name() string {
+	return StrategySwarm
+}
+
+func (swarmUpdater) Replaces() bool {
+	return false
+}
+
+func (swarmUpdater) Check(container types.ContainerJSON) error {
+	if _, ok := container.Config.Labels[swarmServiceLabel]; !ok {
+		return fmt.Errorf("container is not a task of a swarm service")
+	}
+	return nil
+}
+
+// Applied reports if the service of the container already has the labels, its tasks are then being replaced by swarm
+func (u swarmUpdater) Applied(
+	ctx context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+) (bool, error) {
+	serviceID := container.Config.Labels[swarmServiceLabel]
+	service, _, err := u.client.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		return false, errors.Wrapf(err, "inspection failed for service with id: %s", serviceID)
+	}
+	current := service.Spec.TaskTemplate.ContainerSpec.Labels
+	wanted := serviceLabels(labels)
+	if len(current) != len(wanted) {
+		return false, nil
+	}
+	for key, value := range wanted {
+		if current[key] != value {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// UpdateLabels updates the service of the container, swarm then replaces the tasks on its own
+//
+// Labels set by swarm itself are not written to the service.
+// No new container id is returned since the tasks are replaced asynchronously
+func (u swarmUpdater) UpdateLabels(
+	ctx context.Context,
+	container types.ContainerJSON,
+	labels map[string]string,
+	_ *audit.Entry,
+) (string, error) {
+	serviceID := container.Config.Labels[swarmServiceLabel]
+	service, _, err := u.client.ServiceInspectWithRaw(ctx, serviceID)
+	if err != nil {
+		return "", errors.Wrapf(err, "inspection failed for service with id: %s", serviceID)
+	}
+
+	spec := service.Spec
+	spec.TaskTemplate.ContainerSpec.Labels = serviceLabels(labels)
+	logrus.WithContext(ctx).Debugf("Updating container labels of service %s (%s)", service.Spec.Name, serviceID)
+	response, err := u.client.ServiceUpdate(ctx, serviceID, service.Version, spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to update service %s", serviceID)
+	}
+	for _, warning := range response.Warnings {
+		logrus.WithContext(ctx).Warnf("Updating service %s: %s", serviceID, warning)
+	}
+	return "", nil
+}
+
+// serviceLabels returns the labels without the ones set by swarm itself
+func serviceLabels(labels map[string]string) map[string]string {
+	filtered := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if !strings.HasPrefix(key, swarmLabelPrefix) {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,90 @@
+package docker
+
+import (
+	"context"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+
+	"sidus.io/discriminator/internal/pkg/tracing"
+)
+
+// tracedClient records a span for every call to the docker api, if the context has a tracer
+type tracedClient struct {
+	Client
+}
+
+func (c tracedClient) ContainerCreate(
+	ctx context.Context,
+	config *container.Config,
+	hostConfig *container.HostConfig,
+	networkingConfig *network.NetworkingConfig,
+	containerName string,
+) (container.ContainerCreateCreatedBody, error) {
+	ctx, span := tracing.Start(ctx, "docker.ContainerCreate", "container", containerName)
+	created, err := c.Client.ContainerCreate(ctx, config, hostConfig, networkingConfig, containerName)
+	span.SetAttribute("containerId", created.ID)
+	span.End(err)
+	return created, err
+}
+
+func (c tracedClient) ContainerRemove(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+	ctx, span := tracing.Start(ctx, "docker.ContainerRemove", "container", id)
+	err := c.Client.ContainerRemove(ctx, id, options)
+	span.End(err)
+	return err
+}
+
+func (c tracedClient) ContainerRename(ctx context.Context, id, newContainerName string) error {
+	ctx, span := tracing.Start(ctx, "docker.ContainerRename", "container", id, "newName", newContainerName)
+	err := c.Client.ContainerRename(ctx, id, newContainerName)
+	span.End(err)
+	return err
+}
+
+func (c tracedClient) ContainerList(
+	ctx context.Context,
+	options types.ContainerListOptions,
+) ([]types.Container, error) {
+	ctx, span := tracing.Start(ctx, "docker.ContainerList")
+	containers, err := c.Client.ContainerList(ctx, options)
+	span.End(err)
+	return containers, err
+}
+
+func (c tracedClient) ContainerInspect(ctx context.Context, id string) (types.ContainerJSON, error) {
+	ctx, span := tracing.Start(ctx, "docker.ContainerInspect", "container", id)
+	inspected, err := c.Client.ContainerInspect(ctx, id)
+	span.End(err)
+	return inspected, err
+}
+
+func (c tracedClient) ContainerStart(ctx context.Context, id string, options types.ContainerStartOptions) error {
+	ctx, span := tracing.Start(ctx, "docker.ContainerStart", "container", id)
+	err := c.Client.ContainerStart(ctx, id, options)
+	span.End(err)
+	return err
+}
+
+func (c tracedClient) ContainerStop(ctx context.Context, id string, timeout *time.Duration) error {
+	ctx, span := tracing.Start(ctx, "docker.ContainerStop", "container", id)
+	if timeout != nil {
+		span.SetAttribute("timeout", timeout.String())
+	}
+	err := c.Client.ContainerStop(ctx, id, timeout)
+	span.End(err)
+	return err
+}
+
+func (c tracedClient) NetworkConnect(
+	ctx context.Context,
+	networkID, containerID string,
+	config *network.EndpointSettings,
+) error {
+	ctx, span := tracing.Start(ctx, "docker.NetworkConnect", "container", containerID, "network", networkID)
+	err := c.Client.NetworkConnect(ctx, networkID, containerID, config)
+	span.End(err)
+	return err
+}
@@ -0,0 +1,183 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// Names of the built in update strategies
+const (
+	// StrategyRecreate stops the old container before the new one is created
+	StrategyRecreate = "recreate"
+	// StrategyBlueGreen starts the new container before the old one is stopped
+	StrategyBlueGreen = "blue-green"
+	// StrategySwarm updates the swarm service of the container and lets swarm replace it
+	StrategySwarm = "swarm"
+	// StrategyNotify only reports the labels that would have been set
+	StrategyNotify = "notify"
+)
+
+// LabelUpdater is a strategy for applying new labels to a container
+type LabelUpdater interface {
+	// Name is the name the strategy is selected by
+	Name() string
+	// Check returns an error if the strategy can't be used for the container
+	Check(container types.ContainerJSON) error
+	// Replaces reports if the strategy replaces the container with a new one with another id
+	Replaces() bool
+	// UpdateLabels applies the labels to the inspected container and returns the id of the new container, if any.
+	//
+	// Backups and rollbacks should be recorded in the entry.
+	// The strategy can set the outcome of the entry, otherwise it is decided from the returned error
+	UpdateLabels(
+		ctx context.Context,
+		container types.ContainerJSON,
+		labels map[string]string,
+		entry *audit.Entry,
+	) (string, error)
+}
+
+// appliedChecker is implemented by strategies that leave the container untouched,
+// so that the labels they already applied aren't applied again on every iteration
+type appliedChecker interface {
+	// Applied reports if the labels were already applied to the container
+	Applied(ctx context.Context, container types.ContainerJSON, labels map[string]string) (bool, error)
+}
+
+// StrategySelector selects an update strategy for containers with names matching the pattern
+//
+// Patterns are matched against the container name without the leading "/"
+// and support the "*" and "?" wildcards
+type StrategySelector struct {
+	Pattern  string
+	Strategy string
+}
+
+// registerUpdaters registers the built in and configured update strategies
+// and makes sure all selected strategies exist
+func (s *Service) registerUpdaters() error {
+	updaters := []LabelUpdater{
+		recreateUpdater{s: s},
+		blueGreenUpdater{s: s},
+		&notifyUpdater{notified: make(map[string]map[string]string)},
+	}
+	if s.options.SwarmClient != nil {
+		updaters = append(updaters, swarmUpdater{client: s.options.SwarmClient})
+	}
+	updaters = append(updaters, s.options.Updaters...)
+
+	s.updaters = make(map[string]LabelUpdater, len(updaters))
+	for _, updater := range updaters {
+		if _, ok := s.updaters[updater.Name()]; ok {
+			return fmt.Errorf("update strategy %s registered more than once", updater.Name())
+		}
+		s.updaters[updater.Name()] = updater
+	}
+
+	if _, ok := s.updaters[s.options.DefaultStrategy]; !ok {
+		return fmt.Errorf("unknown default update strategy %s", s.options.DefaultStrategy)
+	}
+	for _, selector := range s.options.StrategySelectors {
+		if _, ok := s.updaters[selector.Strategy]; !ok {
+			return fmt.Errorf("unknown update strategy %s selected for %s", selector.Strategy, selector.Pattern)
+		}
+		if _, err := path.Match(selector.Pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %s", selector.Pattern)
+		}
+	}
+	return nil
+}
+
+// Update is a pending update of the labels of an inspected container, with the strategy selected for it
+type Update struct {
+	container types.ContainerJSON
+	updater   LabelUpdater
+}
+
+// Strategy returns the name of the update strategy
+func (u Update) Strategy() string {
+	return u.updater.Name()
+}
+
+// Replaces reports if the update replaces the container with a new one with another id
+func (u Update) Replaces() bool {
+	return u.updater.Replaces()
+}
+
+// PrepareUpdate inspects the container and selects the update strategy for it, the update is applied by ApplyUpdate
+func (s *Service) PrepareUpdate(ctx context.Context, containerID string) (Update, error) {
+	logrus.WithContext(ctx).Debugf("Inspecting container %s", containerID)
+	container, err := s.dockerClient.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return Update{}, errors.Wrapf(err, "inspection failed for container with id: %s", containerID)
+	}
+	updater, err := s.updater(ctx, container)
+	if err != nil {
+		return Update{}, err
+	}
+	return Update{container: container, updater: updater}, nil
+}
+
+// updater returns the update strategy to use for the container
+//
+// The strategy is selected by, in order, the strategy label, the strategy selectors,
+// swarm tasks being updated through their service and last the default strategy.
+// If the selected strategy can't be used for the container the default strategy is used instead.
+func (s *Service) updater(ctx context.Context, container types.ContainerJSON) (LabelUpdater, error) {
+	name := s.selectStrategy(container)
+	updater, ok := s.updaters[name]
+	if !ok {
+		logrus.WithContext(ctx).Warnf(
+			"Container %s selects unknown update strategy %s, using %s", container.Name, name, s.options.DefaultStrategy,
+		)
+		updater = s.updaters[s.options.DefaultStrategy]
+	}
+	err := updater.Check(container)
+	if err == nil {
+		return updater, nil
+	}
+	if updater.Name() == s.options.DefaultStrategy {
+		return nil, fmt.Errorf("update strategy %s can't be used for container %s: %v", updater.Name(), container.Name, err)
+	}
+
+	logrus.WithContext(ctx).WithError(err).Warnf(
+		"Container %s can't be updated with %s, falling back to %s",
+		container.Name, updater.Name(), s.options.DefaultStrategy,
+	)
+	updater = s.updaters[s.options.DefaultStrategy]
+	err = updater.Check(container)
+	if err != nil {
+		return nil, fmt.Errorf("update strategy %s can't be used for container %s: %v", updater.Name(), container.Name, err)
+	}
+	return updater, nil
+}
+
+// selectStrategy returns the name of the strategy selected for the container
+func (s *Service) selectStrategy(container types.ContainerJSON) string {
+	if s.options.StrategyLabel != "" {
+		if name := container.Config.Labels[s.options.StrategyLabel]; name != "" {
+			return name
+		}
+	}
+	name := strings.TrimPrefix(container.Name, "/")
+	for _, selector := range s.options.StrategySelectors {
+		// Patterns are validated when the service is created
+		if matched, _ := path.Match(selector.Pattern, name); matched {
+			return selector.Strategy
+		}
+	}
+	if _, ok := container.Config.Labels[swarmServiceLabel]; ok {
+		if _, ok := s.updaters[StrategySwarm]; ok {
+			return StrategySwarm
+		}
+	}
+	return s.options.DefaultStrategy
+}
@@ -0,0 +1,230 @@
+package docker_test
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/docker"
+	"sidus.io/discriminator/internal/pkg/docker/dockertest"
+)
+
+// countingUpdater is a custom strategy counting its updates
+type countingUpdater struct {
+	updates *int
+}
+
+func (countingUpdater) Name() string {
+	return "counting"
+}
+
+func (countingUpdater) Replaces() bool {
+	return false
+}
+
+func (countingUpdater) Check(types.ContainerJSON) error {
+	return nil
+}
+
+func (u countingUpdater) UpdateLabels(
+	context.Context,
+	types.ContainerJSON,
+	map[string]string,
+	*audit.Entry,
+) (string, error) {
+	*u.updates++
+	return "", nil
+}
+
+func TestService_SetLabels_strategies(t *testing.T) {
+	tests := []struct {
+		name         string
+		labels       map[string]string
+		swarm        bool
+		wantStrategy string
+		wantOutcome  audit.Outcome
+		wantErr      bool
+	}{
+		{
+			name:         "default",
+			wantStrategy: docker.StrategyRecreate,
+			wantOutcome:  audit.OutcomeSuccess,
+		},
+		{
+			name:         "label",
+			labels:       map[string]string{"strategy": docker.StrategyNotify},
+			wantStrategy: docker.StrategyNotify,
+			wantOutcome:  audit.OutcomeNotified,
+		},
+		{
+			name:         "custom",
+			labels:       map[string]string{"strategy": "counting"},
+			wantStrategy: "counting",
+			wantOutcome:  audit.OutcomeSuccess,
+		},
+		{
+			name:         "unknown label falls back to default",
+			labels:       map[string]string{"strategy": "unknown"},
+			wantStrategy: docker.StrategyRecreate,
+			wantOutcome:  audit.OutcomeSuccess,
+		},
+		{
+			name:         "swarm task",
+			swarm:        true,
+			wantStrategy: docker.StrategySwarm,
+			wantOutcome:  audit.OutcomeSuccess,
+		},
+		{
+			name:    "swarm task can't be recreated",
+			labels:  map[string]string{"strategy": docker.StrategyRecreate},
+			swarm:   true,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			client := dockertest.NewClient()
+			labels := map[string]string{"old": "label"}
+			for key, value := range tt.labels {
+				labels[key] = value
+			}
+			var serviceID string
+			if tt.swarm {
+				serviceID = client.AddService("web", map[string]string{"old": "label"})
+				labels["com.docker.swarm.service.id"] = serviceID
+			}
+			id := client.AddContainer(dockertest.Container{Name: "web.1", Running: true, Labels: labels})
+			updates := 0
+			auditLog := &memoryAuditLog{}
+			service, err := docker.NewService(ctx, client, docker.ServiceOptions{
+				AuditLog:      auditLog,
+				StrategyLabel: "strategy",
+				SwarmClient:   client,
+				Updaters:      []docker.LabelUpdater{countingUpdater{updates: &updates}},
+			})
+			if err != nil {
+				t.Fatalf("NewService() error = %v", err)
+			}
+
+			newLabels := map[string]string{"new": "label"}
+			for key, value := range labels {
+				if key != "old" {
+					newLabels[key] = value
+				}
+			}
+			err = service.SetLabels(ctx, id, "instruction()", newLabels)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SetLabels() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if len(*auditLog) != 0 {
+					t.Errorf("audit log = %+v, want no entries", *auditLog)
+				}
+				return
+			}
+			entry := (*auditLog)[0]
+			if entry.Strategy != tt.wantStrategy || entry.Outcome != tt.wantOutcome {
+				t.Errorf("audit entry = %v/%v, want %v/%v", entry.Strategy, entry.Outcome, tt.wantStrategy, tt.wantOutcome)
+			}
+
+			web, _ := client.Container("web.1")
+			switch tt.wantStrategy {
+			case docker.StrategyRecreate:
+				if web.ID == id {
+					t.Errorf("container was not recreated")
+				}
+			case docker.StrategySwarm:
+				swarmService, _ := client.Service(serviceID)
+				got := swarmService.Spec.TaskTemplate.ContainerSpec.Labels
+				if !reflect.DeepEqual(got, map[string]string{"new": "label"}) {
+					t.Errorf("service labels = %v, want only the new label", got)
+				}
+				fallthrough
+			default:
+				if web.ID != id || web.Config.Labels["old"] != "label" {
+					t.Errorf("container was changed by strategy %s", tt.wantStrategy)
+				}
+			}
+			if tt.wantStrategy == "counting" && updates != 1 {
+				t.Errorf("custom strategy called %d times, want 1", updates)
+			}
+			// Strategies that leave the container untouched don't apply the same labels again
+			if tt.wantStrategy == docker.StrategyNotify || tt.wantStrategy == docker.StrategySwarm {
+				if err := service.SetLabels(ctx, id, "instruction()", newLabels); err != nil {
+					t.Fatalf("SetLabels() error = %v", err)
+				}
+				if len(*auditLog) != 1 {
+					t.Errorf("audit log = %+v, want the labels applied once", *auditLog)
+				}
+			}
+		})
+	}
+}
+
+func TestNewService_strategies(t *testing.T) {
+	tests := []struct {
+		name    string
+		options docker.ServiceOptions
+		wantErr bool
+	}{
+		{
+			name: "valid selectors",
+			options: docker.ServiceOptions{
+				DefaultStrategy:   docker.StrategyNotify,
+				StrategySelectors: []docker.StrategySelector{{Pattern: "web-*", Strategy: docker.StrategyBlueGreen}},
+			},
+		},
+		{
+			name:    "unknown default",
+			options: docker.ServiceOptions{DefaultStrategy: "unknown"},
+			wantErr: true,
+		},
+		{
+			name: "swarm without client",
+			options: docker.ServiceOptions{
+				StrategySelectors: []docker.StrategySelector{{Pattern: "*", Strategy: docker.StrategySwarm}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid pattern",
+			options: docker.ServiceOptions{
+				StrategySelectors: []docker.StrategySelector{{Pattern: "[", Strategy: docker.StrategyNotify}},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := docker.NewService(context.Background(), dockertest.NewClient(), tt.options)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewService() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Make sure selectors choose strategy for containers without the strategy label
+func TestService_SetLabels_selector(t *testing.T) {
+	ctx := context.Background()
+	client := dockertest.NewClient()
+	id := client.AddContainer(dockertest.Container{Name: "legacy-app", Running: true})
+	auditLog := &memoryAuditLog{}
+	service, err := docker.NewService(ctx, client, docker.ServiceOptions{
+		AuditLog:          auditLog,
+		StrategySelectors: []docker.StrategySelector{{Pattern: "legacy-*", Strategy: docker.StrategyNotify}},
+	})
+	if err != nil {
+		t.Fatalf("NewService() error = %v", err)
+	}
+	if err := service.SetLabels(ctx, id, "instruction()", map[string]string{"new": "label"}); err != nil {
+		t.Fatalf("SetLabels() error = %v", err)
+	}
+	if got := (*auditLog)[0].Strategy; got != docker.StrategyNotify {
+		t.Errorf("strategy = %v, want %v", got, docker.StrategyNotify)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"io"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -18,6 +19,9 @@ type Modifiers []Modifier
 //
 // deletions always trumps additions
 type Modifier struct {
+	// Template is the name of the template the modifier comes from, if any
+	Template string
+
 	additions map[string]string
 	deletions []string
 }
@@ -72,6 +76,25 @@ func (m Modifier) Apply(labels map[string]string) {
 	}
 }
 
+// String returns the modifier in the form it is parsed from, additions before deletions, sorted by key
+func (m Modifier) String() string {
+	keys := make([]string, 0, len(m.additions))
+	for key := range m.additions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	rows := make([]string, 0, len(m.additions)+len(m.deletions))
+	for _, key := range keys {
+		rows = append(rows, "+"+key+"="+m.additions[key])
+	}
+	deletions := append([]string{}, m.deletions...)
+	sort.Strings(deletions)
+	for _, key := range deletions {
+		rows = append(rows, "-"+key)
+	}
+	return strings.Join(rows, "\n")
+}
+
 // Apply applies a set of modifers to a set of labels in sequential order
 func (ms Modifiers) Apply(labels map[string]string) {
 	for _, m := range ms {
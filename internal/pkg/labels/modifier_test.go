@@ -118,3 +118,33 @@ func TestModifiers_Apply(t *testing.T) {
 		})
 	}
 }
+
+func TestModifier_String(t *testing.T) {
+	tests := []struct {
+		name     string
+		modifier string
+		want     string
+	}{
+		{
+			name:     "sorted",
+			modifier: "-z\n+b=2\n  +a=1=1\n-y",
+			want:     "+a=1=1\n+b=2\n-y\n-z",
+		},
+		{
+			name:     "empty",
+			modifier: "ignored",
+			want:     "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := NewModifier(context.Background(), bytes.NewReader([]byte(tt.modifier)))
+			if err != nil {
+				t.Fatalf("NewModifier() error = %v", err)
+			}
+			if got := m.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
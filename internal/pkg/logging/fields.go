@@ -0,0 +1,95 @@
+// Package logging carries log fields in contexts and adds them to every log line made with the context
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Field is the name of a value carried by contexts, used as is in log output
+type Field string
+
+// Fields added to log lines, in the order they are added to contexts
+const (
+	// FieldPhase is the phase of the application, ex. "setup" or "operating"
+	FieldPhase Field = "phase"
+	// FieldIteration identifies the iteration, or api request, the line is part of
+	FieldIteration Field = "iteration"
+	// FieldHost is the name of the docker host
+	FieldHost Field = "host"
+	// FieldContainerName is the name of the container, without the leading "/"
+	FieldContainerName Field = "container"
+	// FieldContainerID is the full id of the container
+	FieldContainerID Field = "containerId"
+	// FieldTemplate is the name of the template being rendered
+	FieldTemplate Field = "template"
+)
+
+// fields are all fields, in the order they are added to log lines
+var fields = []Field{FieldPhase, FieldIteration, FieldHost, FieldContainerName, FieldContainerID, FieldTemplate}
+
+// contextKey is the type of context keys, so that they can't collide with keys of other packages
+type contextKey Field
+
+// With returns a context carrying the value of the field
+func With(ctx context.Context, field Field, value string) context.Context {
+	return context.WithValue(ctx, contextKey(field), value)
+}
+
+// Value returns the value of the field carried by the context, empty if there is none
+func Value(ctx context.Context, field Field) string {
+	value, _ := ctx.Value(contextKey(field)).(string)
+	return value
+}
+
+// Fields returns the fields carried by the context
+func Fields(ctx context.Context) logrus.Fields {
+	data := logrus.Fields{}
+	for _, field := range fields {
+		if value := Value(ctx, field); value != "" {
+			data[string(field)] = value
+		}
+	}
+	return data
+}
+
+// NewIterationID returns a random id for an iteration
+func NewIterationID() string {
+	id := make([]byte, 4)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Hook adds the fields of the context of log entries to them
+//
+// Fields set explicitly on the entry are kept
+type Hook struct{}
+
+// Levels returns all levels, every line gets the fields
+func (Hook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire adds the fields of the context to the entry
+func (Hook) Fire(entry *logrus.Entry) error {
+	if entry.Context == nil {
+		return nil
+	}
+	contextFields := Fields(entry.Context)
+	if len(contextFields) == 0 {
+		return nil
+	}
+	// The data is shared with the entry the line was made from, so it is copied rather than modified
+	data := make(logrus.Fields, len(entry.Data)+len(contextFields))
+	for key, value := range contextFields {
+		data[key] = value
+	}
+	for key, value := range entry.Data {
+		data[key] = value
+	}
+	entry.Data = data
+	return nil
+}
@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestHook(t *testing.T) {
+	ctx := With(context.Background(), FieldPhase, "operating")
+	ctx = With(ctx, FieldIteration, "0a1b2c3d")
+	ctx = With(ctx, FieldContainerName, "web")
+	tests := []struct {
+		name string
+		log  func(logger *logrus.Logger)
+		want map[string]interface{}
+	}{
+		{
+			name: "context fields",
+			log: func(logger *logrus.Logger) {
+				logger.WithContext(ctx).Info("updating")
+			},
+			want: map[string]interface{}{
+				"level": "info", "msg": "updating", "phase": "operating", "iteration": "0a1b2c3d", "container": "web",
+			},
+		},
+		{
+			name: "explicit fields kept",
+			log: func(logger *logrus.Logger) {
+				logger.WithContext(ctx).WithField("container", "api").WithError(context.Canceled).Error("failed")
+			},
+			want: map[string]interface{}{
+				"level": "error", "msg": "failed", "phase": "operating", "iteration": "0a1b2c3d", "container": "api",
+				"error": "context canceled",
+			},
+		},
+		{
+			name: "no context",
+			log: func(logger *logrus.Logger) {
+				logger.Warn("starting")
+			},
+			want: map[string]interface{}{"level": "warning", "msg": "starting"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			logger := logrus.New()
+			logger.SetOutput(&out)
+			logger.SetFormatter(&logrus.JSONFormatter{DisableTimestamp: true})
+			logger.AddHook(Hook{})
+			tt.log(logger)
+
+			var got map[string]interface{}
+			if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+				t.Fatalf("log line %s is not json: %v", out.String(), err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("log line = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHook_sharedData(t *testing.T) {
+	logger := logrus.New()
+	logger.SetOutput(&bytes.Buffer{})
+	logger.AddHook(Hook{})
+	entry := logger.WithField("a", "1")
+	entry.WithContext(With(context.Background(), FieldHost, "prod")).Info("line")
+	if _, ok := entry.Data[string(FieldHost)]; ok {
+		t.Errorf("Fire() modified the data of the parent entry: %v", entry.Data)
+	}
+}
+
+func TestFields(t *testing.T) {
+	ctx := With(context.Background(), FieldTemplate, "traefik/router")
+	// Plain string keys are different keys
+	ctx = context.WithValue(ctx, "host", "prod") //nolint:staticcheck
+	want := logrus.Fields{"template": "traefik/router"}
+	if got := Fields(ctx); !reflect.DeepEqual(got, want) {
+		t.Errorf("Fields() = %v, want %v", got, want)
+	}
+}
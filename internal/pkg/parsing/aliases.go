@@ -0,0 +1,136 @@
+package parsing
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+// argumentReferencePrefix marks an argument value in an alias that should be
+// forwarded from the arguments the alias was called with
+const argumentReferencePrefix = "$"
+
+// Aliases is a collection of aliases by name
+type Aliases map[string]Alias
+
+// Alias is a named instruction that expands into a chain of other instructions
+//
+// Argument values on the form "$name" are replaced with the argument "name"
+// the alias was called with, ex. "traefik(domain: $domain) | backup()"
+type Alias struct {
+	calls []call
+}
+
+// NewAlias parses an instruction into an alias
+func NewAlias(instruction string) (Alias, error) {
+	calls, err := parseInstruction(instruction)
+	if err != nil {
+		return Alias{}, err
+	}
+	return Alias{calls: calls}, nil
+}
+
+// LoadAliasesFromPath loads all aliases in the given path
+//
+// Aliases are named after their path relative to the given path, without the extension,
+// ex. "stacks/webapp.alias" is named "stacks/webapp"
+func LoadAliasesFromPath(ctx context.Context, path, extension string) (Aliases, error) {
+	instructions, err := ReadAliasesFromPath(ctx, path, extension)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAliases(ctx, instructions), nil
+}
+
+// ReadAliasesFromPath reads the instructions of all aliases in the given path, by name
+//
+// Aliases are named as by LoadAliasesFromPath
+func ReadAliasesFromPath(_ context.Context, path, extension string) (map[string]string, error) {
+	instructions := make(map[string]string)
+	err := filepath.Walk(path,
+		func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(info.Name(), extension) {
+				return nil
+			}
+			relativePath, err := filepath.Rel(path, filePath)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadFile(filePath) //nolint:gosec
+			if err != nil {
+				return errors.Wrapf(err, "failed to read alias %s", filePath)
+			}
+			name := filepath.ToSlash(strings.TrimSuffix(relativePath, extension))
+			instructions[name] = strings.TrimSpace(string(content))
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while processing aliases in %s", path)
+	}
+	return instructions, nil
+}
+
+// ParseAliases parses the instructions of aliases by name
+//
+// Aliases that fail to parse are left out with a warning
+func ParseAliases(ctx context.Context, instructions map[string]string) Aliases {
+	aliases := make(Aliases, len(instructions))
+	for name, instruction := range instructions {
+		alias, err := NewAlias(instruction)
+		if err != nil {
+			logrus.WithContext(ctx).WithError(err).Warnf("failed to parse alias %s, this alias will not be loaded", name)
+			continue
+		}
+		aliases[name] = alias
+	}
+	return aliases
+}
+
+// bind returns the calls of the alias with all argument references replaced
+func (a Alias) bind(name string, arguments map[string]string) ([]call, error) {
+	calls := make([]call, len(a.calls))
+	for i, c := range a.calls {
+		bound := call{template: c.template}
+		var err error
+		bound.arguments, err = bindArguments(name, c.arguments, arguments)
+		if err != nil {
+			return nil, err
+		}
+		for _, cond := range c.conditions {
+			boundCondition, err := cond.bind(name, arguments)
+			if err != nil {
+				return nil, err
+			}
+			bound.conditions = append(bound.conditions, boundCondition)
+		}
+		calls[i] = bound
+	}
+	return calls, nil
+}
+
+// bindArguments returns a copy of values with all argument references replaced
+func bindArguments(name string, values, arguments map[string]string) (map[string]string, error) {
+	bound := make(map[string]string, len(values))
+	for key, value := range values {
+		if strings.HasPrefix(value, argumentReferencePrefix) {
+			reference := strings.TrimPrefix(value, argumentReferencePrefix)
+			forwarded, ok := arguments[reference]
+			if !ok {
+				return nil, fmt.Errorf("alias %s requires argument %s", name, reference)
+			}
+			value = forwarded
+		}
+		bound[key] = value
+	}
+	return bound, nil
+}
@@ -0,0 +1,79 @@
+package parsing
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"sidus.io/discriminator/internal/pkg/templates"
+)
+
+const (
+	conditionKeyword = "when"
+
+	// conditionLabel holds if the container has the label, ex. "label: env" or "label: env=prod"
+	conditionLabel = "label"
+	// conditionName holds if the container name matches the pattern, ex. "name: web-*"
+	conditionName = "name"
+)
+
+var conditionRegex = regexp.MustCompile(`^\s*` + conditionKeyword + `\(([^\(\)]*)\)(.*)$`)
+
+// condition is a set of requirements that all have to hold for a call to be made
+type condition map[string]string
+
+// parseConditions splits leading conditions on the form "when(label: env=prod)" from a call
+//
+// Returns the conditions and the rest of the call
+func parseConditions(s string) ([]condition, string, error) {
+	var conditions []condition
+	for {
+		match := conditionRegex.FindStringSubmatch(s)
+		if match == nil || strings.TrimSpace(match[2]) == "" {
+			return conditions, s, nil
+		}
+		_, arguments, err := parse(conditionKeyword + "(" + match[1] + ")")
+		if err != nil {
+			return nil, "", err
+		}
+		for key := range arguments {
+			if key != conditionLabel && key != conditionName {
+				return nil, "", fmt.Errorf("unknown condition %s in \"%s\"", key, s)
+			}
+		}
+		conditions = append(conditions, arguments)
+		s = match[2]
+	}
+}
+
+// holds checks if all requirements of the condition hold for the container
+func (c condition) holds(data templates.ContainerData) (bool, error) {
+	for key, value := range c {
+		switch key {
+		case conditionLabel:
+			parts := strings.SplitN(value, "=", 2)
+			actual, ok := data.Labels[parts[0]]
+			if !ok || (len(parts) == 2 && actual != parts[1]) {
+				return false, nil
+			}
+		case conditionName:
+			matched, err := path.Match(value, strings.TrimPrefix(data.Name, "/"))
+			if err != nil {
+				return false, fmt.Errorf("invalid name pattern %s", value)
+			}
+			if !matched {
+				return false, nil
+			}
+		default:
+			return false, fmt.Errorf("unknown condition %s", key)
+		}
+	}
+	return true, nil
+}
+
+// bind returns a copy of the condition with argument references replaced
+func (c condition) bind(name string, arguments map[string]string) (condition, error) {
+	bound, err := bindArguments(name, c, arguments)
+	return condition(bound), err
+}
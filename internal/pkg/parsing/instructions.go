@@ -0,0 +1,31 @@
+package parsing
+
+import (
+	"sort"
+	"strings"
+)
+
+// CollectInstruction joins the instructions found in the given label and all labels
+// suffixed from it, ex. "io.sidus.discriminator.10-base", in sorted order of the label keys.
+//
+// Returns false if none of the labels are present
+func CollectInstruction(labels map[string]string, label string) (string, bool) {
+	var keys []string
+	for key := range labels {
+		if key == label || strings.HasPrefix(key, label+".") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return "", false
+	}
+	sort.Strings(keys)
+
+	instructions := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if instruction := strings.TrimSpace(labels[key]); instruction != "" {
+			instructions = append(instructions, instruction)
+		}
+	}
+	return strings.Join(instructions, " | "), true
+}
@@ -11,7 +11,9 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"sidus.io/discriminator/internal/pkg/labels"
+	"sidus.io/discriminator/internal/pkg/logging"
 	"sidus.io/discriminator/internal/pkg/templates"
+	"sidus.io/discriminator/internal/pkg/tracing"
 )
 
 var (
@@ -20,52 +22,155 @@ var (
 	invalidFormatErrorF = "input \"%s\" does not follow the expected format"
 )
 
+// maxAliasDepth is the maximum number of nested alias expansions
+const maxAliasDepth = 16
+
 // Parser provides functionality to parse input labels to a set of modifiers,
 // provided the necessary templates
 type Parser struct {
 	templateDirectory TemplateDirectory
+	aliases           Aliases
+}
+
+// call is a single template or alias call in an instruction
+type call struct {
+	template   string
+	arguments  map[string]string
+	conditions []condition
 }
 
 // NewParser creates a new parser
-func NewParser(_ context.Context, templateDirectory TemplateDirectory) (Parser, error) {
-	return Parser{templateDirectory: templateDirectory}, nil
+//
+// Aliases take precedence over templates with the same name
+func NewParser(_ context.Context, templateDirectory TemplateDirectory, aliases Aliases) (Parser, error) {
+	return Parser{templateDirectory: templateDirectory, aliases: aliases}, nil
 }
 
 // Process parses a string, calls the necessary templates and returns a list of modifiers.
 //
 // Provided input string should be on the form "templateName(parameter: value, p:v) | otherTemplate()"
-// with an arbitrary number of template calls and arguments
+// with an arbitrary number of template calls and arguments.
+// Calls to aliases are expanded recursively.
+// A call can be prefixed with conditions, ex. "when(label: env=prod) templateName()",
+// and is then only made if all conditions hold for the container.
 func (p Parser) Process(ctx context.Context, s string, data templates.ContainerData) (labels.Modifiers, error) {
-	// make sure the input is valid before further processing
-	if !validatorRegex.Match([]byte(s)) {
-		return nil, fmt.Errorf(invalidFormatErrorF, s)
-	}
 	logrus.WithContext(ctx).Debugf("Processing %s", s)
+	calls, err := parseInstruction(s)
+	if err != nil {
+		return nil, err
+	}
+	return p.processCalls(ctx, calls, data, nil)
+}
 
-	// one template call at a time
-	parts := strings.Split(s, "|")
+// processCalls calls the templates in order, expanding aliases
+//
+// expanding holds the aliases currently being expanded and is used to detect cycles
+func (p Parser) processCalls(
+	ctx context.Context,
+	calls []call,
+	data templates.ContainerData,
+	expanding []string,
+) (labels.Modifiers, error) {
 	var modifiers labels.Modifiers
-	for _, part := range parts {
-		logrus.WithContext(ctx).Debugf("Processing %s", part)
-		// Parse out arguments and template name
-		template, arguments, err := parse(part)
+	for _, c := range calls {
+		ctx := logging.With(ctx, logging.FieldTemplate, c.template)
+		ok, err := conditionsHold(c.conditions, data)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse \"%s\"", part)
+			return nil, errors.Wrapf(err, "failed to evaluate conditions for %s", c.template)
+		}
+		if !ok {
+			logrus.WithContext(ctx).Debugf("Skipping %s, conditions not met", c.template)
+			continue
+		}
+		if alias, ok := p.aliases[c.template]; ok {
+			expanded, err := p.expandAlias(ctx, c, alias, data, expanding)
+			if err != nil {
+				return nil, err
+			}
+			modifiers = append(modifiers, expanded...)
+			continue
 		}
 
 		// Parse the template for modifiers
-		modifier, err := p.templateDirectory.GetModifiers(ctx, template, templates.Data{
+		ctx, span := tracing.Start(ctx, "template", "template", c.template)
+		modifier, err := p.templateDirectory.GetModifiers(ctx, c.template, templates.Data{
 			ContainerData: data,
-			Arguments:     arguments,
+			Arguments:     c.arguments,
 		})
+		span.End(err)
 		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse template %s", template)
+			return nil, errors.Wrapf(err, "failed to parse template %s", c.template)
 		}
+		modifier.Template = c.template
 		modifiers = append(modifiers, modifier)
 	}
 	return modifiers, nil
 }
 
+// expandAlias processes the calls an alias expands into
+func (p Parser) expandAlias(
+	ctx context.Context,
+	c call,
+	alias Alias,
+	data templates.ContainerData,
+	expanding []string,
+) (labels.Modifiers, error) {
+	for _, name := range expanding {
+		if name == c.template {
+			return nil, fmt.Errorf("alias cycle detected: %s -> %s", strings.Join(expanding, " -> "), c.template)
+		}
+	}
+	if len(expanding) >= maxAliasDepth {
+		return nil, fmt.Errorf("alias %s exceeds the maximum depth of %d nested aliases", c.template, maxAliasDepth)
+	}
+	logrus.WithContext(ctx).Debugf("Expanding alias %s", c.template)
+	calls, err := alias.bind(c.template, c.arguments)
+	if err != nil {
+		return nil, err
+	}
+	// Copy to make sure sibling expansions don't share the backing array
+	nested := append(append([]string{}, expanding...), c.template)
+	modifiers, err := p.processCalls(ctx, calls, data, nested)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to expand alias %s", c.template)
+	}
+	return modifiers, nil
+}
+
+// conditionsHold checks if all conditions hold for the container
+func conditionsHold(conditions []condition, data templates.ContainerData) (bool, error) {
+	for _, cond := range conditions {
+		ok, err := cond.holds(data)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// parseInstruction splits an instruction into its calls
+func parseInstruction(s string) ([]call, error) {
+	// one template call at a time, every call is validated when parsed
+	parts := strings.Split(s, "|")
+	calls := make([]call, 0, len(parts))
+	for _, part := range parts {
+		conditions, rest, err := parseConditions(part)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse \"%s\"", part)
+		}
+		// Parse out arguments and template name
+		template, arguments, err := parse(rest)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse \"%s\"", part)
+		}
+		if template == conditionKeyword {
+			return nil, fmt.Errorf("condition without a call in \"%s\"", part)
+		}
+		calls = append(calls, call{template: template, arguments: arguments, conditions: conditions})
+	}
+	return calls, nil
+}
+
 func parse(s string) (string, map[string]string, error) {
 	// Make sure the input is valid before further processing
 	if !validatorRegex.Match([]byte(s)) {
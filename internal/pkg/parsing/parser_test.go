@@ -1,8 +1,14 @@
 package parsing
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"sidus.io/discriminator/internal/pkg/labels"
+	"sidus.io/discriminator/internal/pkg/templates"
 )
 
 func Test_parse(t *testing.T) {
@@ -63,3 +69,179 @@ func Test_parse(t *testing.T) {
 		})
 	}
 }
+
+// echoDirectory is a template directory where every template adds a label
+// with the template name and the arguments it was called with
+type echoDirectory struct{}
+
+func (echoDirectory) GetModifiers(ctx context.Context, name string, data templates.Data) (labels.Modifier, error) {
+	return labels.NewModifier(ctx, strings.NewReader(fmt.Sprintf("+%s=%v", name, data.Arguments)))
+}
+
+func TestParser_Process(t *testing.T) {
+	aliases := map[string]string{
+		"webapp":  "traefik(domain: $domain) | prometheus(port: 9100) | backup()",
+		"stack":   "webapp(domain: $host)",
+		"missing": "traefik(domain: $domain)",
+		"loop":    "backup() | loop2()",
+		"loop2":   "loop()",
+	}
+	tests := []struct {
+		name        string
+		instruction string
+		want        map[string]string
+		wantErr     bool
+	}{
+		{
+			name:        "template only",
+			instruction: "traefik(domain: a)",
+			want:        map[string]string{"traefik": "map[domain:a]"},
+		},
+		{
+			name:        "alias forwards arguments",
+			instruction: "webapp(domain: a)",
+			want: map[string]string{
+				"traefik":    "map[domain:a]",
+				"prometheus": "map[port:9100]",
+				"backup":     "map[]",
+			},
+		},
+		{
+			name:        "nested alias",
+			instruction: "stack(host: b) | other()",
+			want: map[string]string{
+				"traefik":    "map[domain:b]",
+				"prometheus": "map[port:9100]",
+				"backup":     "map[]",
+				"other":      "map[]",
+			},
+		},
+		{
+			name:        "condition holds",
+			instruction: "when(label: env=prod) traefik(domain: a) | when(name: web-*) backup()",
+			want: map[string]string{
+				"traefik": "map[domain:a]",
+				"backup":  "map[]",
+			},
+		},
+		{
+			name:        "condition does not hold",
+			instruction: "when(label: env=dev) traefik(domain: a) | when(label: env, name: db) backup() | other()",
+			want:        map[string]string{"other": "map[]"},
+		},
+		{
+			name:        "multiple conditions",
+			instruction: "when(label: env) when(label: missing) webapp(domain: a) | other()",
+			want:        map[string]string{"other": "map[]"},
+		},
+		{
+			name:        "unknown condition",
+			instruction: "when(image: x) traefik()",
+			wantErr:     true,
+		},
+		{
+			name:        "condition without call",
+			instruction: "when(label: env)",
+			wantErr:     true,
+		},
+		{
+			name:        "missing forwarded argument",
+			instruction: "missing()",
+			wantErr:     true,
+		},
+		{
+			name:        "cycle",
+			instruction: "loop()",
+			wantErr:     true,
+		},
+	}
+
+	parsed := make(Aliases)
+	for name, instruction := range aliases {
+		alias, err := NewAlias(instruction)
+		if err != nil {
+			t.Fatalf("NewAlias(%s) error = %v", instruction, err)
+		}
+		parsed[name] = alias
+	}
+	p, err := NewParser(context.Background(), echoDirectory{}, parsed)
+	if err != nil {
+		t.Fatalf("NewParser() error = %v", err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modifiers, err := p.Process(context.Background(), tt.instruction, templates.ContainerData{
+				Labels: map[string]string{"env": "prod"},
+				Name:   "/web-1",
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Process() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got := map[string]string{}
+			modifiers.Apply(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Process() labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParser_Process_depth(t *testing.T) {
+	aliases := make(Aliases)
+	for i := 0; i <= maxAliasDepth; i++ {
+		alias, err := NewAlias(fmt.Sprintf("a%d()", i+1))
+		if err != nil {
+			t.Fatalf("NewAlias() error = %v", err)
+		}
+		aliases[fmt.Sprintf("a%d", i)] = alias
+	}
+	p, _ := NewParser(context.Background(), echoDirectory{}, aliases)
+	if _, err := p.Process(context.Background(), "a0()", templates.ContainerData{}); err == nil {
+		t.Errorf("Process() expected error when exceeding the maximum alias depth")
+	}
+}
+
+func TestCollectInstruction(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+		wantOk bool
+	}{
+		{
+			name:   "no instruction",
+			labels: map[string]string{"other": "a()"},
+			wantOk: false,
+		},
+		{
+			name:   "single label",
+			labels: map[string]string{"label": "a()"},
+			want:   "a()",
+			wantOk: true,
+		},
+		{
+			name: "sorted suffixes",
+			labels: map[string]string{
+				"label.20-extra": "c()",
+				"label":          "a()",
+				"label.10-base":  "b()",
+				"label.15-empty": " ",
+				"labels":         "d()",
+			},
+			want:   "a() | b() | c()",
+			wantOk: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := CollectInstruction(tt.labels, "label")
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("CollectInstruction() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
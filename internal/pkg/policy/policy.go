@@ -0,0 +1,172 @@
+// Package policy restricts which labels templates are allowed to change
+package policy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"sidus.io/discriminator/internal/pkg/labels"
+)
+
+// Policy decides which labels the modifiers of templates may change
+//
+// Patterns are label keys or template names, a pattern ending with "*" matches everything starting with the rest,
+// ex. "com.docker.compose.*"
+type Policy struct {
+	protected  []string
+	namespaces []namespace
+}
+
+// namespace restricts the templates matching the pattern to the keys matching any of the key patterns
+type namespace struct {
+	template string
+	keys     []string
+}
+
+// Violation is a change to a label a template wasn't allowed to make
+type Violation struct {
+	Template string `json:"template"`
+	Key      string `json:"key"`
+	Reason   string `json:"reason"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("template %s may not change %s: %s", v.Template, v.Key, v.Reason)
+}
+
+// NewPolicy creates a policy
+//
+// Protected labels can never be changed. Namespaces map template patterns to the label key patterns
+// the templates may change, templates not matching any namespace may change every label that isn't protected.
+func NewPolicy(_ context.Context, protected []string, namespaces map[string][]string) (*Policy, error) {
+	p := &Policy{protected: protected}
+	for _, pattern := range protected {
+		if err := validatePattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for template, keys := range namespaces {
+		if err := validatePattern(template); err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			if err := validatePattern(key); err != nil {
+				return nil, err
+			}
+		}
+		p.namespaces = append(p.namespaces, namespace{template: template, keys: keys})
+	}
+	// The most specific pattern is used when several namespaces match a template
+	sort.Slice(p.namespaces, func(i, j int) bool {
+		a, b := p.namespaces[i].template, p.namespaces[j].template
+		if len(a) != len(b) {
+			return len(a) > len(b)
+		}
+		return a < b
+	})
+	return p, nil
+}
+
+// ParseNamespaces parses namespaces on the form "template=pattern,pattern", ex. "traefik/*=traefik.*"
+func ParseNamespaces(entries []string) (map[string][]string, error) {
+	namespaces := make(map[string][]string, len(entries))
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("namespace %s is not on the form template=pattern,pattern", entry)
+		}
+		template := strings.TrimSpace(parts[0])
+		for _, key := range strings.Split(parts[1], ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				namespaces[template] = append(namespaces[template], key)
+			}
+		}
+	}
+	return namespaces, nil
+}
+
+// Apply applies the modifiers to the labels in order
+//
+// Changes the policy doesn't allow are left out and returned as violations.
+// A nil policy allows everything
+func (p *Policy) Apply(current map[string]string, modifiers labels.Modifiers) []Violation {
+	if p == nil {
+		modifiers.Apply(current)
+		return nil
+	}
+	var violations []Violation
+	for _, modifier := range modifiers {
+		next := make(map[string]string, len(current))
+		for key, value := range current {
+			next[key] = value
+		}
+		modifier.Apply(next)
+		for _, key := range changedKeys(current, next) {
+			reason := p.check(modifier.Template, key)
+			if reason == "" {
+				if value, ok := next[key]; ok {
+					current[key] = value
+				} else {
+					delete(current, key)
+				}
+				continue
+			}
+			violations = append(violations, Violation{Template: modifier.Template, Key: key, Reason: reason})
+		}
+	}
+	return violations
+}
+
+// check returns why the template may not change the key, or an empty string if it may
+func (p *Policy) check(template, key string) string {
+	for _, pattern := range p.protected {
+		if matches(pattern, key) {
+			return fmt.Sprintf("the label is protected by %s", pattern)
+		}
+	}
+	for _, n := range p.namespaces {
+		if !matches(n.template, template) {
+			continue
+		}
+		for _, pattern := range n.keys {
+			if matches(pattern, key) {
+				return ""
+			}
+		}
+		return fmt.Sprintf("the template is restricted to %s", strings.Join(n.keys, ", "))
+	}
+	return ""
+}
+
+// changedKeys returns the sorted keys that are added, removed or changed going from a to b
+func changedKeys(a, b map[string]string) []string {
+	var keys []string
+	for key, value := range b {
+		if old, ok := a[key]; !ok || old != value {
+			keys = append(keys, key)
+		}
+	}
+	for key := range a {
+		if _, ok := b[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func matches(pattern, s string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == s
+}
+
+func validatePattern(pattern string) error {
+	if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+		return fmt.Errorf("invalid pattern %q, only a trailing * is supported", pattern)
+	}
+	return nil
+}
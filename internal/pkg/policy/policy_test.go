@@ -0,0 +1,151 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/labels"
+)
+
+func modifier(t *testing.T, template, text string) labels.Modifier {
+	t.Helper()
+	m, err := labels.NewModifier(context.Background(), bytes.NewReader([]byte(text)))
+	if err != nil {
+		t.Fatalf("NewModifier() error = %v", err)
+	}
+	m.Template = template
+	return m
+}
+
+func TestPolicy_Apply(t *testing.T) {
+	p, err := NewPolicy(
+		context.Background(),
+		[]string{"com.docker.compose.*", "instruction"},
+		map[string][]string{
+			"traefik/*":      {"traefik.*"},
+			"traefik/router": {"traefik.http.*", "router"},
+		},
+	)
+	if err != nil {
+		t.Fatalf("NewPolicy() error = %v", err)
+	}
+	tests := []struct {
+		name           string
+		policy         *Policy
+		labels         map[string]string
+		modifiers      func(t *testing.T) labels.Modifiers
+		want           map[string]string
+		wantViolations []Violation
+	}{
+		{
+			name:   "protected",
+			policy: p,
+			labels: map[string]string{"com.docker.compose.project": "app", "instruction": "x()"},
+			modifiers: func(t *testing.T) labels.Modifiers {
+				return labels.Modifiers{modifier(t, "x", "-com.docker.compose.project\n-instruction\n+a=1")}
+			},
+			want: map[string]string{"com.docker.compose.project": "app", "instruction": "x()", "a": "1"},
+			wantViolations: []Violation{
+				{Template: "x", Key: "com.docker.compose.project", Reason: "the label is protected by com.docker.compose.*"},
+				{Template: "x", Key: "instruction", Reason: "the label is protected by instruction"},
+			},
+		},
+		{
+			name:   "unchanged protected label",
+			policy: p,
+			labels: map[string]string{"instruction": "x()"},
+			modifiers: func(t *testing.T) labels.Modifiers {
+				return labels.Modifiers{modifier(t, "x", "+instruction=x()")}
+			},
+			want: map[string]string{"instruction": "x()"},
+		},
+		{
+			name:   "namespaces",
+			policy: p,
+			labels: map[string]string{},
+			modifiers: func(t *testing.T) labels.Modifiers {
+				return labels.Modifiers{
+					modifier(t, "traefik/service", "+traefik.port=80\n+other=1"),
+					modifier(t, "traefik/router", "+traefik.http.rule=x\n+router=1\n+traefik.enable=true"),
+				}
+			},
+			want: map[string]string{"traefik.port": "80", "traefik.http.rule": "x", "router": "1"},
+			wantViolations: []Violation{
+				{Template: "traefik/service", Key: "other", Reason: "the template is restricted to traefik.*"},
+				{
+					Template: "traefik/router",
+					Key:      "traefik.enable",
+					Reason:   "the template is restricted to traefik.http.*, router",
+				},
+			},
+		},
+		{
+			name:   "applied in order",
+			policy: p,
+			labels: map[string]string{},
+			modifiers: func(t *testing.T) labels.Modifiers {
+				return labels.Modifiers{modifier(t, "a", "+a=1"), modifier(t, "b", "-a\n+b=2")}
+			},
+			want: map[string]string{"b": "2"},
+		},
+		{
+			name:   "no policy",
+			labels: map[string]string{"instruction": "x()"},
+			modifiers: func(t *testing.T) labels.Modifiers {
+				return labels.Modifiers{modifier(t, "x", "-instruction")}
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			violations := tt.policy.Apply(tt.labels, tt.modifiers(t))
+			if !reflect.DeepEqual(tt.labels, tt.want) {
+				t.Errorf("Apply() labels = %v, want %v", tt.labels, tt.want)
+			}
+			if !reflect.DeepEqual(violations, tt.wantViolations) {
+				t.Errorf("Apply() violations = %v, want %v", violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestParseNamespaces(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    map[string][]string
+		wantErr bool
+	}{
+		{
+			name:    "namespaces",
+			entries: []string{"traefik/*=traefik.*", "prometheus = prometheus.*, metrics"},
+			want:    map[string][]string{"traefik/*": {"traefik.*"}, "prometheus": {"prometheus.*", "metrics"}},
+		},
+		{
+			name:    "missing keys",
+			entries: []string{"traefik/*"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNamespaces(tt.entries)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseNamespaces() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseNamespaces() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	_, err := NewPolicy(context.Background(), []string{"com.*.project"}, nil)
+	if err == nil {
+		t.Errorf("NewPolicy() expected error for pattern with a * in the middle")
+	}
+}
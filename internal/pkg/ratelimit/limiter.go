@@ -0,0 +1,102 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Options configures a Limiter, zero values disable the respective limit
+type Options struct {
+	// MaxPerIteration is the max number of recreations in one iteration
+	MaxPerIteration int
+	// MaxPerHour is the max number of recreations within any hour
+	MaxPerHour int
+	// MinInterval is the minimum time between recreations of the same container
+	MinInterval time.Duration
+	// Windows are the maintenance windows recreations are limited to, if any
+	Windows []Window
+}
+
+// Limiter decides if containers can be recreated based on the recreations made before
+type Limiter struct {
+	mu        sync.Mutex
+	options   Options
+	iteration int
+	// recent holds the times of the recreations within the last hour
+	recent []time.Time
+	// last holds the time of the last recreation per container name
+	last map[string]time.Time
+}
+
+// NewLimiter creates a limiter without any recorded recreations
+func NewLimiter(_ context.Context, options Options) (*Limiter, error) {
+	return &Limiter{
+		options: options,
+		last:    make(map[string]time.Time),
+	}, nil
+}
+
+// StartIteration resets the number of recreations in the current iteration
+func (l *Limiter) StartIteration() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.iteration = 0
+}
+
+// Allow returns an error describing why the container can't be recreated at the time, nil if it can
+func (l *Limiter) Allow(now time.Time, name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	if len(l.options.Windows) > 0 && !l.inWindow(now) {
+		return fmt.Errorf("outside of maintenance windows")
+	}
+	if l.options.MaxPerIteration > 0 && l.iteration >= l.options.MaxPerIteration {
+		return fmt.Errorf("limit of %d recreations per iteration reached", l.options.MaxPerIteration)
+	}
+	if l.options.MaxPerHour > 0 && len(l.recent) >= l.options.MaxPerHour {
+		return fmt.Errorf("limit of %d recreations per hour reached", l.options.MaxPerHour)
+	}
+	if last, ok := l.last[name]; ok && l.options.MinInterval > 0 && now.Sub(last) < l.options.MinInterval {
+		return fmt.Errorf(
+			"container was recreated %s ago, minimum interval is %s", now.Sub(last).Round(time.Second), l.options.MinInterval,
+		)
+	}
+	return nil
+}
+
+// Record records a recreation of the container at the time
+func (l *Limiter) Record(now time.Time, name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.iteration++
+	l.recent = append(l.recent, now)
+	l.last[name] = now
+	l.prune(now)
+}
+
+// prune forgets recreations that no longer affect any limit
+func (l *Limiter) prune(now time.Time) {
+	i := 0
+	for i < len(l.recent) && now.Sub(l.recent[i]) >= time.Hour {
+		i++
+	}
+	l.recent = l.recent[i:]
+	for name, last := range l.last {
+		if now.Sub(last) >= l.options.MinInterval {
+			delete(l.last, name)
+		}
+	}
+}
+
+func (l *Limiter) inWindow(now time.Time) bool {
+	for _, window := range l.options.Windows {
+		if window.Contains(now) {
+			return true
+		}
+	}
+	return false
+}
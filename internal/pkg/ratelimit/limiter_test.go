@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	start := time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC)
+	type recreation struct {
+		after time.Duration
+		name  string
+		// newIteration starts a new iteration before the recreation
+		newIteration bool
+	}
+	tests := []struct {
+		name        string
+		options     Options
+		recreations []recreation
+		after       time.Duration
+		container   string
+		wantErr     bool
+	}{
+		{
+			name:        "no limits",
+			recreations: []recreation{{0, "a", false}, {0, "a", false}, {0, "b", false}},
+			container:   "a",
+		},
+		{
+			name:        "per iteration",
+			options:     Options{MaxPerIteration: 2},
+			recreations: []recreation{{0, "a", false}, {0, "b", false}},
+			container:   "c",
+			wantErr:     true,
+		},
+		{
+			name:        "per iteration reset",
+			options:     Options{MaxPerIteration: 2},
+			recreations: []recreation{{0, "a", false}, {0, "b", false}, {time.Minute, "c", true}},
+			container:   "d",
+		},
+		{
+			name:        "per hour",
+			options:     Options{MaxPerHour: 2},
+			recreations: []recreation{{0, "a", true}, {30 * time.Minute, "b", true}},
+			after:       59 * time.Minute,
+			container:   "c",
+			wantErr:     true,
+		},
+		{
+			name:        "per hour expired",
+			options:     Options{MaxPerHour: 2},
+			recreations: []recreation{{0, "a", true}, {30 * time.Minute, "b", true}},
+			after:       time.Hour,
+			container:   "c",
+		},
+		{
+			name:        "min interval",
+			options:     Options{MinInterval: time.Hour},
+			recreations: []recreation{{0, "a", false}},
+			after:       30 * time.Minute,
+			container:   "a",
+			wantErr:     true,
+		},
+		{
+			name:        "min interval other container",
+			options:     Options{MinInterval: time.Hour},
+			recreations: []recreation{{0, "a", false}},
+			after:       30 * time.Minute,
+			container:   "b",
+		},
+		{
+			name:        "min interval passed",
+			options:     Options{MinInterval: time.Hour},
+			recreations: []recreation{{0, "a", false}},
+			after:       time.Hour,
+			container:   "a",
+		},
+		{
+			name:      "in window",
+			options:   Options{Windows: []Window{mustParseWindow(t, "0 2 * * * 1h")}},
+			after:     30 * time.Minute,
+			container: "a",
+		},
+		{
+			name:      "outside window",
+			options:   Options{Windows: []Window{mustParseWindow(t, "0 2 * * * 1h")}},
+			after:     time.Hour,
+			container: "a",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLimiter(context.Background(), tt.options)
+			if err != nil {
+				t.Fatalf("NewLimiter() error = %v", err)
+			}
+			l.StartIteration()
+			for _, r := range tt.recreations {
+				if r.newIteration {
+					l.StartIteration()
+				}
+				l.Record(start.Add(r.after), r.name)
+			}
+			err = l.Allow(start.Add(tt.after), tt.container)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Allow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustParseWindow(t *testing.T, s string) Window {
+	w, err := ParseWindow(s)
+	if err != nil {
+		t.Fatalf("ParseWindow() error = %v", err)
+	}
+	return w
+}
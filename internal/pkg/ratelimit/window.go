@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Window is a recurring period of time that starts at every time matching
+// a cron expression and lasts for a duration
+type Window struct {
+	minutes  field
+	hours    field
+	days     field
+	months   field
+	weekdays field
+	duration time.Duration
+	// restrictedDays and restrictedWeekdays follow cron in matching days on either
+	// day of month or weekday when both are restricted
+	restrictedDays     bool
+	restrictedWeekdays bool
+}
+
+// field is a set of allowed values of a cron field as a bit mask
+type field uint64
+
+// ParseWindow parses a window on the form "<minute> <hour> <day of month> <month> <day of week> <duration>",
+// ex. "0 2 * * 6 4h" for four hours from two in the morning every saturday.
+//
+// The cron fields support "*", values, ranges, lists and steps, ex. "1-5", "0,30" and "*/15".
+// Days of week are 0-6 starting on sunday, 7 is also sunday.
+func ParseWindow(s string) (Window, error) {
+	parts := strings.Fields(s)
+	if len(parts) != 6 {
+		return Window{}, fmt.Errorf("window %s should have five cron fields and a duration", s)
+	}
+	var w Window
+	var err error
+	fields := []struct {
+		target   *field
+		min, max int
+	}{
+		{&w.minutes, 0, 59},
+		{&w.hours, 0, 23},
+		{&w.days, 1, 31},
+		{&w.months, 1, 12},
+		{&w.weekdays, 0, 7},
+	}
+	for i, f := range fields {
+		*f.target, err = parseField(parts[i], f.min, f.max)
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid window %s: %v", s, err)
+		}
+	}
+	if w.weekdays&(1<<7) != 0 {
+		w.weekdays |= 1
+	}
+	w.restrictedDays = parts[2] != "*"
+	w.restrictedWeekdays = parts[4] != "*"
+
+	w.duration, err = time.ParseDuration(parts[5])
+	if err != nil || w.duration <= 0 {
+		return Window{}, fmt.Errorf("invalid duration %s in window %s", parts[5], s)
+	}
+	return w, nil
+}
+
+// Contains checks if the time is within the window
+func (w Window) Contains(t time.Time) bool {
+	start := t.Truncate(time.Minute)
+	for offset := time.Duration(0); offset < w.duration; offset += time.Minute {
+		if w.matches(start.Add(-offset)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches checks if the window starts at the minute of the time
+func (w Window) matches(t time.Time) bool {
+	if !w.minutes.has(t.Minute()) || !w.hours.has(t.Hour()) || !w.months.has(int(t.Month())) {
+		return false
+	}
+	day, weekday := w.days.has(t.Day()), w.weekdays.has(int(t.Weekday()))
+	if w.restrictedDays && w.restrictedWeekdays {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+func (f field) has(value int) bool {
+	return f&(1<<uint(value)) != 0
+}
+
+// parseField parses a comma separated list of values, ranges and steps within min and max
+func parseField(s string, min, max int) (field, error) {
+	var f field
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step in %s", part)
+			}
+			part = part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			from, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %s", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %s", part)
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for value := from; value <= to; value += step {
+			f |= 1 << uint(value)
+		}
+	}
+	return f, nil
+}
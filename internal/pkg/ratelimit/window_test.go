@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow_Contains(t *testing.T) {
+	// 2020-01-04 is a saturday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2020, time.January, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		window string
+		time   time.Time
+		want   bool
+	}{
+		{name: "at start", window: "0 2 * * 6 4h", time: at(4, 2, 0), want: true},
+		{name: "within", window: "0 2 * * 6 4h", time: at(4, 5, 59), want: true},
+		{name: "at end", window: "0 2 * * 6 4h", time: at(4, 6, 0), want: false},
+		{name: "before", window: "0 2 * * 6 4h", time: at(4, 1, 59), want: false},
+		{name: "other weekday", window: "0 2 * * 6 4h", time: at(5, 3, 0), want: false},
+		{name: "sunday as 7", window: "0 2 * * 7 4h", time: at(5, 3, 0), want: true},
+		{name: "over midnight", window: "0 22 * * 5 4h", time: at(4, 1, 0), want: true},
+		{name: "weekday range", window: "0 9 * * 1-5 8h", time: at(6, 12, 0), want: true},
+		{name: "weekday range weekend", window: "0 9 * * 1-5 8h", time: at(4, 12, 0), want: false},
+		{name: "list", window: "0 1,13 * * * 1h", time: at(4, 13, 30), want: true},
+		{name: "step", window: "*/15 * * * * 5m", time: at(4, 10, 47), want: true},
+		{name: "step outside", window: "*/15 * * * * 5m", time: at(4, 10, 52), want: false},
+		{name: "day of month or weekday", window: "0 0 1 * 6 1h", time: at(4, 0, 30), want: true},
+		{name: "day of month", window: "0 0 1 * * 1h", time: at(4, 0, 30), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := ParseWindow(tt.window)
+			if err != nil {
+				t.Fatalf("ParseWindow() error = %v", err)
+			}
+			if got := w.Contains(tt.time); got != tt.want {
+				t.Errorf("Contains() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  string
+		wantErr bool
+	}{
+		{name: "valid", window: "30 2 1-15 */2 0,6 90m"},
+		{name: "missing duration", window: "0 2 * * 6", wantErr: true},
+		{name: "invalid duration", window: "0 2 * * 6 soon", wantErr: true},
+		{name: "negative duration", window: "0 2 * * 6 -1h", wantErr: true},
+		{name: "minute out of range", window: "60 2 * * 6 1h", wantErr: true},
+		{name: "day out of range", window: "0 2 0 * 6 1h", wantErr: true},
+		{name: "inverted range", window: "0 5-2 * * 6 1h", wantErr: true},
+		{name: "invalid step", window: "*/0 2 * * 6 1h", wantErr: true},
+		{name: "not a number", window: "0 two * * 6 1h", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseWindow(tt.window)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParseWindow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
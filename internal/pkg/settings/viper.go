@@ -18,14 +18,58 @@ const (
 const (
 	templatesPath      = "templates-path"
 	templatesExtension = "templates-extension"
+	aliasesExtension   = "aliases-extension"
 
 	containerLabel           = "container-label"
 	includeStoppedContainers = "include-stopped-containers"
+	maxLabelIterations       = "max-label-iterations"
+
+	instructionsEnv  = "instructions-env"
+	instructionsFile = "instructions-file"
 
 	runInterval = "run-interval"
 
+	hostsFile = "hosts-file"
+
+	apiAddress = "api-address"
+
+	auditLogPath = "audit-log-path"
+
+	dataDir = "data-dir"
+
+	retryBackoff            = "retry-backoff"
+	maxRetryBackoff         = "max-retry-backoff"
+	quarantineAfterFailures = "quarantine-after-failures"
+
+	webhooksFile       = "webhooks-file"
+	webhookQueueSize   = "webhook-queue-size"
+	webhookMaxAttempts = "webhook-max-attempts"
+
+	backupPath           = "backup-path"
+	backupRetentionCount = "backup-retention-count"
+	backupRetentionAge   = "backup-retention-age"
+
+	healthCheckTimeout = "health-check-timeout"
+	minUptime          = "min-uptime"
+
+	strategyLabel     = "strategy-label"
+	strategySelectors = "strategy-selectors"
+	defaultStrategy   = "default-strategy"
+
+	dependentsPolicy = "dependents-policy"
+
+	maxRecreationsPerIteration = "max-recreations-per-iteration"
+	maxRecreationsPerHour      = "max-recreations-per-hour"
+	minRecreationInterval      = "min-recreation-interval"
+	maintenanceWindows         = "maintenance-windows"
+
+	protectedLabels    = "protected-labels"
+	templateNamespaces = "template-namespaces"
+
 	logLevel  = "log-level"
 	logFormat = "log-format"
+
+	traceOutput = "trace-output"
 )
 
 type Settings struct {
@@ -48,14 +92,58 @@ func NewSettings(_ context.Context) (Settings, error) {
 func setDefaults(v *viper.Viper) {
 	v.SetDefault(templatesPath, "/templates")
 	v.SetDefault(templatesExtension, ".tmpl")
+	v.SetDefault(aliasesExtension, ".alias")
 
 	v.SetDefault(containerLabel, ReverseDomain+"."+AppName)
 	v.SetDefault(includeStoppedContainers, false)
+	v.SetDefault(maxLabelIterations, 10)
+
+	v.SetDefault(instructionsEnv, "")
+	v.SetDefault(instructionsFile, "")
 
 	v.SetDefault(runInterval, 5*time.Minute)
 
+	v.SetDefault(hostsFile, "")
+
+	v.SetDefault(apiAddress, "")
+
+	v.SetDefault(auditLogPath, "")
+
+	v.SetDefault(dataDir, "")
+
+	v.SetDefault(retryBackoff, 5*time.Minute)
+	v.SetDefault(maxRetryBackoff, 6*time.Hour)
+	v.SetDefault(quarantineAfterFailures, 5)
+
+	v.SetDefault(webhooksFile, "")
+	v.SetDefault(webhookQueueSize, 100)
+	v.SetDefault(webhookMaxAttempts, 3)
+
+	v.SetDefault(backupPath, "")
+	v.SetDefault(backupRetentionCount, 10)
+	v.SetDefault(backupRetentionAge, 7*24*time.Hour)
+
+	v.SetDefault(healthCheckTimeout, 2*time.Minute)
+	v.SetDefault(minUptime, 10*time.Second)
+
+	v.SetDefault(strategyLabel, ReverseDomain+"."+AppName+"-strategy")
+	v.SetDefault(strategySelectors, "")
+	v.SetDefault(defaultStrategy, "recreate")
+
+	v.SetDefault(dependentsPolicy, "recreate")
+
+	v.SetDefault(maxRecreationsPerIteration, 0)
+	v.SetDefault(maxRecreationsPerHour, 0)
+	v.SetDefault(minRecreationInterval, 0)
+	v.SetDefault(maintenanceWindows, "")
+
+	v.SetDefault(protectedLabels, "com.docker.compose.*")
+	v.SetDefault(templateNamespaces, "")
+
 	v.SetDefault(logLevel, "info")
 	v.SetDefault(logFormat, "text")
+
+	v.SetDefault(traceOutput, "")
 }
 
 func (s Settings) TemplatesPath() string {
@@ -66,6 +154,10 @@ func (s Settings) TemplatesExtension() string {
 	return s.v.GetString(templatesExtension)
 }
 
+func (s Settings) AliasesExtension() string {
+	return s.v.GetString(aliasesExtension)
+}
+
 func (s Settings) ContainerLabel() string {
 	return s.v.GetString(containerLabel)
 }
@@ -74,10 +166,169 @@ func (s Settings) IncludeStoppedContainers() bool {
 	return s.v.GetBool(includeStoppedContainers)
 }
 
+func (s Settings) MaxLabelIterations() int {
+	return s.v.GetInt(maxLabelIterations)
+}
+
+// InstructionsEnv is the environment variable in containers to read instructions from, disabled if empty
+func (s Settings) InstructionsEnv() string {
+	return s.v.GetString(instructionsEnv)
+}
+
+// InstructionsFile is the file mapping container names to instructions, disabled if empty
+func (s Settings) InstructionsFile() string {
+	return s.v.GetString(instructionsFile)
+}
+
 func (s Settings) RunInterval() time.Duration {
 	return s.v.GetDuration(runInterval)
 }
 
+// HostsFile is the yaml file listing the docker hosts to connect to, the environment configures a single host if empty
+func (s Settings) HostsFile() string {
+	return s.v.GetString(hostsFile)
+}
+
+// APIAddress is the address to serve the control api on, ex. "unix:///run/discriminator.sock", disabled if empty
+func (s Settings) APIAddress() string {
+	return s.v.GetString(apiAddress)
+}
+
+// WebhooksFile is a yaml file listing webhooks to notify about container updates, disabled if empty
+func (s Settings) WebhooksFile() string {
+	return s.v.GetString(webhooksFile)
+}
+
+// WebhookQueueSize is the number of notifications waiting to be sent before new ones are dropped
+func (s Settings) WebhookQueueSize() int {
+	return s.v.GetInt(webhookQueueSize)
+}
+
+// WebhookMaxAttempts is the number of times a notification is sent before giving up
+func (s Settings) WebhookMaxAttempts() int {
+	return s.v.GetInt(webhookMaxAttempts)
+}
+
+// AuditLogPath is the file container recreations are recorded in, disabled if empty
+func (s Settings) AuditLogPath() string {
+	return s.v.GetString(auditLogPath)
+}
+
+// TraceOutput is the file to write tracing spans to, or "stdout", disabled if empty
+func (s Settings) TraceOutput() string {
+	return s.v.GetString(traceOutput)
+}
+
+// DataDir is the directory the reconciliation history of containers is kept in, disabled if empty
+func (s Settings) DataDir() string {
+	return s.v.GetString(dataDir)
+}
+
+// RetryBackoff is the time before a failed update is attempted again, doubled for every failure
+func (s Settings) RetryBackoff() time.Duration {
+	return s.v.GetDuration(retryBackoff)
+}
+
+// MaxRetryBackoff is the longest time before a failed update is attempted again
+func (s Settings) MaxRetryBackoff() time.Duration {
+	return s.v.GetDuration(maxRetryBackoff)
+}
+
+// QuarantineAfterFailures is the number of failed updates after which a container is quarantined, 0 disables
+func (s Settings) QuarantineAfterFailures() int {
+	return s.v.GetInt(quarantineAfterFailures)
+}
+
+// BackupPath is the directory containers are backed up to before they are recreated, disabled if empty
+func (s Settings) BackupPath() string {
+	return s.v.GetString(backupPath)
+}
+
+// BackupRetentionCount is the number of backups to keep per container, 0 keeps all
+func (s Settings) BackupRetentionCount() int {
+	return s.v.GetInt(backupRetentionCount)
+}
+
+// BackupRetentionAge is how long backups are kept, 0 keeps them forever
+func (s Settings) BackupRetentionAge() time.Duration {
+	return s.v.GetDuration(backupRetentionAge)
+}
+
+// HealthCheckTimeout is how long to wait for a recreated container with a health check to become healthy
+func (s Settings) HealthCheckTimeout() time.Duration {
+	return s.v.GetDuration(healthCheckTimeout)
+}
+
+// MinUptime is how long a recreated container without a health check has to stay running
+func (s Settings) MinUptime() time.Duration {
+	return s.v.GetDuration(minUptime)
+}
+
+// StrategyLabel is the label containers use to choose how they are updated
+func (s Settings) StrategyLabel() string {
+	return s.v.GetString(strategyLabel)
+}
+
+// StrategySelectors maps container name patterns to update strategies, ex. "web-*=blue-green;legacy-*=notify"
+//
+// Returns the pattern and strategy pairs in order
+func (s Settings) StrategySelectors() [][2]string {
+	var selectors [][2]string
+	for _, selector := range splitList(s.v.GetString(strategySelectors)) {
+		parts := strings.SplitN(selector, "=", 2)
+		if len(parts) != 2 {
+			logrus.Warnf("Could not parse strategy selector %s, ignoring it", selector)
+			continue
+		}
+		selectors = append(selectors, [2]string{strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])})
+	}
+	return selectors
+}
+
+// DefaultStrategy is the update strategy for containers that don't select one
+func (s Settings) DefaultStrategy() string {
+	return s.v.GetString(defaultStrategy)
+}
+
+// DependentsPolicy is what to do with containers depending on a replaced container, recreate/refuse/ignore
+func (s Settings) DependentsPolicy() string {
+	return s.v.GetString(dependentsPolicy)
+}
+
+// MaxRecreationsPerIteration is the max number of containers updated in one iteration, 0 disables the limit
+func (s Settings) MaxRecreationsPerIteration() int {
+	return s.v.GetInt(maxRecreationsPerIteration)
+}
+
+// MaxRecreationsPerHour is the max number of containers updated within any hour, 0 disables the limit
+func (s Settings) MaxRecreationsPerHour() int {
+	return s.v.GetInt(maxRecreationsPerHour)
+}
+
+// MinRecreationInterval is the minimum time between updates of the same container
+func (s Settings) MinRecreationInterval() time.Duration {
+	return s.v.GetDuration(minRecreationInterval)
+}
+
+// MaintenanceWindows are the windows containers are only updated within, ex. "0 2 * * 6 4h;0 2 * * 0 4h"
+//
+// Updates are allowed at any time if there are no windows
+func (s Settings) MaintenanceWindows() []string {
+	return splitList(s.v.GetString(maintenanceWindows))
+}
+
+// ProtectedLabels are the label keys templates may never change, a trailing "*" matches any suffix
+//
+// The instruction labels are always protected in addition to these
+func (s Settings) ProtectedLabels() []string {
+	return splitList(s.v.GetString(protectedLabels))
+}
+
+// TemplateNamespaces restrict templates to label keys, ex. "traefik/*=traefik.*;prometheus=prometheus.*,metrics"
+func (s Settings) TemplateNamespaces() []string {
+	return splitList(s.v.GetString(templateNamespaces))
+}
+
 func (s Settings) LogFormatter() logrus.Formatter {
 	in := s.v.GetString(logFormat)
 	switch strings.ToLower(strings.TrimSpace(in)) {
@@ -101,3 +352,14 @@ func (s Settings) LogLevel() logrus.Level {
 	}
 	return lvl
 }
+
+// splitList splits a list separated by ";", ignoring empty entries
+func splitList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ";") {
+		if strings.TrimSpace(entry) != "" {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	return entries
+}
@@ -0,0 +1,42 @@
+package sources
+
+import (
+	"context"
+	"strings"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+// EnvGetter provides abstraction for retrieving the environment variables of a container
+type EnvGetter interface {
+	GetEnv(ctx context.Context, containerID string) ([]string, error)
+}
+
+// EnvSource reads instructions from an environment variable set in the container
+type EnvSource struct {
+	variable  string
+	envGetter EnvGetter
+}
+
+// NewEnvSource creates a source reading instructions from the given environment variable
+func NewEnvSource(_ context.Context, variable string, envGetter EnvGetter) (EnvSource, error) {
+	return EnvSource{
+		variable:  variable,
+		envGetter: envGetter,
+	}, nil
+}
+
+// Instruction returns the value of the environment variable in the container
+func (s EnvSource) Instruction(ctx context.Context, container docker.Container) (string, error) {
+	env, err := s.envGetter.GetEnv(ctx, container.ID)
+	if err != nil {
+		return "", err
+	}
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if len(parts) == 2 && parts[0] == s.variable {
+			return parts[1], nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,68 @@
+package sources
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"gopkg.in/yaml.v2"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+// Rule maps containers with names matching the pattern to an instruction
+type Rule struct {
+	Pattern     string `yaml:"pattern"`
+	Instruction string `yaml:"instruction"`
+}
+
+// FileSource reads instructions from a list of rules
+type FileSource struct {
+	rules []Rule
+}
+
+// NewFileSource creates a source from a list of rules
+//
+// Patterns are matched against the container name without the leading "/"
+// and support the "*" and "?" wildcards
+func NewFileSource(_ context.Context, rules []Rule) (FileSource, error) {
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return FileSource{}, fmt.Errorf("invalid pattern %s", rule.Pattern)
+		}
+	}
+	return FileSource{rules: rules}, nil
+}
+
+// LoadFileSourceFromPath loads a list of rules from a yaml file on the form
+//
+//   - pattern: web-*
+//     instruction: traefik(domain: example.com)
+func LoadFileSourceFromPath(ctx context.Context, filePath string) (FileSource, error) {
+	content, err := ioutil.ReadFile(filePath) //nolint:gosec
+	if err != nil {
+		return FileSource{}, errors.Wrapf(err, "failed to read instructions file %s", filePath)
+	}
+	var rules []Rule
+	if err := yaml.UnmarshalStrict(content, &rules); err != nil {
+		return FileSource{}, errors.Wrapf(err, "failed to parse instructions file %s", filePath)
+	}
+	return NewFileSource(ctx, rules)
+}
+
+// Instruction chains the instructions of all rules matching the container in order
+func (s FileSource) Instruction(_ context.Context, container docker.Container) (string, error) {
+	var instructions []string
+	name := strings.TrimPrefix(container.Name, "/")
+	for _, rule := range s.rules {
+		// Patterns are validated when the source is created
+		if matched, _ := path.Match(rule.Pattern, name); matched {
+			instructions = append(instructions, rule.Instruction)
+		}
+	}
+	return strings.Join(instructions, " | "), nil
+}
@@ -0,0 +1,34 @@
+package sources
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+// Source provides instructions for containers from somewhere other than their labels
+type Source interface {
+	// Instruction returns the instruction for the container, or an empty string if there is none
+	Instruction(ctx context.Context, container docker.Container) (string, error)
+}
+
+// Sources is a collection of Source
+type Sources []Source
+
+// Instruction chains the instructions of all sources in order
+func (ss Sources) Instruction(ctx context.Context, container docker.Container) (string, error) {
+	var instructions []string
+	for _, s := range ss {
+		instruction, err := s.Instruction(ctx, container)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to get instruction for container %s", container.Name)
+		}
+		if instruction = strings.TrimSpace(instruction); instruction != "" {
+			instructions = append(instructions, instruction)
+		}
+	}
+	return strings.Join(instructions, " | "), nil
+}
@@ -0,0 +1,73 @@
+package sources
+
+import (
+	"context"
+	"testing"
+
+	"sidus.io/discriminator/internal/pkg/docker"
+)
+
+type staticEnv map[string][]string
+
+func (e staticEnv) GetEnv(_ context.Context, containerID string) ([]string, error) {
+	return e[containerID], nil
+}
+
+func TestSources_Instruction(t *testing.T) {
+	ctx := context.Background()
+	fileSource, err := NewFileSource(ctx, []Rule{
+		{Pattern: "web-*", Instruction: "traefik()"},
+		{Pattern: "web-1", Instruction: "backup()"},
+	})
+	if err != nil {
+		t.Fatalf("NewFileSource() error = %v", err)
+	}
+	envSource, err := NewEnvSource(ctx, "INSTRUCTIONS", staticEnv{
+		"1": {"PATH=/bin", "INSTRUCTIONS=prometheus(port: 9100)"},
+		"2": {"INSTRUCTIONS_OTHER=ignored()"},
+	})
+	if err != nil {
+		t.Fatalf("NewEnvSource() error = %v", err)
+	}
+	ss := Sources{fileSource, envSource}
+
+	tests := []struct {
+		name      string
+		container docker.Container
+		want      string
+	}{
+		{
+			name:      "all sources",
+			container: docker.Container{ID: "1", Name: "/web-1"},
+			want:      "traefik() | backup() | prometheus(port: 9100)",
+		},
+		{
+			name:      "file only",
+			container: docker.Container{ID: "2", Name: "/web-2"},
+			want:      "traefik()",
+		},
+		{
+			name:      "no source",
+			container: docker.Container{ID: "3", Name: "/db"},
+			want:      "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ss.Instruction(ctx, tt.container)
+			if err != nil {
+				t.Errorf("Instruction() error = %v", err)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("Instruction() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFileSource_invalidPattern(t *testing.T) {
+	if _, err := NewFileSource(context.Background(), []Rule{{Pattern: "[", Instruction: "a()"}}); err == nil {
+		t.Errorf("NewFileSource() expected error for invalid pattern")
+	}
+}
@@ -0,0 +1,328 @@
+// Package state persists the reconciliation history of containers between restarts
+package state
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FileName is the name of the file the state is stored in, within the data directory
+const FileName = "state.json"
+
+// Record is the reconciliation history of a container, or of all containers of a compose service
+type Record struct {
+	Key string `json:"key"`
+	// ContainerID is the id of the container of the last attempt, recreated containers get new ids
+	ContainerID string `json:"containerId"`
+	// AppliedHash is the hash of the labels last applied successfully
+	AppliedHash string    `json:"appliedHash,omitempty"`
+	AppliedAt   time.Time `json:"appliedAt"`
+	// Failures is the number of failed attempts since the last success
+	Failures int `json:"failures,omitempty"`
+	// FailedHash is the hash of the labels of the last failed attempt, empty if the labels couldn't be resolved
+	FailedHash string    `json:"failedHash,omitempty"`
+	FailedAt   time.Time `json:"failedAt"`
+	LastError  string    `json:"lastError,omitempty"`
+	// RetryAt is the time before which the failed labels aren't attempted again
+	RetryAt time.Time `json:"retryAt"`
+	// Quarantined containers aren't updated until they are released
+	Quarantined bool `json:"quarantined,omitempty"`
+	// Replaced maps the ids of containers updates started to replace to their names before the update,
+	// so that replaced containers left behind under another name can be recognized
+	Replaced map[string]string `json:"replaced,omitempty"`
+	// Created maps the ids of containers that failed updates created and couldn't remove
+	// to the names they were created to take over
+	Created map[string]string `json:"created,omitempty"`
+}
+
+// Backoff decides when failed updates are attempted again
+type Backoff struct {
+	// Initial is the delay after the first failure, doubled for every failure after that
+	Initial time.Duration
+	// Max is the longest delay, 0 disables the limit
+	Max time.Duration
+	// QuarantineAfter is the number of failures after which a container is quarantined, 0 disables quarantine
+	QuarantineAfter int
+}
+
+// Delay returns the time to wait after the number of failures
+func (b Backoff) Delay(failures int) time.Duration {
+	delay := b.Initial
+	// Stop doubling at the limit, or before overflowing without one
+	for i := 1; i < failures && (b.Max <= 0 || delay < b.Max) && delay*2 > delay; i++ {
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		return b.Max
+	}
+	return delay
+}
+
+// Succeeded records that the labels with the hash were applied to the container
+func (r *Record) Succeeded(now time.Time, containerID, hash string) {
+	r.ContainerID = containerID
+	r.AppliedHash = hash
+	r.AppliedAt = now
+	r.Release()
+}
+
+// Failed records a failed attempt to apply the labels with the hash to the container
+//
+// The labels aren't attempted again before the delay of the backoff has passed,
+// and not at all once the container is quarantined
+func (r *Record) Failed(now time.Time, containerID, hash string, err error, backoff Backoff) {
+	r.ContainerID = containerID
+	r.Failures++
+	r.FailedHash = hash
+	r.FailedAt = now
+	r.LastError = err.Error()
+	r.RetryAt = now.Add(backoff.Delay(r.Failures))
+	r.Quarantined = backoff.QuarantineAfter > 0 && r.Failures >= backoff.QuarantineAfter
+}
+
+// Replacing records that an update starts to replace the container with the id and name
+func (r *Record) Replacing(containerID, name string) {
+	r.Replaced = withContainer(r.Replaced, containerID, name)
+}
+
+// Creating records that an update created the container with the id to take over the name, and couldn't remove it
+func (r *Record) Creating(containerID, name string) {
+	r.Created = withContainer(r.Created, containerID, name)
+}
+
+// withContainer returns a copy of the names by container id, with the name of the container added
+func withContainer(names map[string]string, containerID, name string) map[string]string {
+	// Records share the map with their copies, ex. the records in a memory store
+	updated := make(map[string]string, len(names)+1)
+	for id, name := range names {
+		updated[id] = name
+	}
+	updated[containerID] = name
+	return updated
+}
+
+// Release forgets the failures of the container, so that it is attempted again right away
+func (r *Record) Release() {
+	r.Failures = 0
+	r.FailedHash = ""
+	r.FailedAt = time.Time{}
+	r.LastError = ""
+	r.RetryAt = time.Time{}
+	r.Quarantined = false
+}
+
+// Waiting returns whether applying the labels with the hash should wait, because it failed before retryAt
+//
+// Other labels, ex. after the templates were fixed, are attempted right away
+func (r Record) Waiting(now time.Time, hash string) bool {
+	return r.Failures > 0 && r.FailedHash == hash && now.Before(r.RetryAt)
+}
+
+// Store is a json file holding the records of containers
+//
+// The file is read and written on every access, so that it can be inspected and cleared
+// by other processes while the application is running.
+type Store struct {
+	mu   sync.Mutex
+	path string
+	// records holds the records of stores without a file
+	records map[string]Record
+}
+
+// NewStore creates a store in the data directory, creating the directory if needed
+func NewStore(_ context.Context, dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create data directory %s", dir)
+	}
+	return &Store{path: filepath.Join(dir, FileName)}, nil
+}
+
+// NewMemoryStore creates a store that keeps the records in memory, they are lost when the application stops
+func NewMemoryStore(_ context.Context) (*Store, error) {
+	return &Store{records: make(map[string]Record)}, nil
+}
+
+// Get returns the record with the key, or an empty record with the key if there is none
+//
+// A nil store has no records
+func (s *Store) Get(key string) (Record, error) {
+	if s == nil {
+		return Record{Key: key}, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return Record{}, err
+	}
+	record, ok := records[key]
+	if !ok {
+		return Record{Key: key}, nil
+	}
+	return record, nil
+}
+
+// Put saves the record, replacing any record with the same key
+//
+// Records aren't saved by a nil store
+func (s *Store) Put(record Record) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return err
+	}
+	records[record.Key] = record
+	return s.save(records)
+}
+
+// List returns the records the match function returns true for, sorted by key
+//
+// A nil store has no records
+func (s *Store) List(match func(key string) bool) ([]Record, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var list []Record
+	for key, record := range records {
+		if match(key) {
+			list = append(list, record)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list, nil
+}
+
+// Update changes the records the match function returns true for and returns their keys
+//
+// A nil store has no records to update
+func (s *Store) Update(match func(key string) bool, update func(record *Record)) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var updated []string
+	for key, record := range records {
+		if match(key) {
+			update(&record)
+			records[key] = record
+			updated = append(updated, key)
+		}
+	}
+	sort.Strings(updated)
+	if len(updated) == 0 {
+		return nil, nil
+	}
+	return updated, s.save(records)
+}
+
+// Delete removes the records the match function returns true for and returns their keys
+//
+// A nil store has no records to delete
+func (s *Store) Delete(match func(key string) bool) ([]string, error) {
+	if s == nil {
+		return nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	var deleted []string
+	for key := range records {
+		if match(key) {
+			deleted = append(deleted, key)
+			delete(records, key)
+		}
+	}
+	sort.Strings(deleted)
+	if len(deleted) == 0 {
+		return nil, nil
+	}
+	return deleted, s.save(records)
+}
+
+// load reads all records, a missing file has no records
+func (s *Store) load() (map[string]Record, error) {
+	records := make(map[string]Record)
+	if s.path == "" {
+		for key, record := range s.records {
+			records[key] = record
+		}
+		return records, nil
+	}
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read state %s", s.path)
+	}
+	if err := json.Unmarshal(content, &records); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode state %s", s.path)
+	}
+	return records, nil
+}
+
+// save writes all records to a temporary file and moves it in place, so the file is never partly written
+func (s *Store) save(records map[string]Record) error {
+	if s.path == "" {
+		s.records = records
+		return nil
+	}
+	content, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode state")
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0640); err != nil {
+		return errors.Wrapf(err, "failed to write state %s", tmp)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return errors.Wrapf(err, "failed to replace state %s", s.path)
+	}
+	return nil
+}
+
+// Hash returns a hash of the labels that doesn't depend on their order
+func Hash(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, key := range keys {
+		// Null bytes can't be part of labels, so the encoding is unambiguous
+		h.Write([]byte(key + "\x00" + labels[key] + "\x00")) //nolint:errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
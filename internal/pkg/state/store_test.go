@@ -0,0 +1,173 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	store, err := NewStore(ctx, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+
+	now := time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC)
+	record, err := store.Get("local/web")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if !reflect.DeepEqual(record, Record{Key: "local/web"}) {
+		t.Errorf("Get() of a missing record = %+v", record)
+	}
+	record.Failed(now, "1", "a", errors.New("failed"), Backoff{Initial: time.Minute})
+	record.Failed(now, "1", "a", errors.New("failed again"), Backoff{Initial: time.Minute / 2})
+	for _, r := range []Record{record, {Key: "local/app/api"}, {Key: "prod/web"}} {
+		if err := store.Put(r); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+
+	// A new store reads the records of the file
+	store, err = NewStore(ctx, filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatalf("NewStore() error = %v", err)
+	}
+	got, err := store.Get("local/web")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Failures != 2 || got.LastError != "failed again" || !got.RetryAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("Get() = %+v, want the saved record", got)
+	}
+
+	local := func(key string) bool { return strings.HasPrefix(key, "local/") }
+	list, err := store.List(local)
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list) != 2 || list[0].Key != "local/app/api" || list[1].Key != "local/web" {
+		t.Errorf("List() = %+v, want the local records sorted by key", list)
+	}
+	deleted, err := store.Delete(local)
+	if err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"local/app/api", "local/web"}) {
+		t.Errorf("Delete() = %v", deleted)
+	}
+	list, err = store.List(func(string) bool { return true })
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(list) != 1 || list[0].Key != "prod/web" {
+		t.Errorf("List() after Delete() = %+v", list)
+	}
+}
+
+func TestStore_nil(t *testing.T) {
+	var store *Store
+	if err := store.Put(Record{Key: "local/web", Failures: 1}); err != nil {
+		t.Errorf("Put() error = %v", err)
+	}
+	record, err := store.Get("local/web")
+	if err != nil || !reflect.DeepEqual(record, Record{Key: "local/web"}) {
+		t.Errorf("Get() = %+v, %v, want an empty record", record, err)
+	}
+	records, err := store.List(func(string) bool { return true })
+	if err != nil || len(records) != 0 {
+		t.Errorf("List() = %+v, %v, want no records", records, err)
+	}
+	deleted, err := store.Delete(func(string) bool { return true })
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("Delete() = %v, %v, want nothing deleted", deleted, err)
+	}
+}
+
+func TestRecord_Waiting(t *testing.T) {
+	now := time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC)
+	failed := Record{}
+	failed.Failed(now, "1", "a", errors.New("failed"), Backoff{Initial: time.Minute})
+	succeeded := failed
+	succeeded.Succeeded(now, "2", "a")
+	tests := []struct {
+		name   string
+		record Record
+		now    time.Time
+		hash   string
+		want   bool
+	}{
+		{name: "same labels", record: failed, now: now, hash: "a", want: true},
+		{name: "retry time passed", record: failed, now: now.Add(time.Minute), hash: "a"},
+		{name: "other labels", record: failed, now: now, hash: "b"},
+		{name: "succeeded since", record: succeeded, now: now, hash: "a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.record.Waiting(tt.now, tt.hash); got != tt.want {
+				t.Errorf("Waiting() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecord_Failed(t *testing.T) {
+	now := time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC)
+	backoff := Backoff{Initial: time.Minute, Max: 5 * time.Minute, QuarantineAfter: 4}
+	var record Record
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		record.Failed(now, "1", "a", errors.New("failed"), backoff)
+		if !record.RetryAt.Equal(now.Add(want)) {
+			t.Errorf("RetryAt after %d failures = %s, want %s", i+1, record.RetryAt.Sub(now), want)
+		}
+		if quarantined := i+1 >= backoff.QuarantineAfter; record.Quarantined != quarantined {
+			t.Errorf("Quarantined after %d failures = %v, want %v", i+1, record.Quarantined, quarantined)
+		}
+	}
+	record.Release()
+	if record.Quarantined || record.Failures != 0 || record.Waiting(now, "a") {
+		t.Errorf("record after Release() = %+v", record)
+	}
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  Backoff
+		failures int
+		want     time.Duration
+	}{
+		{name: "first failure", backoff: Backoff{Initial: time.Second}, failures: 1, want: time.Second},
+		{name: "doubled", backoff: Backoff{Initial: time.Second}, failures: 4, want: 8 * time.Second},
+		{name: "limited", backoff: Backoff{Initial: time.Second, Max: 5 * time.Second}, failures: 4, want: 5 * time.Second},
+		{name: "no overflow", backoff: Backoff{Initial: time.Second}, failures: 100, want: time.Second << 33},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.backoff.Delay(tt.failures); got != tt.want {
+				t.Errorf("Delay() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHash(t *testing.T) {
+	if Hash(map[string]string{"a": "1", "b": "2"}) != Hash(map[string]string{"b": "2", "a": "1"}) {
+		t.Errorf("Hash() depends on the order of the labels")
+	}
+	if Hash(map[string]string{"a": "1b"}) == Hash(map[string]string{"a1": "b"}) {
+		t.Errorf("Hash() is ambiguous")
+	}
+}
@@ -10,4 +10,6 @@ type Data struct {
 type ContainerData struct {
 	Labels map[string]string
 	Name   string
+	// Host is the name of the docker host the container runs on
+	Host string
 }
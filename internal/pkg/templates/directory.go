@@ -3,8 +3,11 @@ package templates
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"text/template"
 
@@ -15,55 +18,187 @@ import (
 	"sidus.io/discriminator/internal/pkg/labels"
 )
 
+// PartialsDirectory is the name of directories containing partials.
+//
+// Templates loaded from a partials directory can be included by other templates
+// but can not be invoked from an instruction
+const PartialsDirectory = "_partials"
+
 // Directory is a collection of templates
 type Directory struct {
 	templates *template.Template
-	extension string
+	partials  map[string]bool
 }
 
 // LoadTemplatesFromPath loads all templates in the given path
-func LoadTemplatesFromPath(ctx context.Context, path, extension string) (*template.Template, error) {
-	tmpl := template.New("collection")
+//
+// Templates are named after their path relative to the given path, without the extension,
+// ex. "traefik/router.tmpl" is named "traefik/router".
+// Returns the template collection and the names of all templates defined as partials.
+// Two templates with the same name results in an error.
+func LoadTemplatesFromPath(ctx context.Context, path, extension string) (*template.Template, []string, error) {
+	texts, err := ReadTemplatesFromPath(ctx, path, extension)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl, partials, err := ParseTemplates(ctx, texts, nil)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "error while processing templates in %s", path)
+	}
+	return tmpl, partials, nil
+}
+
+// ReadTemplatesFromPath reads the text of all templates in the given path, by name
+//
+// Templates are named as by LoadTemplatesFromPath
+func ReadTemplatesFromPath(_ context.Context, path, extension string) (map[string]string, error) {
+	texts := make(map[string]string)
 	err := filepath.Walk(path,
-		func(path string, info os.FileInfo, err error) error {
+		func(filePath string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			if !info.IsDir() && strings.HasSuffix(info.Name(), extension) {
-				tmpl, err = tmpl.ParseFiles(path)
-				if err != nil {
-					logrus.WithContext(ctx).WithError(err).Warnf("failed to parse template %s, this template will not be loaded", path)
-					return nil
-				}
+			if info.IsDir() || !strings.HasSuffix(info.Name(), extension) {
+				return nil
 			}
+			relativePath, err := filepath.Rel(path, filePath)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadFile(filePath) //nolint:gosec
+			if err != nil {
+				return errors.Wrapf(err, "failed to read template %s", filePath)
+			}
+			texts[filepath.ToSlash(strings.TrimSuffix(relativePath, extension))] = string(content)
 			return nil
 		})
 	if err != nil {
 		return nil, errors.Wrapf(err, "error while processing templates in %s", path)
 	}
-	return tmpl, nil
+	return texts, nil
+}
+
+// ParseTemplates parses the template texts by name into a collection
+//
+// The functions in funcs can be called from the templates, in addition to the predefined functions.
+// Templates that fail to parse are left out with a warning.
+// Returns the template collection and the names of all templates defined as partials.
+// Two templates with the same name results in an error.
+func ParseTemplates(
+	ctx context.Context,
+	texts map[string]string,
+	funcs template.FuncMap,
+) (*template.Template, []string, error) {
+	tmpl := template.New("collection").Funcs(funcs)
+	names := make([]string, 0, len(texts))
+	for name := range texts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var partials []string
+	for _, name := range names {
+		defined, err := addTemplate(tmpl, name, texts[name], funcs)
+		if err != nil {
+			if _, ok := errors.Cause(err).(duplicateError); ok {
+				return nil, nil, err
+			}
+			logrus.WithContext(ctx).WithError(err).Warnf("failed to parse template %s, this template will not be loaded", name)
+			continue
+		}
+		if IsPartial(name) {
+			partials = append(partials, defined...)
+		}
+	}
+	return tmpl, partials, nil
+}
+
+// duplicateError is returned when a template name is already present in a collection
+type duplicateError string
+
+func (e duplicateError) Error() string {
+	return fmt.Sprintf("template %s is defined more than once", string(e))
+}
+
+// addTemplate parses the text as a template with the given name and adds it,
+// together with any templates it defines, to the collection.
+//
+// Returns the names of all templates added to the collection
+func addTemplate(collection *template.Template, name, text string, funcs template.FuncMap) ([]string, error) {
+	// Parse separately first so that collisions can be detected before anything is overwritten
+	parsed, err := template.New(name).Funcs(funcs).Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse template %s", name)
+	}
+	var defined []string
+	for _, t := range parsed.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if collection.Lookup(t.Name()) != nil {
+			return nil, errors.Wrapf(duplicateError(t.Name()), "failed to add template %s", name)
+		}
+		defined = append(defined, t.Name())
+	}
+	for _, t := range parsed.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		if _, err := collection.AddParseTree(t.Name(), t.Tree); err != nil {
+			return nil, errors.Wrapf(err, "failed to add template %s", name)
+		}
+	}
+	return defined, nil
+}
+
+// IsPartial reports whether the name belongs to a template in a partials directory
+func IsPartial(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == PartialsDirectory {
+			return true
+		}
+	}
+	return false
 }
 
 // NewDirectory creates a directory
-func NewDirectory(_ context.Context, tmpl *template.Template, extension string) (*Directory, error) {
-	return &Directory{
+//
+// Templates named in partials can only be included from other templates
+func NewDirectory(_ context.Context, tmpl *template.Template, partials []string) (*Directory, error) {
+	d := &Directory{
 		templates: tmpl,
-		extension: extension,
-	}, nil
+		partials:  make(map[string]bool),
+	}
+	for _, name := range partials {
+		d.partials[name] = true
+	}
+	return d, nil
 }
 
 // GetModifiers parses the templates and get modifiers for the specified name and data
 //
-// The name has to be in the template collection for this method to work
+// The name has to be in the template collection and may not be a partial for this method to work
 func (d Directory) GetModifiers(ctx context.Context, name string, data Data) (labels.Modifier, error) {
+	if d.partials[name] {
+		return labels.Modifier{}, fmt.Errorf("template %s is a partial and can not be used in an instruction", name)
+	}
+	if d.templates.Lookup(name) == nil {
+		return labels.Modifier{}, fmt.Errorf("no template named %s", name)
+	}
 	var text bytes.Buffer
-	err := d.templates.ExecuteTemplate(&text, name+d.extension, data)
+	err := d.templates.ExecuteTemplate(&text, name, data)
 	if err != nil {
 		return labels.Modifier{}, errors.Wrapf(err, "failed to parse template %s with data %+v", name, data)
 	}
 	return labels.NewModifier(ctx, bytes.NewReader(text.Bytes()))
 }
 
-func (d Directory) Count(ctx context.Context) int {
-	return len(d.templates.Templates())
+// Count returns the number of templates that can be used in instructions
+func (d Directory) Count(_ context.Context) int {
+	count := 0
+	for _, t := range d.templates.Templates() {
+		if t.Tree != nil && !d.partials[t.Name()] {
+			count++
+		}
+	}
+	return count
 }
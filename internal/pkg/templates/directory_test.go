@@ -0,0 +1,117 @@
+package templates
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTemplates(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "discriminator-templates")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory for %s: %v", name, err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+func TestDirectory_GetModifiers(t *testing.T) {
+	files := map[string]string{
+		"traefik/router.tmpl":     `{{template "_partials/enable" .}}+router={{.Arguments.domain}}`,
+		"prometheus/router.tmpl":  "+metrics=true",
+		"_partials/enable.tmpl":   "+traefik.enable=true\n",
+		"ignored.txt":             "+ignored=true",
+		"defines.tmpl":            `{{define "inner"}}+inner=true{{end}}+outer=true`,
+		"nested/_partials/x.tmpl": "+x=true",
+	}
+	tests := []struct {
+		name    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "traefik/router",
+			want: map[string]string{"traefik.enable": "true", "router": "example.com"},
+		},
+		{
+			name: "prometheus/router",
+			want: map[string]string{"metrics": "true"},
+		},
+		{
+			name: "inner",
+			want: map[string]string{"inner": "true"},
+		},
+		{
+			name:    "_partials/enable",
+			wantErr: true,
+		},
+		{
+			name:    "nested/_partials/x",
+			wantErr: true,
+		},
+		{
+			name:    "ignored",
+			wantErr: true,
+		},
+		{
+			name:    "router",
+			wantErr: true,
+		},
+	}
+
+	ctx := context.Background()
+	dir := writeTemplates(t, files)
+	defer os.RemoveAll(dir)
+	tmpl, partials, err := LoadTemplatesFromPath(ctx, dir, ".tmpl")
+	if err != nil {
+		t.Fatalf("LoadTemplatesFromPath() error = %v", err)
+	}
+	d, err := NewDirectory(ctx, tmpl, partials)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	if got := d.Count(ctx); got != 4 {
+		t.Errorf("Count() = %v, want %v", got, 4)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := d.GetModifiers(ctx, tt.name, Data{Arguments: map[string]string{"domain": "example.com"}})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("GetModifiers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got := map[string]string{}
+			m.Apply(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetModifiers() labels = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTemplatesFromPath_duplicate(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"a.tmpl": `{{define "b"}}+a=true{{end}}`,
+		"b.tmpl": "+b=true",
+	})
+	defer os.RemoveAll(dir)
+	if _, _, err := LoadTemplatesFromPath(context.Background(), dir, ".tmpl"); err == nil {
+		t.Errorf("LoadTemplatesFromPath() expected error for duplicate template name")
+	}
+}
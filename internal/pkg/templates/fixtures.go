@@ -0,0 +1,176 @@
+package templates
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+
+	"sidus.io/discriminator/internal/pkg/labels"
+)
+
+// TestSuffix ends the names of files with test cases for a template,
+// ex. the cases of "traefik/router.tmpl" are in "traefik/router_test.yaml"
+const TestSuffix = "_test.yaml"
+
+// TestCase is a test of a template, it expects labels, a modifier or an error
+type TestCase struct {
+	Name string `yaml:"name"`
+	// Container is the name of the container
+	Container string            `yaml:"container"`
+	Host      string            `yaml:"host"`
+	Labels    map[string]string `yaml:"labels"`
+	Arguments map[string]string `yaml:"arguments"`
+	// WantLabels are the labels expected after the modifier of the template is applied to the labels
+	WantLabels map[string]string `yaml:"wantLabels"`
+	// WantModifier is the modifier expected from the template, ex. "+a=1"
+	WantModifier *string `yaml:"wantModifier"`
+	// WantErr expects the template to fail
+	WantErr bool `yaml:"wantErr"`
+}
+
+// Tests are the test cases of a template
+type Tests struct {
+	// Template is the name of the tested template
+	Template string
+	// Path is the file the cases are loaded from
+	Path  string
+	Cases []TestCase
+}
+
+// LoadTestsFromPath loads the test cases of all templates in the given path
+//
+// Cases are loaded from yaml files next to the templates, named after the template with the TestSuffix
+func LoadTestsFromPath(_ context.Context, path string) ([]Tests, error) {
+	var tests []Tests
+	err := filepath.Walk(path,
+		func(filePath string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(info.Name(), TestSuffix) {
+				return nil
+			}
+			relativePath, err := filepath.Rel(path, filePath)
+			if err != nil {
+				return err
+			}
+			content, err := ioutil.ReadFile(filePath) //nolint:gosec
+			if err != nil {
+				return errors.Wrapf(err, "failed to read tests %s", filePath)
+			}
+			t := Tests{
+				Template: filepath.ToSlash(strings.TrimSuffix(relativePath, TestSuffix)),
+				Path:     filePath,
+			}
+			if err := yaml.UnmarshalStrict(content, &t.Cases); err != nil {
+				return errors.Wrapf(err, "failed to parse tests %s", filePath)
+			}
+			for i, c := range t.Cases {
+				if c.WantLabels == nil && c.WantModifier == nil && !c.WantErr {
+					return fmt.Errorf("case %d in %s expects neither labels, a modifier nor an error", i+1, filePath)
+				}
+			}
+			tests = append(tests, t)
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error while processing template tests in %s", path)
+	}
+	return tests, nil
+}
+
+// RunTest runs the case on the named template
+//
+// The returned error describes how the result differs from the expected one
+func (d Directory) RunTest(ctx context.Context, name string, c TestCase) error {
+	modifier, err := d.GetModifiers(ctx, name, Data{
+		ContainerData: ContainerData{
+			Labels: c.Labels,
+			Name:   c.Container,
+			Host:   c.Host,
+		},
+		Arguments: c.Arguments,
+	})
+	switch {
+	case c.WantErr && err == nil:
+		return fmt.Errorf("expected an error, got modifier:\n%s", indent(modifier.String()))
+	case c.WantErr:
+		return nil
+	case err != nil:
+		return err
+	}
+
+	var failures []string
+	if c.WantModifier != nil {
+		want, err := labels.NewModifier(ctx, bytes.NewReader([]byte(*c.WantModifier)))
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse expected modifier")
+		}
+		if modifier.String() != want.String() {
+			failures = append(failures, fmt.Sprintf(
+				"modifier differs, want:\n%s\ngot:\n%s", indent(want.String()), indent(modifier.String()),
+			))
+		}
+	}
+	if c.WantLabels != nil {
+		got := make(map[string]string, len(c.Labels))
+		for key, value := range c.Labels {
+			got[key] = value
+		}
+		labels.Modifiers{modifier}.Apply(got)
+		if diff := labelsDiff(c.WantLabels, got); diff != "" {
+			failures = append(failures, "labels differ (-want +got):\n"+indent(diff))
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+	return nil
+}
+
+// labelsDiff lists the labels only in want with "-" and the labels only in got with "+", sorted by key
+func labelsDiff(want, got map[string]string) string {
+	keys := make(map[string]bool, len(want)+len(got))
+	for key := range want {
+		keys[key] = true
+	}
+	for key := range got {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var rows []string
+	for _, key := range sorted {
+		wantValue, inWant := want[key]
+		gotValue, inGot := got[key]
+		if inWant && inGot && wantValue == gotValue {
+			continue
+		}
+		if inWant {
+			rows = append(rows, "-"+key+"="+wantValue)
+		}
+		if inGot {
+			rows = append(rows, "+"+key+"="+gotValue)
+		}
+	}
+	return strings.Join(rows, "\n")
+}
+
+func indent(text string) string {
+	if text == "" {
+		return "  (empty)"
+	}
+	return "  " + strings.Replace(text, "\n", "\n  ", -1)
+}
@@ -0,0 +1,145 @@
+package templates
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadTestsFromPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		want    map[string]int
+		wantErr bool
+	}{
+		{
+			name: "cases",
+			files: map[string]string{
+				"traefik/router.tmpl":      "+router={{.Name}}",
+				"traefik/router_test.yaml": "- {name: a, wantLabels: {}}\n- {name: b, wantModifier: '+a=1'}",
+				"other_test.yaml":          "- {name: c, wantErr: true}",
+				"router.yaml":              "not a test",
+			},
+			want: map[string]int{"traefik/router": 2, "other": 1},
+		},
+		{
+			name:    "no expectation",
+			files:   map[string]string{"router_test.yaml": "- {name: a, labels: {a: '1'}}"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown field",
+			files:   map[string]string{"router_test.yaml": "- {name: a, wantErr: true, expected: {}}"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTemplates(t, tt.files)
+			defer os.RemoveAll(dir)
+			got, err := LoadTestsFromPath(context.Background(), dir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadTestsFromPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("LoadTestsFromPath() loaded %d templates, want %d", len(got), len(tt.want))
+			}
+			for _, tests := range got {
+				if len(tests.Cases) != tt.want[tests.Template] {
+					t.Errorf("template %s has %d cases, want %d", tests.Template, len(tests.Cases), tt.want[tests.Template])
+				}
+			}
+		})
+	}
+}
+
+func TestDirectory_RunTest(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"router.tmpl": "+router={{.Name}}.{{.Arguments.domain}}\n-old",
+		"broken.tmpl": "{{.Missing.Field}}",
+	})
+	defer os.RemoveAll(dir)
+	tmpl, partials, err := LoadTemplatesFromPath(context.Background(), dir, ".tmpl")
+	if err != nil {
+		t.Fatalf("LoadTemplatesFromPath() error = %v", err)
+	}
+	directory, err := NewDirectory(context.Background(), tmpl, partials)
+	if err != nil {
+		t.Fatalf("NewDirectory() error = %v", err)
+	}
+	modifier := func(s string) *string { return &s }
+
+	tests := []struct {
+		name     string
+		template string
+		c        TestCase
+		// wantErr is a part of the expected failure, empty if the case is expected to pass
+		wantErr string
+	}{
+		{
+			name:     "labels",
+			template: "router",
+			c: TestCase{
+				Container:  "web",
+				Labels:     map[string]string{"old": "1", "kept": "2"},
+				Arguments:  map[string]string{"domain": "example.com"},
+				WantLabels: map[string]string{"kept": "2", "router": "web.example.com"},
+			},
+		},
+		{
+			name:     "modifier",
+			template: "router",
+			c: TestCase{
+				Container:    "web",
+				Arguments:    map[string]string{"domain": "example.com"},
+				WantModifier: modifier("-old\n+router=web.example.com"),
+			},
+		},
+		{
+			name:     "different labels",
+			template: "router",
+			c: TestCase{
+				Container:  "api",
+				Arguments:  map[string]string{"domain": "example.com"},
+				WantLabels: map[string]string{"router": "web.example.com"},
+			},
+			wantErr: "-router=web.example.com\n  +router=api.example.com",
+		},
+		{
+			name:     "different modifier",
+			template: "router",
+			c:        TestCase{Container: "web", WantModifier: modifier("+router=web.")},
+			wantErr:  "modifier differs",
+		},
+		{
+			name:     "expected error",
+			template: "broken",
+			c:        TestCase{WantErr: true},
+		},
+		{
+			name:     "unexpected error",
+			template: "broken",
+			c:        TestCase{WantLabels: map[string]string{}},
+			wantErr:  "failed to parse template",
+		},
+		{
+			name:     "missing error",
+			template: "router",
+			c:        TestCase{WantErr: true},
+			wantErr:  "expected an error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := directory.RunTest(context.Background(), tt.template, tt.c)
+			if (err != nil) != (tt.wantErr != "") {
+				t.Fatalf("RunTest() error = %v, want %q", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("RunTest() error = %v, want it to contain %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Stdout is the output of NewFileExporter writing to standard output
+const Stdout = "stdout"
+
+// JSONExporter writes every span as a json line
+type JSONExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewJSONExporter creates an exporter writing to w
+func NewJSONExporter(w io.Writer) *JSONExporter {
+	return &JSONExporter{w: w}
+}
+
+// NewFileExporter creates an exporter appending to the file at the path, or writing to standard output for Stdout
+func NewFileExporter(_ context.Context, path string) (*JSONExporter, error) {
+	if path == Stdout {
+		return NewJSONExporter(os.Stdout), nil
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open trace file %s", path)
+	}
+	return &JSONExporter{w: file, closer: file}, nil
+}
+
+// Export writes the span
+func (e *JSONExporter) Export(span Data) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode span %s", span.Name)
+	}
+	line = append(line, '\n')
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.w.Write(line)
+	if err != nil {
+		return errors.Wrapf(err, "failed to write span %s", span.Name)
+	}
+	return nil
+}
+
+// Close closes the file written to, if any
+func (e *JSONExporter) Close() error {
+	if e.closer == nil {
+		return nil
+	}
+	return e.closer.Close()
+}
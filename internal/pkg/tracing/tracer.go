@@ -0,0 +1,140 @@
+// Package tracing records timed spans of work, ex. iterations and docker api calls, and exports them when they end
+//
+// The tracer and the current span are carried by contexts, so that code only needs a context to start spans.
+// Starting a span with a context without a tracer does nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Exporter receives the spans that ended
+type Exporter interface {
+	Export(span Data) error
+}
+
+// Data is an ended span
+type Data struct {
+	TraceID  string `json:"traceId"`
+	SpanID   string `json:"spanId"`
+	ParentID string `json:"parentId,omitempty"`
+	Name     string `json:"name"`
+	// Start and End are the times the work started and ended
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Duration   float64           `json:"durationSeconds"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Error is the error the work failed with, empty if it succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Tracer starts spans and exports them when they end
+type Tracer struct {
+	exporter Exporter
+	// onError handles errors of the exporter
+	onError func(err error)
+}
+
+// NewTracer creates a tracer exporting spans to the exporter, export errors are passed to onError
+func NewTracer(_ context.Context, exporter Exporter, onError func(err error)) (*Tracer, error) {
+	return &Tracer{exporter: exporter, onError: onError}, nil
+}
+
+// Span is a timed piece of work in progress
+//
+// A nil span, as started without a tracer, does nothing
+type Span struct {
+	tracer *Tracer
+
+	mu   sync.Mutex
+	data Data
+	done bool
+}
+
+type tracerKey struct{}
+
+type spanKey struct{}
+
+// WithTracer returns a context starting spans with the tracer
+func WithTracer(ctx context.Context, tracer *Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+// Start starts a span, as a child of the span of the context if there is one
+//
+// Attributes are given as key value pairs, ex. Start(ctx, "docker.ContainerStop", "container", id).
+// The returned context carries the new span.
+func Start(ctx context.Context, name string, attributes ...string) (context.Context, *Span) {
+	tracer, _ := ctx.Value(tracerKey{}).(*Tracer)
+	if tracer == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer: tracer,
+		data: Data{
+			SpanID: newID(8),
+			Name:   name,
+			Start:  time.Now(),
+		},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*Span); ok && parent != nil {
+		span.data.TraceID = parent.data.TraceID
+		span.data.ParentID = parent.data.SpanID
+	} else {
+		span.data.TraceID = newID(16)
+	}
+	for i := 0; i+1 < len(attributes); i += 2 {
+		span.SetAttribute(attributes[i], attributes[i+1])
+	}
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// SetAttribute sets an attribute of the span, ex. the strategy chosen after the span started
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Attributes == nil {
+		s.data.Attributes = make(map[string]string)
+	}
+	s.data.Attributes[key] = value
+}
+
+// End ends the span and exports it, marking it as failed if the error isn't nil
+//
+// Only the first call has any effect
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.done {
+		s.mu.Unlock()
+		return
+	}
+	s.done = true
+	s.data.End = time.Now()
+	s.data.Duration = s.data.End.Sub(s.data.Start).Seconds()
+	if err != nil {
+		s.data.Error = err.Error()
+	}
+	data := s.data
+	s.mu.Unlock()
+
+	if exportErr := s.tracer.exporter.Export(data); exportErr != nil && s.tracer.onError != nil {
+		s.tracer.onError(exportErr)
+	}
+}
+
+// newID returns a random hex encoded id of n bytes
+func newID(n int) string {
+	id := make([]byte, n)
+	_, _ = rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,75 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStart(t *testing.T) {
+	var out bytes.Buffer
+	tracer, err := NewTracer(context.Background(), NewJSONExporter(&out), nil)
+	if err != nil {
+		t.Fatalf("NewTracer() error = %v", err)
+	}
+	ctx := WithTracer(context.Background(), tracer)
+
+	ctx, iteration := Start(ctx, "iteration")
+	containerCtx, container := Start(ctx, "container", "name", "web", "ignored")
+	_, call := Start(containerCtx, "docker.ContainerStop")
+	call.End(errors.New("timeout"))
+	call.End(nil)
+	container.SetAttribute("strategy", "recreate")
+	container.End(nil)
+	iteration.End(nil)
+
+	var spans []Data
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		var span Data
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("span %s is not json: %v", scanner.Text(), err)
+		}
+		spans = append(spans, span)
+	}
+	if len(spans) != 3 {
+		t.Fatalf("exported %d spans, want 3 ended once each", len(spans))
+	}
+	gotCall, gotContainer, gotIteration := spans[0], spans[1], spans[2]
+	if gotCall.Name != "docker.ContainerStop" || gotCall.Error != "timeout" {
+		t.Errorf("call span = %+v, want the failed call", gotCall)
+	}
+	nested := gotCall.ParentID == gotContainer.SpanID && gotContainer.ParentID == gotIteration.SpanID
+	if !nested || gotIteration.ParentID != "" {
+		t.Errorf("spans aren't nested: %+v", spans)
+	}
+	for _, span := range spans {
+		if span.TraceID != gotIteration.TraceID {
+			t.Errorf("span %s has trace %s, want %s", span.Name, span.TraceID, gotIteration.TraceID)
+		}
+		if span.End.Before(span.Start) || span.Duration < 0 {
+			t.Errorf("span %s ends before it starts", span.Name)
+		}
+	}
+	want := map[string]string{"name": "web", "strategy": "recreate"}
+	if !reflect.DeepEqual(gotContainer.Attributes, want) {
+		t.Errorf("container span attributes = %v, want %v", gotContainer.Attributes, want)
+	}
+}
+
+func TestStart_withoutTracer(t *testing.T) {
+	ctx, span := Start(context.Background(), "iteration")
+	if span != nil {
+		t.Errorf("Start() without a tracer = %+v, want nil", span)
+	}
+	// A nil span does nothing
+	span.SetAttribute("a", "1")
+	span.End(nil)
+	if _, child := Start(ctx, "container"); child != nil {
+		t.Errorf("Start() of a child without a tracer = %+v, want nil", child)
+	}
+}
@@ -0,0 +1,347 @@
+// Package webhook notifies external services about container updates over http
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// Event is something that happened to a container
+type Event string
+
+const (
+	// EventSuccess means a container was recreated with new labels
+	EventSuccess Event = "success"
+	// EventFailure means a container update failed and the old container might need manual recovery
+	EventFailure Event = "failure"
+	// EventRollback means a container update failed and the old container was restored
+	EventRollback Event = "rollback"
+	// EventOrphan means a container left behind by an update was found
+	EventOrphan Event = "orphan"
+)
+
+// Formats of webhook payloads
+const (
+	// FormatJSON posts the Payload as json
+	FormatJSON = "json"
+	// FormatSlack posts a message compatible with slack incoming webhooks
+	FormatSlack = "slack"
+)
+
+// SignatureHeader is the header holding the hex encoded HMAC-SHA256 of json payloads, ex. "sha256=..."
+const SignatureHeader = "X-Discriminator-Signature"
+
+// Target is an url notified about events
+type Target struct {
+	URL string `yaml:"url"`
+	// Format is FormatJSON or FormatSlack, defaults to FormatJSON
+	Format string `yaml:"format"`
+	// Secret signs json payloads, if set
+	Secret string `yaml:"secret"`
+	// Events are the events to notify about, defaults to all
+	Events []Event `yaml:"events"`
+}
+
+// Payload is the json body posted to targets
+type Payload struct {
+	Event Event     `json:"event"`
+	Time  time.Time `json:"time"`
+	Host  string    `json:"host,omitempty"`
+	Name  string    `json:"name"`
+	ID    string    `json:"id"`
+	NewID string    `json:"newId,omitempty"`
+	// Strategy is the update strategy used
+	Strategy string     `json:"strategy,omitempty"`
+	Diff     audit.Diff `json:"diff"`
+	Error    string     `json:"error,omitempty"`
+}
+
+// Options configures a Notifier
+type Options struct {
+	Targets []Target
+	// QueueSize is the number of payloads waiting to be sent before new ones are dropped, defaults to 100
+	QueueSize int
+	// MaxAttempts is the number of times a payload is sent to a target before giving up, defaults to 3
+	MaxAttempts int
+	// RetryDelay is the time before the first retry, doubled for every retry, defaults to 1s
+	RetryDelay time.Duration
+	// Client sends the requests, defaults to a client with a 10s timeout
+	Client *http.Client
+}
+
+// Notifier posts events to the targets in the background
+//
+// Payloads are queued and sent in order by a single worker, failed requests are retried.
+// The queue is bounded, payloads are dropped when it is full so that updates never wait for webhooks.
+type Notifier struct {
+	options Options
+	queue   chan Payload
+	done    chan struct{}
+
+	mu      sync.Mutex
+	closed  bool
+	orphans map[string]bool
+}
+
+// LoadTargetsFromPath loads a list of targets from a yaml file on the form
+//
+//   - url: https://example.com/hooks/discriminator
+//     secret: my-secret
+//     events: [failure, rollback, orphan]
+//   - url: https://hooks.slack.com/services/...
+//     format: slack
+func LoadTargetsFromPath(_ context.Context, filePath string) ([]Target, error) {
+	content, err := ioutil.ReadFile(filePath) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read webhooks file %s", filePath)
+	}
+	var targets []Target
+	if err := yaml.UnmarshalStrict(content, &targets); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse webhooks file %s", filePath)
+	}
+	return targets, nil
+}
+
+// NewNotifier validates the targets and starts sending notifications
+func NewNotifier(_ context.Context, options Options) (*Notifier, error) {
+	options.Targets = append([]Target{}, options.Targets...)
+	for i, target := range options.Targets {
+		if target.URL == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i+1)
+		}
+		switch target.Format {
+		case "":
+			options.Targets[i].Format = FormatJSON
+		case FormatJSON, FormatSlack:
+		default:
+			return nil, fmt.Errorf("unknown format %s of webhook %s", target.Format, target.URL)
+		}
+		for _, event := range target.Events {
+			switch event {
+			case EventSuccess, EventFailure, EventRollback, EventOrphan:
+			default:
+				return nil, fmt.Errorf("unknown event %s of webhook %s", event, target.URL)
+			}
+		}
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = 100
+	}
+	if options.MaxAttempts <= 0 {
+		options.MaxAttempts = 3
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = time.Second
+	}
+	if options.Client == nil {
+		options.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	n := &Notifier{
+		options: options,
+		queue:   make(chan Payload, options.QueueSize),
+		done:    make(chan struct{}),
+		orphans: make(map[string]bool),
+	}
+	go n.work()
+	return n, nil
+}
+
+// Append queues a notification about the recreation described by the audit entry
+//
+// Entries that aren't success, failure or rollback, ex. notified labels, are ignored
+func (n *Notifier) Append(entry audit.Entry) error {
+	var event Event
+	switch entry.Outcome {
+	case audit.OutcomeSuccess:
+		event = EventSuccess
+	case audit.OutcomeFailed:
+		event = EventFailure
+	case audit.OutcomeRolledBack:
+		event = EventRollback
+	default:
+		return nil
+	}
+	n.enqueue(Payload{
+		Event:    event,
+		Time:     entry.Time,
+		Host:     entry.Host,
+		Name:     entry.Name,
+		ID:       entry.OldID,
+		NewID:    entry.NewID,
+		Strategy: entry.Strategy,
+		Diff:     entry.Diff,
+		Error:    entry.Error,
+	})
+	return nil
+}
+
+// Orphan queues a notification about a container left behind by an update
+//
+// Every orphan is only notified about once
+func (n *Notifier) Orphan(host, name, id string) {
+	n.mu.Lock()
+	seen := n.orphans[id]
+	n.orphans[id] = true
+	n.mu.Unlock()
+	if seen {
+		return
+	}
+	n.enqueue(Payload{Event: EventOrphan, Time: time.Now(), Host: host, Name: name, ID: id})
+}
+
+// Close stops accepting notifications and waits for the queued ones to be sent
+func (n *Notifier) Close() error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+	<-n.done
+	return nil
+}
+
+func (n *Notifier) enqueue(payload Payload) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	select {
+	case n.queue <- payload:
+	default:
+		logrus.Warnf("Webhook queue is full, dropping %s notification for container %s", payload.Event, payload.Name)
+	}
+}
+
+// work sends the queued payloads until the queue is closed
+func (n *Notifier) work() {
+	defer close(n.done)
+	for payload := range n.queue {
+		for _, target := range n.options.Targets {
+			if !target.wants(payload.Event) {
+				continue
+			}
+			err := n.send(target, payload)
+			if err != nil {
+				logrus.WithError(err).Errorf(
+					"Failed to send %s notification for container %s to %s", payload.Event, payload.Name, target.URL,
+				)
+			}
+		}
+	}
+}
+
+// send posts the payload to the target, retrying with exponential backoff
+func (n *Notifier) send(target Target, payload Payload) error {
+	body, err := target.body(payload)
+	if err != nil {
+		return err
+	}
+	delay := n.options.RetryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(target, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= n.options.MaxAttempts {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+		logrus.WithError(err).Debugf("Retrying notification to %s in %s", target.URL, delay)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// post makes one request and reports whether a failed request should be retried
+func (n *Notifier) post(target Target, body []byte) (bool, error) {
+	request, err := http.NewRequest(http.MethodPost, target.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to create request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if target.Secret != "" && target.Format == FormatJSON {
+		request.Header.Set(SignatureHeader, "sha256="+Sign(target.Secret, body))
+	}
+	response, err := n.options.Client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook responded with status %s", response.Status)
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the body with the secret
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body) //nolint:errcheck
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (t Target) wants(event Event) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, e := range t.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// body encodes the payload in the format of the target
+func (t Target) body(payload Payload) ([]byte, error) {
+	if t.Format == FormatSlack {
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{Text: message(payload)})
+	}
+	return json.Marshal(payload)
+}
+
+// message describes the payload in a sentence
+func message(payload Payload) string {
+	name := strings.TrimPrefix(payload.Name, "/")
+	if payload.Host != "" {
+		name = payload.Host + "/" + name
+	}
+	var text string
+	switch payload.Event {
+	case EventSuccess:
+		text = fmt.Sprintf("Container %s was recreated with new labels", name)
+		if keys := payload.Diff.Keys(); len(keys) > 0 {
+			text += ": " + strings.Join(keys, ", ")
+		}
+	case EventFailure:
+		text = fmt.Sprintf("Updating container %s failed and it might need manual recovery", name)
+	case EventRollback:
+		text = fmt.Sprintf("Updating container %s failed and the old container was restored", name)
+	case EventOrphan:
+		text = fmt.Sprintf("Container %s was left behind by an update", name)
+	}
+	if payload.Error != "" {
+		text += fmt.Sprintf(" (%s)", payload.Error)
+	}
+	return text
+}
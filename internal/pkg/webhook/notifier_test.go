@@ -0,0 +1,207 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+)
+
+// recorder is a webhook receiver recording the requests it gets,
+// responding with the statuses in order and 200 once they run out
+type recorder struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, body)
+	if len(r.statuses) > 0 {
+		w.WriteHeader(r.statuses[0])
+		r.statuses = r.statuses[1:]
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	entry := audit.Entry{
+		Time:    time.Date(2020, time.January, 4, 2, 0, 0, 0, time.UTC),
+		Host:    "prod",
+		Name:    "/web",
+		OldID:   "old",
+		NewID:   "new",
+		Diff:    audit.Diff{Added: map[string]string{"a": "1"}},
+		Outcome: audit.OutcomeSuccess,
+	}
+	tests := []struct {
+		name     string
+		target   Target
+		statuses []int
+		notify   func(n *Notifier)
+		// want are parts of the bodies of the expected requests
+		want []string
+	}{
+		{
+			name:   "json",
+			target: Target{Secret: "secret"},
+			notify: func(n *Notifier) {
+				n.Append(entry) //nolint:errcheck
+			},
+			want: []string{`"event":"success","time":"2020-01-04T02:00:00Z","host":"prod","name":"/web","id":"old"`},
+		},
+		{
+			name:   "slack",
+			target: Target{Format: FormatSlack},
+			notify: func(n *Notifier) {
+				failed := entry
+				failed.Outcome = audit.OutcomeRolledBack
+				failed.Error = "unhealthy"
+				n.Append(failed) //nolint:errcheck
+			},
+			want: []string{`{"text":"Updating container prod/web failed and the old container was restored (unhealthy)"}`},
+		},
+		{
+			name:   "filtered events",
+			target: Target{Events: []Event{EventFailure, EventOrphan}},
+			notify: func(n *Notifier) {
+				n.Append(entry) //nolint:errcheck
+				failed := entry
+				failed.Outcome = audit.OutcomeFailed
+				n.Append(failed) //nolint:errcheck
+				notified := entry
+				notified.Outcome = audit.OutcomeNotified
+				n.Append(notified) //nolint:errcheck
+			},
+			want: []string{`"event":"failure"`},
+		},
+		{
+			name: "orphans notified once",
+			notify: func(n *Notifier) {
+				n.Orphan("prod", "/web-old", "1")
+				n.Orphan("prod", "/web-old", "1")
+				n.Orphan("prod", "/api-new", "2")
+			},
+			want: []string{`"event":"orphan"`, `"name":"/api-new"`},
+		},
+		{
+			name:     "retried",
+			statuses: []int{http.StatusBadGateway, http.StatusTooManyRequests},
+			notify: func(n *Notifier) {
+				n.Append(entry) //nolint:errcheck
+			},
+			want: []string{`"event":"success"`, `"event":"success"`, `"event":"success"`},
+		},
+		{
+			name:     "given up",
+			statuses: []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			notify: func(n *Notifier) {
+				n.Append(entry) //nolint:errcheck
+			},
+			want: []string{`"event":"success"`, `"event":"success"`, `"event":"success"`},
+		},
+		{
+			name:     "not retried on client errors",
+			statuses: []int{http.StatusBadRequest},
+			notify: func(n *Notifier) {
+				n.Append(entry) //nolint:errcheck
+			},
+			want: []string{`"event":"success"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &recorder{statuses: tt.statuses}
+			server := httptest.NewServer(r)
+			defer server.Close()
+			target := tt.target
+			target.URL = server.URL
+			n, err := NewNotifier(context.Background(), Options{
+				Targets:    []Target{target},
+				RetryDelay: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatalf("NewNotifier() error = %v", err)
+			}
+			tt.notify(n)
+			n.Close() //nolint:errcheck
+
+			if len(r.bodies) != len(tt.want) {
+				t.Fatalf("got %d requests, want %d: %q", len(r.bodies), len(tt.want), r.bodies)
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(string(r.bodies[i]), want) {
+					t.Errorf("request %d = %s, want it to contain %s", i, r.bodies[i], want)
+				}
+				signature := r.requests[i].Header.Get(SignatureHeader)
+				if target.Secret != "" && signature != "sha256="+Sign(target.Secret, r.bodies[i]) {
+					t.Errorf("request %d signature = %q, want the signature of the body", i, signature)
+				}
+				if target.Secret == "" && signature != "" {
+					t.Errorf("request %d signed without a secret", i)
+				}
+				var decoded map[string]interface{}
+				if err := json.Unmarshal(r.bodies[i], &decoded); err != nil {
+					t.Errorf("request %d is not json: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNotifier_queueFull(t *testing.T) {
+	release := make(chan struct{})
+	received := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		<-release
+	}))
+	defer server.Close()
+	n, err := NewNotifier(context.Background(), Options{
+		Targets:   []Target{{URL: server.URL}},
+		QueueSize: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+	n.Orphan("", "/a-old", "1")
+	// Wait until the worker is busy with the first payload
+	<-received
+	for _, id := range []string{"2", "3", "4"} {
+		n.Orphan("", "/b-old", id)
+	}
+	close(release)
+	n.Close() //nolint:errcheck
+	if got := len(received); got != 1 {
+		t.Errorf("got %d queued requests after the first, want 1", got)
+	}
+}
+
+func TestNewNotifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		target Target
+	}{
+		{name: "missing url", target: Target{}},
+		{name: "unknown format", target: Target{URL: "http://localhost", Format: "xml"}},
+		{name: "unknown event", target: Target{URL: "http://localhost", Events: []Event{"started"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewNotifier(context.Background(), Options{Targets: []Target{tt.target}}); err == nil {
+				t.Errorf("NewNotifier() expected error")
+			}
+		})
+	}
+}
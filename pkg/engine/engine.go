@@ -0,0 +1,267 @@
+// Package engine evaluates instructions against containers, rendering templates into the labels the containers
+// should have, without changing any containers.
+//
+// It is the label engine of the discriminator daemon, for use in other tools. An engine is created from sources of
+// templates and aliases, and evaluated for a container:
+//
+//	e, err := engine.NewEngine(ctx, engine.Options{
+//		Sources: []engine.Source{engine.Static{Templates: map[string]string{"web": "+port={{.Arguments.port}}"}}},
+//	})
+//	result, err := e.Evaluate(ctx, "web(port: 80)", engine.ContainerData{Name: "web"})
+package engine
+
+import (
+	"context"
+	"fmt"
+	"text/template"
+
+	"github.com/pkg/errors"
+
+	"github.com/sirupsen/logrus"
+
+	"sidus.io/discriminator/internal/pkg/audit"
+	"sidus.io/discriminator/internal/pkg/labels"
+	"sidus.io/discriminator/internal/pkg/parsing"
+	"sidus.io/discriminator/internal/pkg/policy"
+	"sidus.io/discriminator/internal/pkg/templates"
+)
+
+// DefaultMaxIterations is the number of times instructions are evaluated if Options.MaxIterations isn't set
+const DefaultMaxIterations = 10
+
+// Options configures an engine
+type Options struct {
+	// Sources provide the templates and aliases, a name defined by more than one source is an error
+	Sources []Source
+	// Funcs are functions the templates can call, in addition to the predefined functions of text/template
+	Funcs template.FuncMap
+	// Label is the key of the labels with instructions, ex. "io.sidus.discriminator".
+	// Instructions in the labels of containers are only evaluated if it is set.
+	// Templates may never change the label or the labels suffixed from it, ex. "io.sidus.discriminator.10-base".
+	Label string
+	// MaxIterations is the number of times instructions are evaluated before giving up on the labels converging
+	MaxIterations int
+	// Protected are label keys templates may never change
+	Protected []string
+	// Namespaces map template names to the label keys the templates may change,
+	// templates not matching any namespace may change every label that isn't protected.
+	// A name ending with "*" matches everything starting with the rest, ex. "traefik/*": {"traefik.*"}
+	Namespaces map[string][]string
+}
+
+// ContainerData is what templates know about a container
+type ContainerData struct {
+	Name string
+	// Host is the name of the docker host the container runs on
+	Host   string
+	Labels map[string]string
+}
+
+// Result is the outcome of evaluating instructions for a container
+type Result struct {
+	// Labels are the labels the container should have
+	Labels map[string]string
+	// Diff is the difference from the labels of the container to Labels
+	Diff Diff
+	// Provenance maps the key of every label in the diff to the template that made the last change to it
+	Provenance map[string]string
+	// Violations are the changes that were left out since the templates weren't allowed to make them
+	Violations []Violation
+	// Iterations is the number of times the instructions were evaluated until the labels stopped changing
+	Iterations int
+}
+
+// Diff is the difference between two sets of labels
+type Diff struct {
+	Added   map[string]string `json:"added,omitempty"`
+	Removed map[string]string `json:"removed,omitempty"`
+	Changed map[string]Change `json:"changed,omitempty"`
+}
+
+// Change is a label with a changed value
+type Change struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Violation is a change to a label a template wasn't allowed to make
+type Violation struct {
+	Template string `json:"template"`
+	Key      string `json:"key"`
+	Reason   string `json:"reason"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("template %s may not change %s: %s", v.Template, v.Key, v.Reason)
+}
+
+// Engine evaluates instructions, it is safe for concurrent use
+type Engine struct {
+	parser        parsing.Parser
+	policy        *policy.Policy
+	label         string
+	maxIterations int
+	count         int
+}
+
+// NewEngine loads the sources and creates an engine
+func NewEngine(ctx context.Context, options Options) (*Engine, error) {
+	definitions := Definitions{Templates: make(map[string]string), Aliases: make(map[string]string)}
+	for _, source := range options.Sources {
+		loaded, err := source.Load(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := definitions.merge(loaded); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpls, partials, err := templates.ParseTemplates(ctx, definitions.Templates, options.Funcs)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load templates")
+	}
+	directory, err := templates.NewDirectory(ctx, tmpls, partials)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create template directory")
+	}
+	aliases := parsing.ParseAliases(ctx, definitions.Aliases)
+	parser, err := parsing.NewParser(ctx, directory, aliases)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create parser")
+	}
+	protected := options.Protected
+	if options.Label != "" {
+		protected = append([]string{options.Label, options.Label + ".*"}, options.Protected...)
+	}
+	p, err := policy.NewPolicy(ctx, protected, options.Namespaces)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create label policy")
+	}
+
+	maxIterations := options.MaxIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxIterations
+	}
+	return &Engine{
+		parser:        parser,
+		policy:        p,
+		label:         options.Label,
+		maxIterations: maxIterations,
+		count:         directory.Count(ctx) + len(aliases),
+	}, nil
+}
+
+// Count returns the number of templates and aliases that can be used in instructions
+func (e *Engine) Count(_ context.Context) int {
+	return e.count
+}
+
+// Instruction chains the instruction with the instructions in the labels, the way Evaluate evaluates them
+func (e *Engine) Instruction(instruction string, labels map[string]string) string {
+	collected := ""
+	if e.label != "" {
+		collected, _ = parsing.CollectInstruction(labels, e.label)
+	}
+	switch {
+	case instruction == "":
+		return collected
+	case collected == "":
+		return instruction
+	default:
+		return instruction + " | " + collected
+	}
+}
+
+// Evaluate evaluates the instruction, followed by the instructions in the labels of the container,
+// and returns the labels the container should have
+//
+// Instructions are on the form "template(argument: value) | alias()". Templates may change labels that
+// instructions depend on, ex. in conditions, so the instructions are evaluated again on the new labels
+// until they no longer change. Fails if that doesn't happen within the maximum iterations.
+func (e *Engine) Evaluate(ctx context.Context, instruction string, container ContainerData) (Result, error) {
+	current := clone(container.Labels)
+	provenance := make(map[string]string)
+	// Every iteration applies all instructions again, so the violations of the last iteration are the ones that count
+	var violations []policy.Violation
+	for i := 1; i <= e.maxIterations; i++ {
+		full := e.Instruction(instruction, current)
+		if full == "" {
+			return newResult(container.Labels, current, provenance, violations, i-1), nil
+		}
+		logrus.WithContext(ctx).Debugf("Processing instruction %s (iteration %d)", full, i)
+		modifiers, err := e.parser.Process(ctx, full, templates.ContainerData{
+			Labels: current,
+			Name:   container.Name,
+			Host:   container.Host,
+		})
+		if err != nil {
+			return Result{}, errors.Wrapf(err, "failed to process instruction %s", full)
+		}
+
+		logrus.WithContext(ctx).Debugf("Applying modifiers %+v", modifiers)
+		next := clone(current)
+		violations = nil
+		for _, modifier := range modifiers {
+			before := clone(next)
+			violations = append(violations, e.policy.Apply(next, labels.Modifiers{modifier})...)
+			for _, key := range audit.NewDiff(before, next).Keys() {
+				provenance[key] = modifier.Template
+			}
+		}
+		if equal(next, current) {
+			return newResult(container.Labels, current, provenance, violations, i), nil
+		}
+		current = next
+	}
+	return Result{}, fmt.Errorf("labels did not converge within %d iterations", e.maxIterations)
+}
+
+// newResult describes the change from the original to the final labels
+func newResult(
+	original, final map[string]string,
+	provenance map[string]string,
+	violations []policy.Violation,
+	iterations int,
+) Result {
+	d := audit.NewDiff(original, final)
+	r := Result{
+		Labels:     final,
+		Diff:       Diff{Added: d.Added, Removed: d.Removed, Changed: make(map[string]Change, len(d.Changed))},
+		Provenance: make(map[string]string),
+		Iterations: iterations,
+	}
+	for key, change := range d.Changed {
+		r.Diff.Changed[key] = Change{From: change.From, To: change.To}
+	}
+	// Labels changed back to their original value aren't in the diff
+	for _, key := range d.Keys() {
+		r.Provenance[key] = provenance[key]
+	}
+	for _, violation := range violations {
+		r.Violations = append(r.Violations, Violation(violation))
+	}
+	return r
+}
+
+// clone copies the labels, a nil map is copied to an empty map
+func clone(original map[string]string) map[string]string {
+	copied := make(map[string]string, len(original))
+	for key, value := range original {
+		copied[key] = value
+	}
+	return copied
+}
+
+// equal reports whether the labels are the same
+func equal(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, ok := b[key]; !ok || other != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package engine_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+
+	"sidus.io/discriminator/pkg/engine"
+)
+
+func TestEngine_Evaluate(t *testing.T) {
+	source := engine.Static{Templates: map[string]string{
+		"base":   "+a=1",
+		"extra":  "+b=2",
+		"chain":  "+instruction.20=extra()",
+		"flip":   `{{if eq (index .Labels "x") "1"}}+x=2{{else}}+x=1{{end}}`,
+		"remove": "-instruction\n+removed=true",
+	}}
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		instruction    string
+		protected      []string
+		want           map[string]string
+		wantProvenance map[string]string
+		wantViolations []string
+		wantErr        bool
+	}{
+		{
+			name:           "instruction only",
+			labels:         map[string]string{},
+			instruction:    "extra()",
+			want:           map[string]string{"b": "2"},
+			wantProvenance: map[string]string{"b": "extra"},
+		},
+		{
+			name:        "labels converge",
+			labels:      map[string]string{"instruction": "when(label: a=1) extra()"},
+			instruction: "base()",
+			want: map[string]string{
+				"instruction": "when(label: a=1) extra()",
+				"a":           "1",
+				"b":           "2",
+			},
+			wantProvenance: map[string]string{"a": "base", "b": "extra"},
+		},
+		{
+			name:           "instruction added by template",
+			labels:         map[string]string{"instruction": "chain()"},
+			want:           map[string]string{"instruction": "chain()"},
+			wantProvenance: map[string]string{},
+			wantViolations: []string{"instruction.20"},
+		},
+		{
+			name:           "instruction removed by template",
+			labels:         map[string]string{"instruction": "remove()"},
+			want:           map[string]string{"instruction": "remove()", "removed": "true"},
+			wantProvenance: map[string]string{"removed": "remove"},
+			wantViolations: []string{"instruction"},
+		},
+		{
+			name:      "protected labels",
+			labels:    map[string]string{"instruction": "base()", "instruction.10": "extra()"},
+			protected: []string{"a"},
+			want: map[string]string{
+				"instruction":    "base()",
+				"instruction.10": "extra()",
+				"b":              "2",
+			},
+			wantProvenance: map[string]string{"b": "extra"},
+			wantViolations: []string{"a"},
+		},
+		{
+			name:           "nothing to evaluate",
+			labels:         map[string]string{"a": "1"},
+			want:           map[string]string{"a": "1"},
+			wantProvenance: map[string]string{},
+		},
+		{
+			name:    "never converges",
+			labels:  map[string]string{"instruction": "flip()"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown template",
+			labels:  map[string]string{"instruction": "unknown()"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := engine.NewEngine(context.Background(), engine.Options{
+				Sources:   []engine.Source{source},
+				Label:     "instruction",
+				Protected: tt.protected,
+			})
+			if err != nil {
+				t.Fatalf("NewEngine() error = %v", err)
+			}
+			got, err := e.Evaluate(context.Background(), tt.instruction, engine.ContainerData{Labels: tt.labels})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Evaluate() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Labels, tt.want) {
+				t.Errorf("Evaluate() labels = %v, want %v", got.Labels, tt.want)
+			}
+			if !reflect.DeepEqual(got.Provenance, tt.wantProvenance) {
+				t.Errorf("Evaluate() provenance = %v, want %v", got.Provenance, tt.wantProvenance)
+			}
+			keys := make([]string, len(got.Violations))
+			for i, violation := range got.Violations {
+				keys[i] = violation.Key
+			}
+			if fmt.Sprint(keys) != fmt.Sprint(tt.wantViolations) {
+				t.Errorf("Evaluate() violations = %v, want %v", got.Violations, tt.wantViolations)
+			}
+		})
+	}
+}
+
+func TestEngine_Evaluate_diff(t *testing.T) {
+	e, err := engine.NewEngine(context.Background(), engine.Options{
+		Sources: []engine.Source{engine.Static{
+			Templates: map[string]string{"web": "+port={{.Arguments.port}}\n+host={{.Host}}\n-debug"},
+			Aliases:   map[string]string{"site": "web(port: $port)"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	got, err := e.Evaluate(context.Background(), "site(port: 80)", engine.ContainerData{
+		Name:   "web",
+		Host:   "prod",
+		Labels: map[string]string{"port": "8080", "debug": "true", "host": "prod"},
+	})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	want := engine.Diff{
+		Added:   map[string]string{},
+		Removed: map[string]string{"debug": "true"},
+		Changed: map[string]engine.Change{"port": {From: "8080", To: "80"}},
+	}
+	if !reflect.DeepEqual(got.Diff, want) {
+		t.Errorf("Evaluate() diff = %+v, want %+v", got.Diff, want)
+	}
+	// Templates called through aliases are the origin of their changes
+	wantProvenance := map[string]string{"port": "web", "debug": "web"}
+	if !reflect.DeepEqual(got.Provenance, wantProvenance) {
+		t.Errorf("Evaluate() provenance = %v, want %v", got.Provenance, wantProvenance)
+	}
+	if got.Iterations != 2 {
+		t.Errorf("Evaluate() iterations = %d, want 2", got.Iterations)
+	}
+}
+
+func TestNewEngine_funcs(t *testing.T) {
+	e, err := engine.NewEngine(context.Background(), engine.Options{
+		Sources: []engine.Source{engine.Static{Templates: map[string]string{
+			"_partials/name": `{{define "name"}}{{upper .Name}}{{end}}`,
+			"upper":          `+name={{template "name" .}}`,
+		}}},
+		Funcs: template.FuncMap{"upper": strings.ToUpper},
+	})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	got, err := e.Evaluate(context.Background(), "upper()", engine.ContainerData{Name: "web"})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	if want := map[string]string{"name": "WEB"}; !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("Evaluate() labels = %v, want %v", got.Labels, want)
+	}
+	if _, err := e.Evaluate(context.Background(), "name()", engine.ContainerData{}); err == nil {
+		t.Errorf("Evaluate() expected error for a partial")
+	}
+}
+
+func TestNewEngine_sources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "engine")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"traefik/router.tmpl": "+traefik.router={{.Arguments.domain}}",
+		"webapp.alias":        "traefik/router(domain: $domain) | backup()",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+	directory := engine.Directory{Path: dir, TemplateExtension: ".tmpl", AliasExtension: ".alias"}
+	embedded := engine.Static{Templates: map[string]string{"backup": "+backup=true"}}
+
+	e, err := engine.NewEngine(context.Background(), engine.Options{Sources: []engine.Source{directory, embedded}})
+	if err != nil {
+		t.Fatalf("NewEngine() error = %v", err)
+	}
+	if got := e.Count(context.Background()); got != 3 {
+		t.Errorf("Count() = %d, want 3", got)
+	}
+	got, err := e.Evaluate(context.Background(), "webapp(domain: example.com)", engine.ContainerData{})
+	if err != nil {
+		t.Fatalf("Evaluate() error = %v", err)
+	}
+	want := map[string]string{"traefik.router": "example.com", "backup": "true"}
+	if !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("Evaluate() labels = %v, want %v", got.Labels, want)
+	}
+
+	duplicate := engine.Static{Templates: map[string]string{"traefik/router": "+other=true"}}
+	if _, err := engine.NewEngine(context.Background(), engine.Options{
+		Sources: []engine.Source{directory, duplicate},
+	}); err == nil {
+		t.Errorf("NewEngine() expected error for a template defined by two sources")
+	}
+}
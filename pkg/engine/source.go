@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"sidus.io/discriminator/internal/pkg/parsing"
+	"sidus.io/discriminator/internal/pkg/templates"
+)
+
+// Source provides templates and aliases to an engine
+type Source interface {
+	// Load returns the definitions of the source, it is called once when the engine is created
+	Load(ctx context.Context) (Definitions, error)
+}
+
+// Definitions are templates and aliases by name
+//
+// Names can contain "/", ex. "traefik/router". Templates in a "_partials" directory, ex. "_partials/enable",
+// can only be included by other templates.
+type Definitions struct {
+	// Templates map names to the text of go templates, rendering lines on the form "+key=value" and "-key"
+	Templates map[string]string
+	// Aliases map names to the instructions the aliases expand into, ex. "traefik(domain: $domain) | backup()"
+	Aliases map[string]string
+}
+
+// Static is a source of fixed definitions, ex. templates embedded in a program
+type Static Definitions
+
+// Load returns the definitions
+func (s Static) Load(_ context.Context) (Definitions, error) {
+	return Definitions(s), nil
+}
+
+// Directory is a source of the template and alias files in a directory, the way the daemon loads them
+//
+// Templates and aliases are named after their path relative to the directory, without the extension,
+// ex. "traefik/router.tmpl" is named "traefik/router"
+type Directory struct {
+	Path string
+	// TemplateExtension is the extension of template files, ex. ".tmpl"
+	TemplateExtension string
+	// AliasExtension is the extension of alias files, ex. ".alias"
+	AliasExtension string
+}
+
+// Load reads the templates and aliases in the directory
+func (d Directory) Load(ctx context.Context) (Definitions, error) {
+	tmpls, err := templates.ReadTemplatesFromPath(ctx, d.Path, d.TemplateExtension)
+	if err != nil {
+		return Definitions{}, errors.Wrapf(err, "failed to load templates")
+	}
+	aliases, err := parsing.ReadAliasesFromPath(ctx, d.Path, d.AliasExtension)
+	if err != nil {
+		return Definitions{}, errors.Wrapf(err, "failed to load aliases")
+	}
+	return Definitions{Templates: tmpls, Aliases: aliases}, nil
+}
+
+// merge adds the definitions of a source, failing if a name is already defined
+func (d *Definitions) merge(source Definitions) error {
+	for name, text := range source.Templates {
+		if _, ok := d.Templates[name]; ok {
+			return fmt.Errorf("template %s is defined by more than one source", name)
+		}
+		d.Templates[name] = text
+	}
+	for name, instruction := range source.Aliases {
+		if _, ok := d.Aliases[name]; ok {
+			return fmt.Errorf("alias %s is defined by more than one source", name)
+		}
+		d.Aliases[name] = instruction
+	}
+	return nil
+}